@@ -12,6 +12,7 @@ type commandArgs struct {
 	Args         map[string]bool
 	ExpectedArgs []string
 	OptionalArgs []string
+	Variadic     bool
 	HandlerFunc  func(map[string]string)
 }
 
@@ -62,11 +63,133 @@ var commandsMap = map[string]commandArgs{
 		HandlerFunc:  handlers.CommitTree,
 	},
 	"clone": {
-		Args:         map[string]bool{},
+		Args: map[string]bool{
+			"-b":                true,
+			"--depth":           true,
+			"--shallow-since":   true,
+			"--shallow-exclude": true,
+			"--filter":          true,
+		},
 		ExpectedArgs: []string{"arg1", "arg2"},
-		OptionalArgs: []string{"arg2"},
+		OptionalArgs: []string{"arg2", "-b", "--depth", "--shallow-since", "--shallow-exclude", "--filter"},
 		HandlerFunc:  handlers.CloneRepository,
 	},
+	"fetch": {
+		Args: map[string]bool{
+			"--depth":          true,
+			"--deepen":         true,
+			"--unshallow":      false,
+			"--filter":         true,
+			"--update-head-ok": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"arg1", "--depth", "--deepen", "--unshallow", "--filter", "--update-head-ok"},
+		Variadic:     true,
+		HandlerFunc:  handlers.Fetch,
+	},
+	"bundle": {
+		Args: map[string]bool{
+			"--version": true,
+			"--all":     false,
+		},
+		ExpectedArgs: []string{"arg1", "arg2"},
+		OptionalArgs: []string{"--version", "--all"},
+		Variadic:     true,
+		HandlerFunc:  handlers.Bundle,
+	},
+	"index-pack": {
+		Args: map[string]bool{
+			"--stdin":    false,
+			"--fix-thin": false,
+			"-o":         true,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"arg1", "--stdin", "--fix-thin", "-o"},
+		HandlerFunc:  handlers.IndexPack,
+	},
+	"ls-remote": {
+		Args: map[string]bool{
+			"--heads":  false,
+			"--tags":   false,
+			"--symref": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"--heads", "--tags", "--symref"},
+		Variadic:     true,
+		HandlerFunc:  handlers.LsRemote,
+	},
+	"pack-objects": {
+		Args: map[string]bool{
+			"--stdout":            false,
+			"--revs":              false,
+			"--window":            true,
+			"--depth":             true,
+			"--delta-base-offset": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"arg1", "--stdout", "--revs", "--window", "--depth", "--delta-base-offset"},
+		HandlerFunc:  handlers.PackObjects,
+	},
+	"push": {
+		Args: map[string]bool{
+			"-f":                 false,
+			"--force":            false,
+			"--force-with-lease": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"arg1", "-f", "--force", "--force-with-lease"},
+		Variadic:     true,
+		HandlerFunc:  handlers.Push,
+	},
+	"upload-pack": {
+		Args: map[string]bool{
+			"--stateless-rpc":          false,
+			"--advertise-refs":         false,
+			"--http-backend-info-refs": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"--stateless-rpc", "--advertise-refs", "--http-backend-info-refs"},
+		HandlerFunc:  handlers.UploadPack,
+	},
+	"receive-pack": {
+		Args: map[string]bool{
+			"--stateless-rpc":          false,
+			"--advertise-refs":         false,
+			"--http-backend-info-refs": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"--stateless-rpc", "--advertise-refs", "--http-backend-info-refs"},
+		HandlerFunc:  handlers.ReceivePack,
+	},
+	"unpack-objects": {
+		Args: map[string]bool{
+			"-n":       false,
+			"--strict": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"arg1", "-n", "--strict"},
+		HandlerFunc:  handlers.UnpackObjects,
+	},
+	"verify-pack": {
+		Args: map[string]bool{
+			"-v": false,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"-v"},
+		Variadic:     true,
+		HandlerFunc:  handlers.VerifyPack,
+	},
+	"serve": {
+		Args: map[string]bool{
+			"--listen":    true,
+			"--read-only": false,
+			"--auth":      true,
+		},
+		ExpectedArgs: []string{"arg1"},
+		OptionalArgs: []string{"--listen", "--read-only", "--auth"},
+		Variadic:     true,
+		HandlerFunc:  handlers.Serve,
+	},
 }
 
 func getArgs(cmd string, args []string) map[string]string {
@@ -76,10 +199,19 @@ func getArgs(cmd string, args []string) map[string]string {
 	cmdArgsMap := commandsMap[cmd].Args
 	expectedArgs := commandsMap[cmd].ExpectedArgs
 	optionalArgs := commandsMap[cmd].OptionalArgs
+	variadic := commandsMap[cmd].Variadic
 
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 
+		if strings.HasPrefix(arg, "--") && strings.Contains(arg, "=") {
+			name, value, _ := strings.Cut(arg, "=")
+			if _, isArg := cmdArgsMap[name]; isArg {
+				argMap[name] = value
+				continue
+			}
+		}
+
 		if strings.HasPrefix(arg, "-") {
 			expectsVal, isArg := cmdArgsMap[arg]
 
@@ -95,7 +227,7 @@ func getArgs(cmd string, args []string) map[string]string {
 				os.Exit(1)
 			}
 		} else {
-			if posArgCount > len(expectedArgs) {
+			if posArgCount > len(expectedArgs) && !variadic {
 				fmt.Printf("Unexpected argument: %v\n", arg)
 				os.Exit(1)
 			}
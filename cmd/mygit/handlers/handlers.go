@@ -6,6 +6,8 @@ import (
 	"github.com/codecrafters-io/git-starter-go/cmd/mygit/lib"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func InitRepo(args map[string]string) {
@@ -24,10 +26,10 @@ func CatFile(args map[string]string) {
 		lib.HandleError("Error: %s\n", err)
 	}
 
-	zBlob := lib.ReadAndDecompressBlob(hash)
-	defer zBlob.Close()
-
-	fileContents := lib.ReadFileContentsFromDecompressedBlob(zBlob)
+	fileContents, _, _, err := lib.ReadObjectFile(hash)
+	if err != nil {
+		lib.HandleError("Error reading object: %s\n", err)
+	}
 
 	if prettyPrint {
 		fmt.Printf("%s", fileContents)
@@ -91,12 +93,13 @@ func HashObject(args map[string]string) {
 func LsTree(args map[string]string) {
 	hash := args["arg1"]
 	_, nameOnly := args["--name-only"]
-	path := filepath.Join(lib.ObjectsDir, hash[:2], hash[2:])
-	file, err := lib.ReadAndDecompressFile(path)
+	tree, objType, _, err := lib.ReadObjectFile(hash)
 	if err != nil {
 		lib.HandleError("Error reading file: %s\n", err)
 	}
-	tree := lib.ReadContentsFromDecompressedTree(file)
+	if objType != lib.Tree {
+		lib.HandleError("Error: %s is not a tree object\n", hash)
+	}
 	lib.ReadTree(tree, nameOnly)
 }
 
@@ -113,15 +116,305 @@ func CloneRepository(args map[string]string) {
 	localPath := args["arg2"]
 
 	if localPath == "" {
-		localPath = filepath.Base(remoteURL)
-
-		if localPath[len(localPath)-4:] == ".git" {
-			localPath = localPath[:len(localPath)-4]
+		localPath = filepath.Base(strings.TrimSuffix(remoteURL, "/"))
+		if colon := strings.LastIndex(localPath, ":"); colon >= 0 {
+			localPath = localPath[colon+1:]
 		}
+		localPath = strings.TrimSuffix(strings.TrimSuffix(localPath, ".bundle"), ".git")
 	}
 
 	workingDir := os.Getenv("PWD")
-	localPath = filepath.Join(workingDir, localPath)
+	if !filepath.IsAbs(localPath) {
+		localPath = filepath.Join(workingDir, localPath)
+	}
+	if lib.IsLocalURL(remoteURL) && !strings.HasPrefix(remoteURL, "file://") && !filepath.IsAbs(remoteURL) {
+		remoteURL = filepath.Join(workingDir, remoteURL)
+	}
+
+	options := lib.CloneOptions{
+		Branch: args["-b"],
+		Depth:  depthArg(args, "--depth"),
+	}
+	if since, ok := args["--shallow-since"]; ok {
+		timestamp, err := lib.ParseShallowSince(since)
+		if err != nil {
+			lib.HandleError("Error parsing --shallow-since: %s\n", err)
+		}
+		options.ShallowSince = timestamp
+	}
+	if exclude, ok := args["--shallow-exclude"]; ok {
+		options.ShallowExclude = []string{exclude}
+	}
+	options.Filter = filterArg(args)
+
+	lib.CloneRepository(remoteURL, localPath, options)
+}
+
+func Fetch(args map[string]string) {
+	_, unshallow := args["--unshallow"]
+	_, updateHeadOK := args["--update-head-ok"]
+	options := lib.FetchOptions{
+		Depth:        depthArg(args, "--depth"),
+		Deepen:       depthArg(args, "--deepen"),
+		Unshallow:    unshallow,
+		Filter:       filterArg(args),
+		UpdateHeadOK: updateHeadOK,
+	}
+	if positional := positionalArgs(args); len(positional) > 0 {
+		options.Remote = positional[0]
+		options.Refspecs = positional[1:]
+	}
+
+	err := lib.FetchRemote(options)
+	if err != nil {
+		lib.HandleError("Error fetching: %s\n", err)
+	}
+}
+
+func LsRemote(args map[string]string) {
+	_, heads := args["--heads"]
+	_, tags := args["--tags"]
+	_, symref := args["--symref"]
+
+	positional := positionalArgs(args)
+	options := lib.LsRemoteOptions{
+		Heads:    heads,
+		Tags:     tags,
+		Symref:   symref,
+		Patterns: positional[1:],
+	}
+	err := lib.LsRemote(positional[0], options)
+	if err != nil {
+		lib.HandleError("Error listing remote refs: %s\n", err)
+	}
+}
+
+func Bundle(args map[string]string) {
+	positional := positionalArgs(args)
+	subcommand, file := positional[0], positional[1]
+
+	var err error
+	switch subcommand {
+	case "create":
+		_, all := args["--all"]
+		options := lib.BundleOptions{Version: 2, All: all}
+		if version, ok := args["--version"]; ok {
+			options.Version, err = strconv.Atoi(version)
+			if err != nil {
+				lib.HandleError("Invalid bundle version: %s\n", version)
+			}
+		}
+		err = lib.CreateBundle(file, positional[2:], options)
+	case "verify":
+		err = lib.VerifyBundle(file)
+	case "unbundle":
+		err = lib.Unbundle(file, positional[2:])
+	default:
+		lib.HandleError("Unknown bundle subcommand: %s\n", subcommand)
+	}
+	if err != nil {
+		lib.HandleError("Error: %s\n", err)
+	}
+}
+
+func PackObjects(args map[string]string) {
+	_, stdout := args["--stdout"]
+	_, revs := args["--revs"]
+	_, ofsDelta := args["--delta-base-offset"]
+
+	options := lib.PackObjectsOptions{
+		BaseName: args["arg1"],
+		Stdout:   stdout,
+		Revs:     revs,
+		Window:   countArg(args, "--window", 10),
+		Depth:    countArg(args, "--depth", 50),
+		OfsDelta: ofsDelta,
+	}
+	if options.BaseName == "" && !stdout {
+		lib.HandleError("usage: pack-objects [--stdout] [--revs] [--window=<n>] [--depth=<n>] [--delta-base-offset] [<base-name>]\n")
+	}
+	err := lib.PackObjects(os.Stdin, os.Stdout, options)
+	if err != nil {
+		lib.HandleError("Error packing objects: %s\n", err)
+	}
+}
+
+func IndexPack(args map[string]string) {
+	_, stdin := args["--stdin"]
+	_, fixThin := args["--fix-thin"]
+
+	options := lib.IndexPackOptions{
+		Stdin:   stdin,
+		FixThin: fixThin,
+		Output:  args["-o"],
+	}
+	if args["arg1"] == "" && !stdin {
+		lib.HandleError("usage: index-pack [--stdin [--fix-thin]] [-o <index-file>] [<pack-file>]\n")
+	}
+	err := lib.IndexPack(args["arg1"], os.Stdin, options)
+	if err != nil {
+		lib.HandleError("Error indexing pack: %s\n", err)
+	}
+}
+
+func UnpackObjects(args map[string]string) {
+	_, dryRun := args["-n"]
+	_, strict := args["--strict"]
+
+	input := os.Stdin
+	if path := args["arg1"]; path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			lib.HandleError("Error opening pack: %s\n", err)
+		}
+		defer file.Close()
+		input = file
+	}
 
-	lib.CloneRepository(remoteURL, localPath)
+	options := lib.UnpackObjectsOptions{
+		DryRun: dryRun,
+		Strict: strict,
+	}
+	err := lib.UnpackObjects(input, options)
+	if err != nil {
+		lib.HandleError("Error unpacking objects: %s\n", err)
+	}
+}
+
+func VerifyPack(args map[string]string) {
+	_, verbose := args["-v"]
+
+	failed := false
+	for _, path := range positionalArgs(args) {
+		if err := lib.VerifyPack(path, verbose); err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying pack: %s\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func Push(args map[string]string) {
+	_, force := args["--force"]
+	_, forceShort := args["-f"]
+	lease, forceWithLease := args["--force-with-lease"]
+
+	options := lib.PushOptions{
+		Force:          force || forceShort,
+		ForceWithLease: forceWithLease,
+		Lease:          lease,
+	}
+	if positional := positionalArgs(args); len(positional) > 0 {
+		options.Remote = positional[0]
+		options.Refspecs = positional[1:]
+	}
+
+	err := lib.PushRemote(options)
+	if err != nil {
+		lib.HandleError("Error pushing: %s\n", err)
+	}
+}
+
+func UploadPack(args map[string]string) {
+	_, stateless := args["--stateless-rpc"]
+	_, advertiseRefs := args["--advertise-refs"]
+	_, infoRefs := args["--http-backend-info-refs"]
+
+	options := lib.UploadPackOptions{
+		StatelessRPC:  stateless,
+		AdvertiseRefs: advertiseRefs || infoRefs,
+		Protocol:      os.Getenv("GIT_PROTOCOL"),
+	}
+	err := lib.UploadPack(args["arg1"], os.Stdin, os.Stdout, options)
+	if err != nil {
+		lib.HandleError("upload-pack: %s\n", err)
+	}
+}
+
+func ReceivePack(args map[string]string) {
+	_, stateless := args["--stateless-rpc"]
+	_, advertiseRefs := args["--advertise-refs"]
+	_, infoRefs := args["--http-backend-info-refs"]
+
+	options := lib.ReceivePackOptions{
+		StatelessRPC:  stateless,
+		AdvertiseRefs: advertiseRefs || infoRefs,
+	}
+	err := lib.ReceivePack(args["arg1"], os.Stdin, os.Stdout, options)
+	if err != nil {
+		lib.HandleError("receive-pack: %s\n", err)
+	}
+}
+
+func Serve(args map[string]string) {
+	_, readOnly := args["--read-only"]
+	options := lib.ServeOptions{
+		Listen:   args["--listen"],
+		ReadOnly: readOnly,
+	}
+	if options.Listen == "" {
+		options.Listen = ":8080"
+	}
+	if auth, ok := args["--auth"]; ok {
+		username, password, found := strings.Cut(auth, ":")
+		if !found || username == "" {
+			lib.HandleError("--auth expects <user>:<password>\n")
+		}
+		options.Username = username
+		options.Password = password
+	}
+
+	err := lib.ServeRepositories(positionalArgs(args), options)
+	if err != nil {
+		lib.HandleError("Error serving repositories: %s\n", err)
+	}
+}
+
+// depthArg parses a history depth option, which must be a positive number.
+func depthArg(args map[string]string, name string) int {
+	value, ok := args[name]
+	if !ok {
+		return 0
+	}
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth <= 0 {
+		lib.HandleError("depth %s is not a positive number\n", value)
+	}
+	return depth
+}
+
+// countArg parses an option that must be a number no less than zero.
+func countArg(args map[string]string, name string, fallback int) int {
+	value, ok := args[name]
+	if !ok {
+		return fallback
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		lib.HandleError("%s %s is not a valid number\n", name, value)
+	}
+	return count
+}
+
+func filterArg(args map[string]string) string {
+	filter := args["--filter"]
+	if filter != "" {
+		if err := lib.ValidateFilterSpec(filter); err != nil {
+			lib.HandleError("%s\n", err)
+		}
+	}
+	return filter
+}
+
+func positionalArgs(args map[string]string) []string {
+	var positional []string
+	for i := 1; ; i++ {
+		arg, ok := args["arg"+strconv.Itoa(i)]
+		if !ok {
+			return positional
+		}
+		positional = append(positional, arg)
+	}
 }
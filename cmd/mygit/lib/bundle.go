@@ -0,0 +1,509 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Bundle files start with one of these lines. Version 3 adds capability
+// lines, such as the object format, after it.
+const (
+	bundleSignatureV2 = "# v2 git bundle"
+	bundleSignatureV3 = "# v3 git bundle"
+)
+
+// BundleOptions controls what CreateBundle writes.
+type BundleOptions struct {
+	// Version is the bundle format, 2 or 3
+	Version int
+	// All bundles every ref and HEAD, as if each had been named
+	All bool
+}
+
+// bundleHeader is what a bundle file lists ahead of its pack: the commits a
+// repository must already have to take the pack, and the refs it carries.
+type bundleHeader struct {
+	version       int
+	prerequisites []bundlePrerequisite
+	refs          []Ref
+}
+
+type bundlePrerequisite struct {
+	hash string
+	// comment is the commit's subject, kept for the reader's benefit
+	comment string
+}
+
+// CreateBundle writes the objects selected by revs to a bundle at path.
+// Each rev is a ref or commit to include, "^<rev>" to exclude, or a
+// "<from>..<to>" range; the refs among them are recorded in the header.
+func CreateBundle(path string, revs []string, options BundleOptions) error {
+	if options.Version != 2 && options.Version != 3 {
+		return fmt.Errorf("unsupported bundle version %d", options.Version)
+	}
+
+	var refs []Ref
+	var include, exclude []string
+	addInclude := func(rev string) error {
+		refName, hash, err := resolveRevision(rev)
+		if err != nil {
+			return err
+		}
+		if refName != "" {
+			refs = append(refs, Ref{Hash: hash, Name: refName})
+		}
+		include = append(include, hash)
+		return nil
+	}
+	addExclude := func(rev string) error {
+		_, hash, err := resolveRevision(rev)
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, hash)
+		return nil
+	}
+
+	if options.All {
+		allRefs, err := ListRefs("refs/")
+		if err != nil {
+			return err
+		}
+		for _, ref := range allRefs {
+			refs = append(refs, ref)
+			include = append(include, ref.Hash)
+		}
+		if head, err := ResolveRef("HEAD"); err == nil && head != "" {
+			refs = append(refs, Ref{Hash: head, Name: "HEAD"})
+			include = append(include, head)
+		}
+	}
+	for _, rev := range revs {
+		var err error
+		if from, to, found := strings.Cut(rev, ".."); found {
+			if from == "" {
+				from = "HEAD"
+			}
+			if to == "" {
+				to = "HEAD"
+			}
+			err = addExclude(from)
+			if err == nil {
+				err = addInclude(to)
+			}
+		} else if strings.HasPrefix(rev, "^") {
+			err = addExclude(rev[1:])
+		} else {
+			err = addInclude(rev)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	objects, err := listObjects(include, exclude)
+	if err != nil {
+		return err
+	}
+	included := make(map[string]bool)
+	for _, object := range objects {
+		included[object.hash] = true
+	}
+
+	// A ref whose history was excluded entirely has nothing to carry
+	header := &bundleHeader{version: options.Version}
+	seenRefs := make(map[string]bool)
+	for _, ref := range refs {
+		if seenRefs[ref.Name] {
+			continue
+		}
+		seenRefs[ref.Name] = true
+		if !included[ref.Hash] {
+			fmt.Fprintf(os.Stderr, "warning: ref '%s' is excluded by the rev-list options\n", ref.Name)
+			continue
+		}
+		header.refs = append(header.refs, ref)
+	}
+	if len(header.refs) == 0 {
+		return fmt.Errorf("Refusing to create empty bundle.")
+	}
+
+	// The parents of included commits that were left out are what the
+	// receiving repository must already have
+	seenPrerequisites := make(map[string]bool)
+	for _, object := range objects {
+		if object.objType != "commit" {
+			continue
+		}
+		commit, err := ReadCommit(object.hash)
+		if err != nil {
+			return err
+		}
+		for _, parent := range commit.Parents {
+			if included[parent] || seenPrerequisites[parent] {
+				continue
+			}
+			seenPrerequisites[parent] = true
+			prerequisite := bundlePrerequisite{hash: parent}
+			if parentCommit, err := ReadCommit(parent); err == nil {
+				prerequisite.comment, _, _ = strings.Cut(parentCommit.Message, "\n")
+			}
+			header.prerequisites = append(header.prerequisites, prerequisite)
+		}
+	}
+
+	return writeBundle(path, header, objects)
+}
+
+// writeBundle writes the bundle to a lock file beside path and moves it
+// into place once complete.
+func writeBundle(path string, header *bundleHeader, objects []packableObject) error {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create '%s': %s", lockPath, err)
+	}
+	defer os.Remove(lockPath)
+
+	out := bufio.NewWriter(file)
+	header.write(out)
+	_, err = writePackStream(out, objects, defaultPackOptions(true))
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(lockPath, path)
+}
+
+func (h *bundleHeader) write(w io.Writer) {
+	if h.version == 3 {
+		fmt.Fprintf(w, "%s\n@object-format=sha1\n", bundleSignatureV3)
+	} else {
+		fmt.Fprintf(w, "%s\n", bundleSignatureV2)
+	}
+	for _, prerequisite := range h.prerequisites {
+		fmt.Fprintf(w, "-%s %s\n", prerequisite.hash, prerequisite.comment)
+	}
+	for _, ref := range h.refs {
+		fmt.Fprintf(w, "%s %s\n", ref.Hash, ref.Name)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// resolveRevision resolves a ref name or object hash, optionally followed
+// by "~<n>", "^" or "^<n>" steps through the commit's ancestors. The full
+// ref name is returned only when rev names a ref as it is.
+func resolveRevision(rev string) (string, string, error) {
+	name := rev
+	var steps []string
+	for {
+		i := strings.LastIndexAny(name, "~^")
+		if i < 0 {
+			break
+		}
+		if _, err := strconv.Atoi(name[i+1:]); name[i+1:] != "" && err != nil {
+			break
+		}
+		steps = append([]string{name[i:]}, steps...)
+		name = name[:i]
+	}
+
+	refName, hash := "", ""
+	for _, candidate := range expandRefName(name) {
+		resolved, err := ResolveRef(candidate)
+		if err != nil {
+			return "", "", err
+		}
+		if resolved != "" {
+			refName, hash = candidate, resolved
+			break
+		}
+	}
+	if hash == "" {
+		if ValidateHash(name) != nil || !ObjectExists(name) {
+			return "", "", fmt.Errorf("bad revision '%s'", rev)
+		}
+		hash = name
+	}
+	if len(steps) == 0 {
+		return refName, hash, nil
+	}
+
+	for _, step := range steps {
+		count, parent := 1, 1
+		if n, err := strconv.Atoi(step[1:]); err == nil {
+			if step[0] == '~' {
+				count = n
+			} else {
+				parent = n
+			}
+		}
+		var err error
+		hash, err = peelToCommit(hash)
+		for ; err == nil && count > 0; count-- {
+			var commit *Commit
+			commit, err = ReadCommit(hash)
+			if err == nil && parent == 0 {
+				break
+			}
+			if err == nil && len(commit.Parents) < parent {
+				err = fmt.Errorf("bad revision '%s'", rev)
+			}
+			if err == nil {
+				hash = commit.Parents[parent-1]
+			}
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("bad revision '%s'", rev)
+		}
+	}
+	return "", hash, nil
+}
+
+// openBundle reads the header of the bundle at path, leaving the returned
+// reader at the start of its pack.
+func openBundle(path string) (*os.File, *bufio.Reader, *bundleHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r := bufio.NewReader(file)
+	header, err := readBundleHeader(r)
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return file, r, header, nil
+}
+
+func readBundleHeader(r *bufio.Reader) (*bundleHeader, error) {
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", fmt.Errorf("truncated bundle header")
+		}
+		return strings.TrimSuffix(line, "\n"), nil
+	}
+
+	signature, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	header := &bundleHeader{}
+	switch signature {
+	case bundleSignatureV2:
+		header.version = 2
+	case bundleSignatureV3:
+		header.version = 3
+	default:
+		return nil, fmt.Errorf("does not look like a v2 or v3 bundle file")
+	}
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return header, nil
+		}
+
+		if header.version == 3 && strings.HasPrefix(line, "@") {
+			key, value, _ := strings.Cut(line[1:], "=")
+			switch key {
+			case "object-format":
+				if value != "sha1" {
+					return nil, fmt.Errorf("unsupported object format '%s'", value)
+				}
+			case "filter":
+				return nil, fmt.Errorf("filtered bundles are not supported")
+			default:
+				return nil, fmt.Errorf("unknown capability '%s'", line[1:])
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "-") {
+			hash, comment, _ := strings.Cut(line[1:], " ")
+			if ValidateHash(hash) != nil {
+				return nil, fmt.Errorf("invalid prerequisite line: %q", line)
+			}
+			header.prerequisites = append(header.prerequisites, bundlePrerequisite{hash: hash, comment: comment})
+			continue
+		}
+		hash, name, found := strings.Cut(line, " ")
+		if !found || ValidateHash(hash) != nil {
+			return nil, fmt.Errorf("invalid ref line: %q", line)
+		}
+		header.refs = append(header.refs, Ref{Hash: hash, Name: name})
+	}
+}
+
+// isBundleFile reports whether path is a file starting with a bundle
+// signature.
+func isBundleFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return line == bundleSignatureV2 || line == bundleSignatureV3
+}
+
+// checkPrerequisites fails unless the repository has every commit the
+// bundle's pack builds on.
+func (h *bundleHeader) checkPrerequisites() error {
+	var missing []string
+	for _, prerequisite := range h.prerequisites {
+		if _, objType, _, err := ReadObjectFile(prerequisite.hash); err != nil || objType != "commit" {
+			missing = append(missing, fmt.Sprintf("%s %s", prerequisite.hash, prerequisite.comment))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Repository lacks these prerequisite commits:\n%s", strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+// VerifyBundle checks that the bundle at path is well formed and that the
+// repository has its prerequisites, and describes what it contains.
+func VerifyBundle(path string) error {
+	file, _, header, err := openBundle(path)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	if err := header.checkPrerequisites(); err != nil {
+		return err
+	}
+
+	if len(header.refs) == 1 {
+		fmt.Println("The bundle contains this ref:")
+	} else {
+		fmt.Printf("The bundle contains these %d refs:\n", len(header.refs))
+	}
+	for _, ref := range header.refs {
+		fmt.Printf("%s %s\n", ref.Hash, ref.Name)
+	}
+	switch len(header.prerequisites) {
+	case 0:
+		fmt.Println("The bundle records a complete history.")
+	case 1:
+		fmt.Println("The bundle requires this ref:")
+	default:
+		fmt.Printf("The bundle requires these %d refs:\n", len(header.prerequisites))
+	}
+	for _, prerequisite := range header.prerequisites {
+		fmt.Printf("%s \n", prerequisite.hash)
+	}
+	fmt.Println("The bundle uses this hash algorithm: sha1")
+	fmt.Fprintf(os.Stderr, "%s is okay\n", path)
+	return nil
+}
+
+// Unbundle stores the objects of the bundle at path and prints the refs it
+// carries, limited to those matching patterns if any are given. No refs are
+// updated; that is left to the caller.
+func Unbundle(path string, patterns []string) error {
+	file, r, header, err := openBundle(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := header.checkPrerequisites(); err != nil {
+		return err
+	}
+
+	if _, err := writePackfile(r); err != nil {
+		return err
+	}
+	for _, ref := range header.refs {
+		if refMatchesPatterns(ref.Name, patterns) {
+			fmt.Printf("%s %s\n", ref.Hash, ref.Name)
+		}
+	}
+	return nil
+}
+
+// bundleTransport fetches from a bundle file as if it were a remote whose
+// refs are those in the bundle's header.
+type bundleTransport struct {
+	path   string
+	header *bundleHeader
+}
+
+func newBundleTransport(url string) (*bundleTransport, error) {
+	path, err := filepath.Abs(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		return nil, err
+	}
+	file, _, header, err := openBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &bundleTransport{path: path, header: header}, nil
+}
+
+func (t *bundleTransport) discoverRefs(service string, refPrefixes []string) (*refAdvertisement, error) {
+	if service != UploadPackService {
+		return nil, fmt.Errorf("cannot push to a bundle")
+	}
+	advertisement := &refAdvertisement{symrefs: make(map[string]string)}
+	advertisement.refs = append(advertisement.refs, t.header.refs...)
+	return advertisement, nil
+}
+
+// fetchPack stores the whole of the bundle's pack, whatever was asked for,
+// once the repository is known to have its prerequisites.
+func (t *bundleTransport) fetchPack(advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (string, *shallowInfo, error) {
+	if fetch.deepen.active() || fetch.filter != "" {
+		return "", nil, fmt.Errorf("bundles do not support shallow or partial fetches")
+	}
+	if err := t.header.checkPrerequisites(); err != nil {
+		return "", nil, err
+	}
+
+	file, r, _, err := openBundle(t.path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	packPath, err := writePackfile(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, want := range fetch.wants {
+		if !ObjectExists(want) {
+			return "", nil, fmt.Errorf("remote did not send all necessary objects")
+		}
+	}
+	return packPath, nil, nil
+}
+
+func (t *bundleTransport) sendPack(advertisement *refAdvertisement, updates []*pushUpdate) error {
+	return fmt.Errorf("cannot push to a bundle")
+}
+
+func (t *bundleTransport) close() error {
+	return nil
+}
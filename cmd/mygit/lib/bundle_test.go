@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveRevision(t *testing.T) {
+	isolateTest(t)
+	initTestRepository(t, filepath.Join(t.TempDir(), "repo.git"))
+
+	// c1 - c2 - c3 - merge on main, with side branching off c1
+	c1 := writeTestCommit(t, "c1\n")
+	c2 := writeTestCommit(t, "c2\n", c1)
+	c3 := writeTestCommit(t, "c3\n", c2)
+	side := writeTestCommit(t, "side\n", c1)
+	merge := writeTestCommit(t, "merge\n", c3, side)
+	tag := fmt.Sprintf("object %s\ntype commit\ntag v2\ntagger %s <%s> 1620000000 +0000\n\nv2\n", c3, DefaultAuthor, DefaultAuthorEmail)
+	tagHash, err := WriteObjectWithType([]byte(tag), "tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]string{
+		"refs/heads/main": merge,
+		"refs/heads/side": side,
+		"refs/tags/v1":    c2,
+		"refs/tags/v2":    hex.EncodeToString(tagHash),
+	}
+	for name, hash := range refs {
+		if err := UpdateRef(name, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		rev     string
+		refName string
+		hash    string
+		wantErr bool
+	}{
+		{rev: "HEAD", refName: "HEAD", hash: merge},
+		{rev: "main", refName: "refs/heads/main", hash: merge},
+		{rev: "refs/heads/side", refName: "refs/heads/side", hash: side},
+		{rev: "v1", refName: "refs/tags/v1", hash: c2},
+		{rev: "v2", refName: "refs/tags/v2", hash: refs["refs/tags/v2"]},
+		{rev: c1, hash: c1},
+		{rev: "main^0", hash: merge},
+		{rev: "main^", hash: c3},
+		{rev: "main^1", hash: c3},
+		{rev: "main^2", hash: side},
+		{rev: "main~1", hash: c3},
+		{rev: "main~3", hash: c1},
+		{rev: "main~", hash: c3},
+		{rev: "main^2~1", hash: c1},
+		{rev: "main~1^^", hash: c1},
+		{rev: "v2^", hash: c2},
+		{rev: c3 + "~2", hash: c1},
+		{rev: "main~4", wantErr: true},
+		{rev: "main^3", wantErr: true},
+		{rev: "side^2", wantErr: true},
+		{rev: "missing", wantErr: true},
+		{rev: strings.Repeat("0", 40), wantErr: true},
+	}
+	for _, test := range tests {
+		refName, hash, err := resolveRevision(test.rev)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("resolveRevision(%q) = %s, %s, want an error", test.rev, refName, hash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveRevision(%q): %s", test.rev, err)
+			continue
+		}
+		if refName != test.refName || hash != test.hash {
+			t.Errorf("resolveRevision(%q) = %q, %s, want %q, %s", test.rev, refName, hash, test.refName, test.hash)
+		}
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "source.git")
+	initTestRepository(t, sourceDir)
+	tip := newTestHistory(t, 5)
+	_, base, err := resolveRevision("main~2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := filepath.Join(dir, "full.bundle")
+	incremental := filepath.Join(dir, "incremental.bundle")
+	if err := CreateBundle(full, []string{"main"}, BundleOptions{Version: 2}); err != nil {
+		t.Fatalf("CreateBundle: %s", err)
+	}
+	if err := CreateBundle(incremental, []string{"main~2..main"}, BundleOptions{Version: 3}); err != nil {
+		t.Fatalf("CreateBundle: %s", err)
+	}
+
+	file, _, header, err := openBundle(incremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if header.version != 3 || len(header.prerequisites) != 1 || header.prerequisites[0].hash != base {
+		t.Fatalf("incremental bundle header = %+v, want version 3 requiring %s", header, base)
+	}
+	if len(header.refs) != 1 || header.refs[0] != (Ref{Name: "refs/heads/main", Hash: tip}) {
+		t.Fatalf("incremental bundle refs = %+v", header.refs)
+	}
+
+	initTestRepository(t, filepath.Join(dir, "target.git"))
+	if err := VerifyBundle(incremental); err == nil {
+		t.Fatal("VerifyBundle accepted a bundle whose prerequisites are missing")
+	}
+	if err := Unbundle(incremental, nil); err == nil {
+		t.Fatal("Unbundle accepted a bundle whose prerequisites are missing")
+	}
+	if err := VerifyBundle(full); err != nil {
+		t.Fatalf("VerifyBundle: %s", err)
+	}
+	if err := Unbundle(full, nil); err != nil {
+		t.Fatalf("Unbundle: %s", err)
+	}
+	if err := VerifyBundle(incremental); err != nil {
+		t.Fatalf("VerifyBundle after unbundling the base: %s", err)
+	}
+	for hash := tip; ; {
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			t.Fatalf("unbundled history: %s", err)
+		}
+		if !ObjectExists(commit.Tree) {
+			t.Fatalf("unbundled tree %s is missing", commit.Tree)
+		}
+		if len(commit.Parents) == 0 {
+			break
+		}
+		hash = commit.Parents[0]
+	}
+
+	SetGitDir(DefaultGitDir)
+	cloneDir := filepath.Join(dir, "clone")
+	CloneRepository(full, cloneDir, CloneOptions{Branch: "main"})
+	if head, err := ResolveRef("HEAD"); err != nil || head != tip {
+		t.Fatalf("HEAD cloned from the bundle = %s, %v, want %s", head, err, tip)
+	}
+}
@@ -2,21 +2,14 @@ package lib
 
 import (
 	"bytes"
-	"compress/zlib"
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
+	"strings"
 )
 
-type Delta struct {
-	baseObj string
-	data    []byte
-}
-
 const (
 	ObjCommit   int = 1
 	ObjTree     int = 2
@@ -26,9 +19,35 @@ const (
 	ObjRefDelta int = 7
 )
 
-func CloneRepository(url string, directory string) {
+type CloneOptions struct {
+	Branch string
+	// Depth, ShallowSince and ShallowExclude truncate the cloned history
+	Depth          int
+	ShallowSince   int64
+	ShallowExclude []string
+	// Filter makes a partial clone that leaves out the filtered objects
+	Filter string
+}
+
+type refAdvertisement struct {
+	version      int
+	refs         []Ref
+	capabilities []string
+	symrefs      map[string]string
+}
+
+func CloneRepository(url string, directory string, options CloneOptions) {
+	remote, err := openTransport(url)
+	if err != nil {
+		HandleError("Error opening remote: %s\n", err)
+	}
+	defer remote.close()
+	if _, ok := remote.(*localTransport); ok {
+		options = localCloneOptions(options)
+	}
+
 	// Create directory
-	err := os.Mkdir(directory, 0755)
+	err = os.Mkdir(directory, 0755)
 	if err != nil {
 		HandleError("Error creating clone directory: %s\n", err)
 	}
@@ -45,276 +64,334 @@ func CloneRepository(url string, directory string) {
 		HandleError("Error initializing repository: %s\n", err)
 	}
 
-	// Fetch packfile
-	packfile, commit, err := fetchPackfile(url)
+	// Discover remote refs
+	advertisement, err := remote.discoverRefs(UploadPackService, []string{"HEAD", "refs/heads/", "refs/tags/"})
 	if err != nil {
-		HandleError("Error fetching packfile: %s\n", err)
+		HandleError("Error fetching refs: %s\n", err)
 	}
 
-	// Write packfile
-	err = writePackfile(packfile)
+	err = writeRemoteConfig(DefaultRemoteName, url)
 	if err != nil {
-		HandleError("Error writing packfile: %s\n", err)
+		HandleError("Error writing config: %s\n", err)
 	}
 
-	// Checkout commit
-	err = checkout(commit)
-	if err != nil {
-		HandleError("Error checking out commit: %s\n", err)
-	}
-}
-
-func getPackFileResponse(url string) (*http.Response, error) {
-	return http.Get(fmt.Sprintf("%s/info/refs?service=git-upload-pack", url))
-}
-
-func getUploadPackResponse(url, objName string) (*http.Response, error) {
-	uploadPackRequestBuffer := bytes.NewBufferString(fmt.Sprintf("0032want %s\n00000009done\n", objName))
-	return http.Post(fmt.Sprintf("%s/git-upload-pack", url), "application/x-git-upload-pack-request", uploadPackRequestBuffer)
-}
-
-func readResponse(response *http.Response) ([]byte, error) {
-	var buffer bytes.Buffer
-	_, err := buffer.ReadFrom(response.Body)
+	deepen := deepenRequest{depth: options.Depth, since: options.ShallowSince, exclude: options.ShallowExclude}
+	err = advertisement.checkDeepenSupport(deepen)
 	if err == nil {
-		return buffer.Bytes(), nil
-	} else {
-		return nil, err
+		err = advertisement.checkFilterSupport(options.Filter)
 	}
-}
-
-func fetchPackfile(url string) ([]byte, string, error) {
-	packFileResponse, err := getPackFileResponse(url)
 	if err != nil {
-		return nil, "", err
+		HandleError("Error fetching packfile: %s\n", err)
 	}
 
-	packBytes, err := readResponse(packFileResponse)
-	if err != nil {
-		return nil, "", err
+	if options.Filter != "" {
+		err = registerPromisorRemote(DefaultRemoteName, options.Filter)
+		if err != nil {
+			HandleError("Error writing config: %s\n", err)
+		}
 	}
 
-	packLines := readPackfile(packBytes)
+	wants := advertisement.cloneWants(deepen.active(), options.Branch)
+	if len(wants) == 0 {
+		fmt.Fprintln(os.Stderr, "warning: You appear to have cloned an empty repository.")
+		return
+	}
 
-	objName, err := getObjectName(packLines)
+	// Fetch and write packfile
+	packPath, shallow, err := remote.fetchPack(advertisement, fetchRequest{wants: wants, deepen: deepen, filter: options.Filter}, newHaveWalker(nil))
 	if err != nil {
-		return nil, "", err
+		HandleError("Error fetching packfile: %s\n", err)
+	}
+	if options.Filter != "" && packPath != "" {
+		err = markPromisorPack(packPath, advertisement.refs)
+		if err != nil {
+			HandleError("Error writing packfile: %s\n", err)
+		}
 	}
 
-	uploadPackResponse, err := getUploadPackResponse(url, objName)
+	err = updateShallow(shallow)
 	if err != nil {
-		return nil, "", err
+		HandleError("Error writing shallow file: %s\n", err)
 	}
 
-	packFile, err := readResponse(uploadPackResponse)
+	// Write refs
+	commit, err := writeCloneRefs(advertisement, DefaultRemoteName, options.Branch)
 	if err != nil {
-		return nil, "", err
+		HandleError("Error writing refs: %s\n", err)
 	}
 
-	lines, _, err := processPackLine(packFile)
+	// Checkout commit
+	err = checkout(commit)
 	if err != nil {
-		return nil, "", err
+		HandleError("Error checking out commit: %s\n", err)
 	}
-
-	packFile = packFile[lines:]
-	return packFile, objName, nil
 }
 
-func writePackfile(packfile []byte) error {
-	err := validatePackfile(packfile)
-	if err != nil {
-		return err
+// localCloneOptions drops the options a local clone cannot honour, since it
+// copies the source's objects as they are.
+func localCloneOptions(options CloneOptions) CloneOptions {
+	if options.Depth > 0 {
+		fmt.Fprintln(os.Stderr, "warning: --depth is ignored in local clones; use file:// instead.")
+	}
+	if options.ShallowSince > 0 {
+		fmt.Fprintln(os.Stderr, "warning: --shallow-since is ignored in local clones; use file:// instead.")
+	}
+	if len(options.ShallowExclude) > 0 {
+		fmt.Fprintln(os.Stderr, "warning: --shallow-exclude is ignored in local clones; use file:// instead.")
+	}
+	if options.Filter != "" {
+		fmt.Fprintln(os.Stderr, "warning: --filter is ignored in local clones; use file:// instead.")
 	}
+	options.Depth = 0
+	options.ShallowSince = 0
+	options.ShallowExclude = nil
+	options.Filter = ""
+	return options
+}
 
-	byteIndex, objectCount, err := readPackfileHeader(packfile)
+// writePackfile spools the pack read from r to disk, resolves its deltas and
+// moves it into the object store with an index. It returns the pack's path.
+func writePackfile(r io.Reader) (string, error) {
+	pack, err := spoolPack(PackDir, r, true)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return storeSpooledPack(pack)
+}
 
-	packfile, byteIndex, deltas, err := parsePackfileObjects(packfile, byteIndex, objectCount)
+// storeSpooledPack resolves the deltas of a spooled pack, completing it if
+// it is thin, and moves it into the object store.
+func storeSpooledPack(pack *spooledPack) (string, error) {
+	defer pack.discard()
+
+	externalBases, err := applyDeltas(pack.file, pack.objects)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = applyDeltas(deltas)
+	if len(externalBases) > 0 {
+		err = pack.completeThin(externalBases)
+		if err != nil {
+			return "", err
+		}
+	}
 
-	return err
+	return pack.store()
 }
 
-func readPackfileHeader(packfile []byte) (int, uint32, error) {
-	byteIndex := 8
-	objectCount := decodeBigUint32(packfile[byteIndex:])
-	byteIndex += 4
+// readRefAdvertisement reads the lines of a ref or capability advertisement
+// up to the flush that ends it. Smart HTTP servers put a "# service=" line
+// and a flush of their own ahead of it.
+func readRefAdvertisement(reader *pktLineReader) ([][]byte, error) {
+	var lines [][]byte
+	serviceHeader := false
+	for {
+		line, err := reader.readLine()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("could not read from remote repository")
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	return byteIndex, objectCount, nil
+		switch {
+		case line == nil && serviceHeader && len(lines) == 0:
+			serviceHeader = false
+		case line == nil:
+			return lines, nil
+		case bytes.HasPrefix(line, []byte("ERR ")):
+			return nil, fmt.Errorf("remote error: %s", line[4:])
+		case len(lines) == 0 && bytes.HasPrefix(line, []byte("# service=")):
+			serviceHeader = true
+		default:
+			lines = append(lines, line)
+		}
+	}
 }
 
-func parsePackfileObjects(packfile []byte, byteIndex int, objectCount uint32) ([]byte, int, []Delta, error) {
-	var deltas []Delta
-	var objReadCount uint32
-	packfile = packfile[:len(packfile)-20]
+func parseRefAdvertisement(packLines [][]byte) (*refAdvertisement, error) {
+	advertisement := &refAdvertisement{version: 0, symrefs: make(map[string]string)}
 
-	for byteIndex < len(packfile) {
-		var obj []byte
-		objReadCount++
-		objSize, objType, bRead, err := readObjectHeader(packfile[byteIndex:])
-		byteIndex += bRead
-		if err != nil {
-			return nil, 0, nil, err
+	for _, line := range packLines {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if string(line) == "version 1" {
+			advertisement.version = 1
+			continue
 		}
 
-		if objType == ObjCommit || objType == ObjTree || objType == ObjBlob || objType == ObjTag {
-			var objTypeString string
-			objTypeString, err = getObjectTypeString(objType)
-			if err != nil {
-				HandleError("Error reading object: invalid object type")
-			}
-
-			bRead, obj, err = readPackfileObject(packfile[byteIndex:])
-			byteIndex += bRead
-			if int(objSize) != len(obj) {
-				HandleError("Error reading object: invalid object header size")
-			}
-			_, err = WriteObjectWithType(obj, objTypeString)
-			if err != nil {
-				HandleError("Error writing object: %s\n", err)
-			}
-		} else if objType == ObjOfsDelta || objType == ObjRefDelta {
-			if objType == ObjOfsDelta { //for ofs delta
-				_, bRead, err = decodeObjectSize(packfile[byteIndex:])
-				byteIndex += bRead
-				if err != nil {
-					HandleError("Error decoding object size: %s\n", err)
-				}
-				bRead, obj, err = readPackfileObject(packfile[byteIndex:])
-			} else { //for ref delta
-				objHash := packfile[byteIndex : byteIndex+20]
-				byteIndex += 20
-				bRead, obj, err = readPackfileObject(packfile[byteIndex:])
-				byteIndex += bRead
-				deltas = append(deltas, Delta{baseObj: hex.EncodeToString(objHash), data: obj})
-			}
+		if nulIndex := bytes.IndexByte(line, 0); nulIndex >= 0 {
+			advertisement.capabilities = strings.Fields(string(line[nulIndex+1:]))
+			line = line[:nulIndex]
+		}
 
-			if int(objSize) != len(obj) {
-				HandleError("Error reading object: invalid object header size")
-			}
-		} else {
-			HandleError("Error reading object: invalid object type")
+		var objHash, objRef string
+		fmt.Sscanf(string(line), "%s %s", &objHash, &objRef)
+		if ValidateHash(objHash) != nil || objRef == "" {
+			return nil, fmt.Errorf("invalid ref advertisement line: %q", line)
+		}
+		if objRef == "capabilities^{}" {
+			continue
 		}
+		advertisement.refs = append(advertisement.refs, Ref{Hash: objHash, Name: objRef})
 	}
 
-	if objReadCount != objectCount {
-		HandleError("WritePackFile: Error reading object: object count mismatch") //Error handling
+	for _, capability := range advertisement.capabilities {
+		if strings.HasPrefix(capability, "symref=") {
+			if ref, target, found := strings.Cut(strings.TrimPrefix(capability, "symref="), ":"); found {
+				advertisement.symrefs[ref] = target
+			}
+		}
 	}
 
-	return packfile, byteIndex, deltas, nil
+	return advertisement, nil
 }
 
-func applyDeltas(deltas []Delta) error {
-	for len(deltas) > 0 {
-		var newDeltas []Delta
-		var deltaApplied bool
-
-		for _, d := range deltas {
-			if ObjectFileExists(d.baseObj) {
-				deltaApplied = true
-				deltaObjData, objType, _, err := ReadObjectFile(d.baseObj)
-				if err != nil {
-					HandleError("Error reading object: %s\n", err)
-				}
-				err = writeDeltaObject(deltaObjData, d.data, objType)
-				if err != nil {
-					HandleError("Error writing delta object: %s\n", err)
-				}
-			} else {
-				newDeltas = append(newDeltas, d)
-			}
+func (a *refAdvertisement) hasCapability(capability string) bool {
+	for _, c := range a.capabilities {
+		if c == capability || strings.HasPrefix(c, capability+"=") {
+			return true
 		}
-		if !deltaApplied && len(newDeltas) > 0 {
-			HandleError("Error reading object: invalid delta object(s)")
+	}
+	return false
+}
+
+func (a *refAdvertisement) lookup(name string) (string, bool) {
+	for _, ref := range a.refs {
+		if ref.Name == name {
+			return ref.Hash, true
 		}
-		deltas = newDeltas
 	}
-	return nil
+	return "", false
 }
 
-func validatePackfile(packfile []byte) error {
-	if len(packfile) < 32 {
-		return fmt.Errorf("packfile failed validation: invalid size")
+// peeled returns the commit an annotated tag points at, or hash itself.
+func (a *refAdvertisement) peeled(name, hash string) string {
+	if peeledHash, ok := a.lookup(name + "^{}"); ok {
+		return peeledHash
 	}
+	return hash
+}
 
-	checksum := packfile[len(packfile)-20:]
-	data := packfile[:len(packfile)-20]
-	dataChecksum := sha1.Sum(data)
+// defaultBranch returns the branch the remote HEAD points at, falling back
+// to a branch advertised with the same object as HEAD.
+func (a *refAdvertisement) defaultBranch() string {
+	if target, ok := a.symrefs["HEAD"]; ok {
+		return strings.TrimPrefix(target, "refs/heads/")
+	}
 
-	if !bytes.Equal(checksum, dataChecksum[:]) {
-		return fmt.Errorf("packfile failed validation: invalid checksum")
+	headHash, ok := a.lookup("HEAD")
+	if !ok {
+		return ""
 	}
-	if !bytes.Equal(data[:4], []byte("PACK")) {
-		return fmt.Errorf("packfile failed validation: invalid header")
+	for _, candidate := range []string{"refs/heads/main", "refs/heads/master"} {
+		if hash, ok := a.lookup(candidate); ok && hash == headHash {
+			return strings.TrimPrefix(candidate, "refs/heads/")
+		}
 	}
-	packfileVersion := decodeBigUint32(data[4:8])
-	if packfileVersion != 2 && packfileVersion != 3 {
-		return fmt.Errorf("packfile failed validation: invalid version")
+	for _, ref := range a.refs {
+		if strings.HasPrefix(ref.Name, "refs/heads/") && ref.Hash == headHash {
+			return strings.TrimPrefix(ref.Name, "refs/heads/")
+		}
 	}
-
-	return nil
+	return ""
 }
 
-func readPackfile(packBytes []byte) [][]byte {
-	var packLines [][]byte
-
-	for len(packBytes) > 0 {
-		line, data, err := processPackLine(packBytes)
-		if err != nil {
-			HandleError("Error processing packfile line: %s\n", err)
+// cloneWants returns the objects to request for a clone. Shallow clones only
+// ask for branches, plus branch if it names a tag; other tags are kept only
+// when they arrive through include-tag.
+func (a *refAdvertisement) cloneWants(shallow bool, branch string) []string {
+	var wants []string
+	seen := make(map[string]bool)
+	for _, ref := range a.refs {
+		isBranch := strings.HasPrefix(ref.Name, "refs/heads/")
+		isTag := strings.HasPrefix(ref.Name, "refs/tags/") && !strings.HasSuffix(ref.Name, "^{}")
+		if isTag && shallow {
+			isTag = ref.Name == "refs/tags/"+branch
+		}
+		if (isBranch || isTag) && !seen[ref.Hash] {
+			seen[ref.Hash] = true
+			wants = append(wants, ref.Hash)
 		}
-		packBytes = packBytes[line:]
-		packLines = append(packLines, data)
+	}
+	return wants
+}
+
+func writeRemoteConfig(remote, url string) error {
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return err
 	}
 
-	return packLines
+	config.Set(fmt.Sprintf("remote.%s.url", remote), url)
+	config.Set(fmt.Sprintf("remote.%s.fetch", remote), fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", remote))
+
+	return config.Write(ConfigFilePath)
 }
 
-func processPackLine(line []byte) (int, []byte, error) {
-	packLength := line[:4]
-	blob := line[4:]
-	dest := [2]byte{}
+// writeCloneRefs records the remote-tracking branches and tags, creates the
+// local branch and points HEAD at it. It returns the commit to check out.
+func writeCloneRefs(advertisement *refAdvertisement, remote, branch string) (string, error) {
+	for _, ref := range advertisement.refs {
+		var err error
+		if strings.HasPrefix(ref.Name, "refs/heads/") {
+			name := strings.TrimPrefix(ref.Name, "refs/heads/")
+			err = UpdateRef(fmt.Sprintf("refs/remotes/%s/%s", remote, name), ref.Hash)
+		} else if strings.HasPrefix(ref.Name, "refs/tags/") && !strings.HasSuffix(ref.Name, "^{}") && ObjectExists(ref.Hash) {
+			err = UpdateRef(ref.Name, ref.Hash)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
 
-	_, err := hex.Decode(dest[:], packLength)
-	if err != nil {
-		return 0, nil, err
+	defaultBranch := advertisement.defaultBranch()
+	if defaultBranch != "" {
+		err := UpdateSymbolicRef(fmt.Sprintf("refs/remotes/%s/HEAD", remote), fmt.Sprintf("refs/remotes/%s/%s", remote, defaultBranch))
+		if err != nil {
+			return "", err
+		}
 	}
 
-	size := uint16(dest[0])<<8 | uint16(dest[1])
-	if size == 0 {
-		return 4, nil, nil
+	if branch == "" {
+		branch = defaultBranch
+	}
+	if branch == "" {
+		return "", fmt.Errorf("remote HEAD does not point at a branch")
 	}
 
-	if len(blob) < int(size)-4 {
-		return 4, nil, fmt.Errorf("error processing packfile line")
+	if hash, ok := advertisement.lookup("refs/heads/" + branch); ok {
+		if err := UpdateRef("refs/heads/"+branch, hash); err != nil {
+			return "", err
+		}
+		if err := UpdateSymbolicRef("HEAD", "refs/heads/"+branch); err != nil {
+			return "", err
+		}
+		if err := writeBranchTrackingConfig(branch, remote); err != nil {
+			return "", err
+		}
+		return hash, nil
 	}
 
-	data := blob[:size-4]
-	if data[len(data)-1] == '\n' {
-		data = data[:len(data)-1]
+	if hash, ok := advertisement.lookup("refs/tags/" + branch); ok {
+		commit := advertisement.peeled("refs/tags/"+branch, hash)
+		return commit, WriteFile(HeadFilePath, []byte(commit+"\n"))
 	}
 
-	return int(size), data, nil
+	return "", fmt.Errorf("remote branch %s not found in upstream %s", branch, remote)
 }
 
-func getObjectName(packLines [][]byte) (string, error) {
-	for _, line := range packLines[1:] {
-		if len(line) == 0 {
-			continue
-		}
-		var objHash, objRef string
-		fmt.Sscanf(string(line), "%s %s", &objHash, &objRef)
-		if objRef == "refs/heads/master" {
-			return objHash, nil
-		}
+func writeBranchTrackingConfig(branch, remote string) error {
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return err
 	}
-	return "", fmt.Errorf("name not found")
+
+	config.Set(fmt.Sprintf("branch.%s.remote", branch), remote)
+	config.Set(fmt.Sprintf("branch.%s.merge", branch), "refs/heads/"+branch)
+
+	return config.Write(ConfigFilePath)
 }
 
 func decodeBigUint32(bytes []byte) uint32 {
@@ -338,19 +415,6 @@ func getObjectTypeString(objType int) (string, error) {
 	return result, nil
 }
 
-func decodeObjectSize(objData []byte) (int, int, error) {
-	byteIndex := bytes.IndexByte(objData, 0)
-	var objSize int
-
-	fmt.Sscanf(string(objData[:byteIndex]), "%d", &objSize)
-
-	if byteIndex+objSize+1 != len(objData) {
-		return 0, 0, fmt.Errorf("invalid object size")
-	}
-
-	return objSize, byteIndex, nil
-}
-
 func checkout(commitHash string) error {
 	commit, objType, _, err := ReadObjectFile(commitHash)
 	if err != nil {
@@ -363,6 +427,11 @@ func checkout(commitHash string) error {
 
 	treeHash := commit[5:45]
 
+	err = prefetchTree(string(treeHash))
+	if err != nil {
+		return fmt.Errorf("error fetching missing objects: %s\n", err)
+	}
+
 	err = checkoutTree(string(treeHash), ".")
 	if err != nil {
 		return fmt.Errorf("error checking out tree: %s\n", err)
@@ -411,6 +480,9 @@ func checkoutTree(treeHash string, path string) error {
 }
 
 func readObjectHeader(packfile []byte) (size uint64, objectType int, byteIndex int, err error) {
+	if len(packfile) == 0 {
+		return 0, 0, 0, errors.New("bad object header")
+	}
 	data := packfile[byteIndex]
 	byteIndex++
 	objectType = int((data >> 4) & 0x7)
@@ -428,34 +500,19 @@ func readObjectHeader(packfile []byte) (size uint64, objectType int, byteIndex i
 	return size, objectType, byteIndex, nil
 }
 
-func readPackfileObject(packfile []byte) (int, []byte, error) {
-	b := bytes.NewReader(packfile)
-	r, err := zlib.NewReader(b)
-	if err != nil {
-		return 0, nil, err
-	}
-	defer r.Close()
-	object, err := io.ReadAll(r)
-	if err != nil {
-		return 0, nil, err
-	}
-	bytesRead := int(b.Size()) - b.Len()
-	return bytesRead, object, nil
-}
-
-func writeDeltaObject(baseObject, deltaObject []byte, objectType string) error {
+func applyDelta(baseObject, deltaObject []byte) ([]byte, error) {
 	used := 0
 	baseSize, read, err := readSize(deltaObject[used:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	used += read
 	if len(baseObject) != int(baseSize) {
-		return errors.New("bad delta header")
+		return nil, errors.New("bad delta header")
 	}
 	expectedSize, read, err := readSize(deltaObject[used:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	used += read
 	buffer := bytes.Buffer{}
@@ -466,6 +523,9 @@ func writeDeltaObject(baseObject, deltaObject []byte, objectType string) error {
 			var argument uint64
 			for bit := 0; bit < 7; bit++ {
 				if opcode&(1<<bit) != 0 {
+					if used >= len(deltaObject) {
+						return nil, errors.New("bad delta copy instruction")
+					}
 					argument += uint64(deltaObject[used]) << (bit * 8)
 					used++
 				}
@@ -475,25 +535,32 @@ func writeDeltaObject(baseObject, deltaObject []byte, objectType string) error {
 			if size == 0 {
 				size = 0x10000
 			}
+			if offset+size > uint64(len(baseObject)) || uint64(buffer.Len())+size > expectedSize {
+				return nil, errors.New("bad delta copy instruction")
+			}
 			buffer.Write(baseObject[offset : offset+size])
-		} else {
+		} else if opcode != 0 {
 			size := int(opcode & 0x7F)
+			if used+size > len(deltaObject) || uint64(buffer.Len()+size) > expectedSize {
+				return nil, errors.New("bad delta insert instruction")
+			}
 			buffer.Write(deltaObject[used : used+size])
 			used += size
+		} else {
+			return nil, errors.New("bad delta opcode")
 		}
 	}
 	objToDelta := buffer.Bytes()
 	if int(expectedSize) != len(objToDelta) {
-		return errors.New("bad delta header")
+		return nil, errors.New("bad delta header")
 	}
-	_, err = WriteObjectWithType(objToDelta, objectType)
-	if err != nil {
-		return err
-	}
-	return nil
+	return objToDelta, nil
 }
 
 func readSize(packfile []byte) (size uint64, used int, err error) {
+	if len(packfile) == 0 {
+		return 0, 0, errors.New("bad size")
+	}
 	data := packfile[used]
 	used++
 	size = uint64(data & 0x7F)
@@ -1,6 +1,10 @@
 package lib
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func prepareAuthor(name, email string) (string, string) {
 	if name == "" {
@@ -27,3 +31,117 @@ func CreateCommit(treeHash, parentHash []byte, message, authorName, authorEmail
 
 	return append(append([]byte(commitHeader), 0), []byte(commitContent)...)
 }
+
+type Commit struct {
+	Tree      string
+	Parents   []string
+	Author    string
+	Committer string
+	Message   string
+}
+
+func ParseCommit(data []byte) (*Commit, error) {
+	commit := &Commit{}
+	headers, message, _ := strings.Cut(string(data), "\n\n")
+	commit.Message = message
+
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			commit.Author = value
+		case "committer":
+			commit.Committer = value
+		}
+	}
+
+	if ValidateHash(commit.Tree) != nil {
+		return nil, fmt.Errorf("invalid commit: missing tree")
+	}
+	return commit, nil
+}
+
+// ReadCommit reads and parses a commit. Commits listed in .git/shallow are
+// returned without parents so history walks stop at the shallow boundary.
+func ReadCommit(hash string) (*Commit, error) {
+	obj, objType, _, err := ReadObjectFile(hash)
+	if err != nil {
+		return nil, err
+	}
+	if objType != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", hash, objType)
+	}
+
+	commit, err := ParseCommit(obj)
+	if err != nil {
+		return nil, err
+	}
+	if isShallowCommit(hash) {
+		commit.Parents = nil
+	}
+	return commit, nil
+}
+
+// CommitTime returns the committer timestamp in seconds since the epoch.
+func (c *Commit) CommitTime() int64 {
+	fields := strings.Fields(c.Committer)
+	if len(fields) < 2 {
+		return 0
+	}
+	timestamp, _ := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	return timestamp
+}
+
+// IsAncestor reports whether ancestor is reachable from descendant.
+func IsAncestor(ancestor, descendant string) (bool, error) {
+	seen := map[string]bool{descendant: true}
+	queue := []string{descendant}
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if hash == ancestor {
+			return true, nil
+		}
+
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			return false, err
+		}
+		for _, parent := range commit.Parents {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return false, nil
+}
+
+// peelToCommit follows annotated tags until it reaches a commit.
+func peelToCommit(hash string) (string, error) {
+	for depth := 0; depth < 10; depth++ {
+		obj, objType, _, err := ReadObjectFile(hash)
+		if err != nil {
+			return "", err
+		}
+
+		switch objType {
+		case "commit":
+			return hash, nil
+		case "tag":
+			target, _, _ := strings.Cut(string(obj), "\n")
+			if !strings.HasPrefix(target, "object ") {
+				return "", fmt.Errorf("invalid tag object %s", hash)
+			}
+			hash = strings.TrimPrefix(target, "object ")
+		default:
+			return "", fmt.Errorf("%s is a %s, not a commit", hash, objType)
+		}
+	}
+	return "", fmt.Errorf("tag chain too deep at %s", hash)
+}
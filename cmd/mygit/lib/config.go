@@ -0,0 +1,241 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Config struct {
+	sections []*configSection
+}
+
+type configSection struct {
+	name       string
+	subsection string
+	entries    []configEntry
+}
+
+type configEntry struct {
+	key   string
+	value string
+}
+
+func ReadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	data, err := ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var section *configSection
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.LastIndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%s:%d: bad section header", path, lineNumber)
+			}
+			section = parseSectionHeader(line[1:end])
+			config.sections = append(config.sections, section)
+			continue
+		}
+
+		if section == nil {
+			return nil, fmt.Errorf("%s:%d: entry outside of a section", path, lineNumber)
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !found {
+			value = "true"
+		}
+		section.entries = append(section.entries, configEntry{key: key, value: parseConfigValue(value)})
+	}
+
+	return config, scanner.Err()
+}
+
+func parseSectionHeader(header string) *configSection {
+	name, subsection, found := strings.Cut(header, " ")
+	if !found {
+		// Legacy [section.subsection] syntax
+		name, subsection, _ = strings.Cut(header, ".")
+	} else {
+		// Only the enclosing quotes, since the name may end in an escaped one
+		subsection = strings.TrimSpace(subsection)
+		if len(subsection) >= 2 && subsection[0] == '"' && subsection[len(subsection)-1] == '"' {
+			subsection = subsection[1 : len(subsection)-1]
+		}
+		subsection = strings.NewReplacer("\\\"", "\"", "\\\\", "\\").Replace(subsection)
+	}
+	return &configSection{name: strings.ToLower(name), subsection: subsection}
+}
+
+func parseConfigValue(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexAny(value, "#;"); i >= 0 && !strings.Contains(value[:i], "\"") {
+		value = strings.TrimSpace(value[:i])
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.NewReplacer("\\\"", "\"", "\\\\", "\\", "\\n", "\n", "\\t", "\t").Replace(value)
+}
+
+// splitConfigKey splits "remote.origin.url" into section, subsection and key.
+func splitConfigKey(key string) (string, string, string) {
+	first := strings.IndexByte(key, '.')
+	last := strings.LastIndexByte(key, '.')
+	if first < 0 {
+		return strings.ToLower(key), "", ""
+	}
+	if first == last {
+		return strings.ToLower(key[:first]), "", strings.ToLower(key[last+1:])
+	}
+	return strings.ToLower(key[:first]), key[first+1 : last], strings.ToLower(key[last+1:])
+}
+
+func (c *Config) findSection(name, subsection string) *configSection {
+	for i := len(c.sections) - 1; i >= 0; i-- {
+		if c.sections[i].name == name && c.sections[i].subsection == subsection {
+			return c.sections[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) Get(key string) (string, bool) {
+	values := c.GetAll(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+func (c *Config) GetAll(key string) []string {
+	name, subsection, entryKey := splitConfigKey(key)
+	var values []string
+	for _, section := range c.sections {
+		if section.name != name || section.subsection != subsection {
+			continue
+		}
+		for _, entry := range section.entries {
+			if entry.key == entryKey {
+				values = append(values, entry.value)
+			}
+		}
+	}
+	return values
+}
+
+// Subsections returns the distinct subsection names of a section, e.g. the
+// remote names for "remote".
+func (c *Config) Subsections(name string) []string {
+	var subsections []string
+	seen := make(map[string]bool)
+	for _, section := range c.sections {
+		if section.name == strings.ToLower(name) && section.subsection != "" && !seen[section.subsection] {
+			seen[section.subsection] = true
+			subsections = append(subsections, section.subsection)
+		}
+	}
+	return subsections
+}
+
+func (c *Config) Set(key, value string) {
+	c.Unset(key)
+	c.Add(key, value)
+}
+
+func (c *Config) Add(key, value string) {
+	name, subsection, entryKey := splitConfigKey(key)
+	section := c.findSection(name, subsection)
+	if section == nil {
+		section = &configSection{name: name, subsection: subsection}
+		c.sections = append(c.sections, section)
+	}
+	section.entries = append(section.entries, configEntry{key: entryKey, value: value})
+}
+
+func (c *Config) Unset(key string) {
+	name, subsection, entryKey := splitConfigKey(key)
+	for _, section := range c.sections {
+		if section.name != name || section.subsection != subsection {
+			continue
+		}
+		var entries []configEntry
+		for _, entry := range section.entries {
+			if entry.key != entryKey {
+				entries = append(entries, entry)
+			}
+		}
+		section.entries = entries
+	}
+}
+
+func (c *Config) Write(path string) error {
+	var buf bytes.Buffer
+	for _, section := range c.sections {
+		if section.subsection != "" {
+			subsection := strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(section.subsection)
+			fmt.Fprintf(&buf, "[%s \"%s\"]\n", section.name, subsection)
+		} else {
+			fmt.Fprintf(&buf, "[%s]\n", section.name)
+		}
+		for _, entry := range section.entries {
+			fmt.Fprintf(&buf, "\t%s = %s\n", entry.key, formatConfigValue(entry.value))
+		}
+	}
+	return WriteFile(path, buf.Bytes())
+}
+
+func formatConfigValue(value string) string {
+	escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t").Replace(value)
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;") {
+		return "\"" + escaped + "\""
+	}
+	return escaped
+}
+
+func ReadRepositoryConfig() (*Config, error) {
+	return ReadConfig(ConfigFilePath)
+}
+
+// readUserAndRepositoryConfig returns the user's global configuration
+// followed by the repository's, so that repository values take precedence
+// as they do in git.
+func readUserAndRepositoryConfig() (*Config, error) {
+	var paths []string
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "git", "config"))
+	} else if home := os.Getenv("HOME"); home != "" {
+		paths = append(paths, filepath.Join(home, ".config", "git", "config"))
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		paths = append(paths, filepath.Join(home, ".gitconfig"))
+	}
+	paths = append(paths, ConfigFilePath)
+
+	combined := &Config{}
+	for _, path := range paths {
+		config, err := ReadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		combined.sections = append(combined.sections, config.sections...)
+	}
+	return combined, nil
+}
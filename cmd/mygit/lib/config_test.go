@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readTestConfig(t *testing.T, contents string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadConfig(path)
+}
+
+func TestReadConfig(t *testing.T) {
+	config, err := readTestConfig(t, `# a comment
+[core]
+	bare = false
+	; another comment
+	FileMode = true
+	logAllRefUpdates
+[remote "origin"]
+	url = https://example.com/repo.git # trailing comment
+	fetch = +refs/heads/*:refs/remotes/origin/*
+	fetch = +refs/tags/*:refs/tags/*
+[remote "Upper \"quoted\""]
+	url = /tmp/upper
+[branch.main]
+	remote = origin
+[alias]
+	quoted = "  spaced # not a comment "
+	escaped = a\tb\nc \"d\" \\e
+[core]
+	bare = true
+`)
+	if err != nil {
+		t.Fatalf("ReadConfig: %s", err)
+	}
+
+	tests := []struct {
+		key   string
+		value string
+		found bool
+	}{
+		{"core.bare", "true", true},
+		{"core.filemode", "true", true},
+		{"CORE.FILEMODE", "true", true},
+		{"core.logallrefupdates", "true", true},
+		{"remote.origin.url", "https://example.com/repo.git", true},
+		{"remote.ORIGIN.url", "", false},
+		{`remote.Upper "quoted".url`, "/tmp/upper", true},
+		{"branch.main.remote", "origin", true},
+		{"alias.quoted", "  spaced # not a comment ", true},
+		{"alias.escaped", "a\tb\nc \"d\" \\e", true},
+		{"core.missing", "", false},
+		{"missing.key", "", false},
+	}
+	for _, test := range tests {
+		value, found := config.Get(test.key)
+		if value != test.value || found != test.found {
+			t.Errorf("Get(%q) = %q, %v, want %q, %v", test.key, value, found, test.value, test.found)
+		}
+	}
+
+	fetch := config.GetAll("remote.origin.fetch")
+	wantFetch := []string{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"}
+	if !reflect.DeepEqual(fetch, wantFetch) {
+		t.Errorf("GetAll(remote.origin.fetch) = %q, want %q", fetch, wantFetch)
+	}
+	if remotes := config.Subsections("remote"); !reflect.DeepEqual(remotes, []string{"origin", `Upper "quoted"`}) {
+		t.Errorf("Subsections(remote) = %q", remotes)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	for _, contents := range []string{
+		"[core\n\tbare = true\n",
+		"bare = true\n",
+	} {
+		if _, err := readTestConfig(t, contents); err == nil {
+			t.Errorf("ReadConfig accepted %q", contents)
+		}
+	}
+}
+
+func TestConfigWriteRoundTrip(t *testing.T) {
+	config := &Config{}
+	config.Set("core.bare", "false")
+	config.Set("core.bare", "true")
+	config.Add("remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*")
+	config.Add("remote.origin.fetch", "+refs/tags/*:refs/tags/*")
+	config.Set(`remote.odd "name".url`, " leading space; and # marks\tand\nnewlines \"quoted\" \\")
+	config.Set("user.name", "Some One")
+	config.Unset("user.name")
+
+	path := filepath.Join(t.TempDir(), "config")
+	if err := config.Write(path); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	read, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig: %s", err)
+	}
+	for _, key := range []string{"core.bare", "remote.origin.fetch", `remote.odd "name".url`, "user.name"} {
+		if got, want := read.GetAll(key), config.GetAll(key); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s read back as %q, want %q", key, got, want)
+		}
+	}
+}
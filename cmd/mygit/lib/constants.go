@@ -1,13 +1,54 @@
 package lib
 
-// Git directory structure
-const (
-	GitDir       = ".git"
-	ObjectsDir   = GitDir + "/objects"
-	RefsDir      = GitDir + "/refs"
+// DefaultGitDir is the repository directory inside a working tree
+const DefaultGitDir = ".git"
+
+// Git directory structure, relative to the working tree unless SetGitDir
+// points them at another repository
+var (
+	GitDir             string
+	ObjectsDir         string
+	PackDir            string
+	RefsDir            string
+	HeadFilePath       string
+	ConfigFilePath     string
+	PackedRefsFilePath string
+	FetchHeadFilePath  string
+	ShallowFilePath    string
+)
+
+func init() {
+	SetGitDir(DefaultGitDir)
+}
+
+// SetGitDir makes the repository at dir, such as a bare repository, the one
+// all other functions operate on.
+func SetGitDir(dir string) {
+	GitDir = dir
+	ObjectsDir = GitDir + "/objects"
+	PackDir = ObjectsDir + "/pack"
+	RefsDir = GitDir + "/refs"
 	HeadFilePath = GitDir + "/HEAD"
+	ConfigFilePath = GitDir + "/config"
+	PackedRefsFilePath = GitDir + "/packed-refs"
+	FetchHeadFilePath = GitDir + "/FETCH_HEAD"
+	ShallowFilePath = GitDir + "/shallow"
+
+	resetStoredPacks()
+	shallowCommits = nil
+}
+
+// Remote defaults
+const (
+	DefaultRemoteName = "origin"
+
+	UploadPackService  = "git-upload-pack"
+	ReceivePackService = "git-receive-pack"
 )
 
+// ZeroHash stands for a missing object in ref update commands
+const ZeroHash = "0000000000000000000000000000000000000000"
+
 // Git object types
 const (
 	Blob = "blob"
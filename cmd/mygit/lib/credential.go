@@ -0,0 +1,261 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// credential is what authenticates us to one HTTP remote. It is filled in
+// from the URL, credential helpers and GIT_ASKPASS, and exchanged with the
+// helpers in git's credential protocol.
+type credential struct {
+	protocol string
+	host     string
+	path     string
+	username string
+	password string
+	// authType and token are a ready-made authorization, such as a Bearer
+	// token, handed out by helpers that support the authtype capability
+	authType string
+	token    string
+}
+
+// url names the remote in prompts and errors.
+func (c *credential) url() string {
+	return fmt.Sprintf("%s://%s", c.protocol, c.host)
+}
+
+func (c *credential) complete() bool {
+	return c.authType != "" && c.token != "" || c.username != "" && c.password != ""
+}
+
+// authorization returns the Authorization header for a server that sent
+// challenges in its WWW-Authenticate headers. A password is sent as a Bearer
+// token only to servers that do not accept Basic.
+func (c *credential) authorization(challenges []string) string {
+	if c.authType != "" && c.token != "" {
+		return c.authType + " " + c.token
+	}
+
+	bearer := false
+	for _, challenge := range challenges {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		if strings.EqualFold(scheme, "Basic") {
+			bearer = false
+			break
+		}
+		if strings.EqualFold(scheme, "Bearer") {
+			bearer = true
+		}
+	}
+	if bearer {
+		return "Bearer " + c.password
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+}
+
+// fill completes the credential, asking the credential helpers first and
+// then the askpass program for whatever they did not provide.
+func (c *credential) fill() error {
+	if c.complete() {
+		return nil
+	}
+
+	helpers, err := credentialHelpers()
+	if err != nil {
+		return err
+	}
+	for _, helper := range helpers {
+		quit, err := c.runHelper(helper, "get")
+		if err != nil {
+			return err
+		}
+		if quit && !c.complete() {
+			return fmt.Errorf("credential helper '%s' told us to quit", helper)
+		}
+		if c.complete() {
+			return nil
+		}
+	}
+
+	if c.username == "" {
+		c.username, err = askpass(fmt.Sprintf("Username for '%s': ", c.url()))
+		if err != nil {
+			return fmt.Errorf("could not read Username for '%s': %s", c.url(), err)
+		}
+	}
+	if c.password == "" {
+		prompt := fmt.Sprintf("Password for '%s://%s@%s': ", c.protocol, c.username, c.host)
+		c.password, err = askpass(prompt)
+		if err != nil {
+			return fmt.Errorf("could not read Password for '%s': %s", c.url(), err)
+		}
+	}
+	return nil
+}
+
+// approve tells the credential helpers the credential worked, so they can
+// store it.
+func (c *credential) approve() {
+	c.notifyHelpers("store")
+}
+
+// reject tells the credential helpers the credential was refused, so they
+// can forget it.
+func (c *credential) reject() {
+	c.notifyHelpers("erase")
+}
+
+func (c *credential) notifyHelpers(action string) {
+	helpers, err := credentialHelpers()
+	if err != nil {
+		return
+	}
+	for _, helper := range helpers {
+		c.runHelper(helper, action)
+	}
+}
+
+// credentialHelpers lists the configured credential.helper values. An empty
+// value clears the helpers configured before it.
+func credentialHelpers() ([]string, error) {
+	config, err := readUserAndRepositoryConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var helpers []string
+	for _, helper := range config.GetAll("credential.helper") {
+		if helper == "" {
+			helpers = nil
+		} else {
+			helpers = append(helpers, helper)
+		}
+	}
+	return helpers, nil
+}
+
+// runHelper runs a credential helper for action, reading back what a get
+// tells us and reporting whether the helper asked us to stop looking.
+// Helpers are named the way git names them: "!<shell command>", an absolute
+// path, or a name run as "git credential-<name>".
+func (c *credential) runHelper(helper, action string) (bool, error) {
+	command := "git credential-" + helper
+	if strings.HasPrefix(helper, "!") {
+		command = helper[1:]
+	} else if filepath.IsAbs(helper) {
+		command = helper
+	}
+
+	input, err := c.encode(action)
+	if err != nil {
+		return false, err
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command("sh", "-c", command+" "+action)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		// A broken helper should not stop us from trying the others
+		fmt.Fprintf(os.Stderr, "warning: credential helper '%s' failed: %s\n", helper, err)
+		return false, nil
+	}
+	if action != "get" {
+		return false, nil
+	}
+
+	quit := false
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		if strings.Contains(value, "\x00") {
+			return false, fmt.Errorf("credential helper '%s' sent a %s containing NUL", helper, key)
+		}
+		switch key {
+		case "username":
+			c.username = value
+		case "password":
+			c.password = value
+		case "authtype":
+			c.authType = value
+		case "credential":
+			c.token = value
+		case "quit":
+			quit = value == "1" || value == "true"
+		}
+	}
+	return quit, scanner.Err()
+}
+
+// encode writes the credential in the helper protocol's key=value form.
+// A value with a newline or NUL in it would let whoever chose it add keys
+// of their own, so the credential is refused instead.
+func (c *credential) encode(action string) (string, error) {
+	fields := []struct{ key, value string }{
+		{"protocol", c.protocol}, {"host", c.host}, {"path", c.path}, {"username", c.username},
+		{"password", c.password}, {"authtype", c.authType}, {"credential", c.token},
+	}
+	for _, field := range fields {
+		if strings.ContainsAny(field.value, "\n\x00") {
+			return "", fmt.Errorf("credential value for %s contains a newline or NUL", field.key)
+		}
+	}
+
+	var out strings.Builder
+	if action == "get" {
+		out.WriteString("capability[]=authtype\n")
+	}
+	fmt.Fprintf(&out, "protocol=%s\nhost=%s\n", c.protocol, c.host)
+	if c.path != "" {
+		fmt.Fprintf(&out, "path=%s\n", c.path)
+	}
+	if c.username != "" {
+		fmt.Fprintf(&out, "username=%s\n", c.username)
+	}
+	if c.password != "" && action != "get" {
+		fmt.Fprintf(&out, "password=%s\n", c.password)
+	}
+	if c.authType != "" && action != "get" {
+		fmt.Fprintf(&out, "authtype=%s\ncredential=%s\n", c.authType, c.token)
+	}
+	out.WriteString("\n")
+	return out.String(), nil
+}
+
+// askpass asks the user for a value through GIT_ASKPASS, core.askPass or
+// SSH_ASKPASS, in that order.
+func askpass(prompt string) (string, error) {
+	program := os.Getenv("GIT_ASKPASS")
+	if program == "" {
+		config, err := readUserAndRepositoryConfig()
+		if err != nil {
+			return "", err
+		}
+		program, _ = config.Get("core.askPass")
+	}
+	if program == "" {
+		program = os.Getenv("SSH_ASKPASS")
+	}
+	if program == "" {
+		return "", fmt.Errorf("no askpass program or credential helper configured")
+	}
+
+	cmd := exec.Command(program, prompt)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	daemonDefaultPort = "9418"
+	daemonDialTimeout = 30 * time.Second
+)
+
+// daemonRemote is a repository served by git daemon, which runs the
+// requested service over a plain TCP connection without authentication.
+type daemonRemote struct {
+	host string
+	port string
+	path string
+}
+
+func newDaemonTransport(url string) (*streamTransport, error) {
+	hostPort, path, _ := strings.Cut(strings.TrimPrefix(url, "git://"), "/")
+	remote := &daemonRemote{path: "/" + path}
+	remote.host, remote.port = splitHostPort(hostPort)
+	if remote.host == "" || path == "" {
+		return nil, fmt.Errorf("invalid git:// URL: %s", url)
+	}
+	return &streamTransport{host: remote.host, connect: remote.connect}, nil
+}
+
+// connect opens a connection to the daemon and asks it to run service on
+// the repository, requesting protocol v2 when fetching.
+func (d *daemonRemote) connect(service string) (*streamConn, error) {
+	port := d.port
+	if port == "" {
+		port = daemonDefaultPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(d.host, port), daemonDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %s", d.host, err)
+	}
+
+	if _, err := conn.Write(d.buildRequest(service)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to %s: %s", d.host, err)
+	}
+	return newStreamConn(conn, conn, conn.Close), nil
+}
+
+// buildRequest encodes the initial request line,
+// "<service> <path>\0host=<host>\0", followed by extra parameters after a
+// second NUL.
+func (d *daemonRemote) buildRequest(service string) []byte {
+	host := d.host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if d.port != "" {
+		host += ":" + d.port
+	}
+
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "%s %s\x00host=%s\x00", service, d.path, host)
+	if service == UploadPackService {
+		request.WriteString("\x00version=2\x00")
+	}
+	return []byte(encodePktLine(request.String()))
+}
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// startTestDaemon listens like git daemon, serving upload-pack from dir
+// under its base name, and returns its address and the requests it got.
+func startTestDaemon(t *testing.T, dir string) (string, func() []string) {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	var requests []string
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := newPktLineReader(conn).readLine()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				requests = append(requests, string(line))
+				mu.Unlock()
+
+				// "<service> <path>\0host=<host>\0[\0<parameter>\0...]"
+				fields := strings.Split(string(line), "\x00")
+				service, path, _ := strings.Cut(fields[0], " ")
+				if service != UploadPackService || path != "/"+filepath.Base(dir) {
+					return
+				}
+				cmd := exec.Command(executable, "upload-pack", dir)
+				if len(fields) > 3 {
+					cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+fields[3])
+				}
+				cmd.Stdin, cmd.Stdout = conn, conn
+				cmd.Run()
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, requests...)
+	}
+}
+
+func TestDaemonClone(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+	serverDir := filepath.Join(dir, "server.git")
+	initTestRepository(t, serverDir)
+	tip := newTestHistory(t, 3)
+	SetGitDir(DefaultGitDir)
+	address, requests := startTestDaemon(t, serverDir)
+
+	CloneRepository("git://"+address+"/server.git", filepath.Join(dir, "client"), CloneOptions{})
+	if head, err := ResolveRef("HEAD"); err != nil || head != tip {
+		t.Fatalf("cloned HEAD = %s, %v, want %s", head, err, tip)
+	}
+	if err := FetchRemote(FetchOptions{Remote: DefaultRemoteName}); err != nil {
+		t.Fatalf("FetchRemote: %s", err)
+	}
+
+	want := "git-upload-pack /server.git\x00host=" + address + "\x00\x00version=2\x00"
+	got := requests()
+	if len(got) != 2 {
+		t.Fatalf("daemon got %d requests, want one for the clone and one for the fetch: %q", len(got), got)
+	}
+	for _, request := range got {
+		if request != want {
+			t.Errorf("daemon request %q, want %q", request, want)
+		}
+	}
+}
+
+func TestDaemonRequest(t *testing.T) {
+	tests := []struct {
+		remote  daemonRemote
+		service string
+		want    string
+	}{
+		{daemonRemote{host: "example.com", path: "/repo.git"}, UploadPackService, "git-upload-pack /repo.git\x00host=example.com\x00\x00version=2\x00"},
+		{daemonRemote{host: "example.com", port: "9000", path: "/dir/repo"}, UploadPackService, "git-upload-pack /dir/repo\x00host=example.com:9000\x00\x00version=2\x00"},
+		{daemonRemote{host: "::1", port: "9000", path: "/repo.git"}, UploadPackService, "git-upload-pack /repo.git\x00host=[::1]:9000\x00\x00version=2\x00"},
+		{daemonRemote{host: "example.com", path: "/repo.git"}, ReceivePackService, "git-receive-pack /repo.git\x00host=example.com\x00"},
+	}
+	for _, test := range tests {
+		if got := string(test.remote.buildRequest(test.service)); got != encodePktLine(test.want) {
+			t.Errorf("%s request to %+v = %q, want %q", test.service, test.remote, got, encodePktLine(test.want))
+		}
+	}
+
+	for _, url := range []string{"git://example.com", "git://example.com/", "git:///repo.git"} {
+		if _, err := newDaemonTransport(url); err == nil {
+			t.Errorf("newDaemonTransport(%q) succeeded, want an error", url)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package lib
+
+// The delta encoder indexes the base object in blocks of deltaBlockSize
+// bytes by a rolling hash, then slides the same hash over the target to find
+// runs it can copy from the base. Whatever is not copied is inserted
+// literally. The result is the instruction stream applyDelta decodes.
+const (
+	deltaBlockSize = 16
+	// deltaHashMultiplier drives the polynomial rolling hash
+	deltaHashMultiplier uint32 = 0x01000193
+	// deltaMaxBucket bounds how many blocks sharing a hash are remembered,
+	// so repetitive bases do not make every lookup slow
+	deltaMaxBucket = 64
+	// deltaMaxCopy is the largest copy git's own encoder emits; larger runs
+	// are split across several instructions
+	deltaMaxCopy = 0x10000
+	// deltaMaxInsert is the most literal bytes one instruction can carry
+	deltaMaxInsert = 0x7F
+)
+
+// deltaHashOut is the weight of the byte leaving the rolling hash window.
+var deltaHashOut = func() uint32 {
+	weight := uint32(1)
+	for i := 1; i < deltaBlockSize; i++ {
+		weight *= deltaHashMultiplier
+	}
+	return weight
+}()
+
+// deltaIndex maps the hash of every block of a base object to the offsets
+// it occurs at, so one base can be compared against many targets.
+type deltaIndex struct {
+	base   []byte
+	blocks map[uint32][]int
+}
+
+func newDeltaIndex(base []byte) *deltaIndex {
+	index := &deltaIndex{base: base, blocks: make(map[uint32][]int)}
+	for offset := 0; offset+deltaBlockSize <= len(base); offset += deltaBlockSize {
+		hash := blockHash(base[offset : offset+deltaBlockSize])
+		if bucket := index.blocks[hash]; len(bucket) < deltaMaxBucket {
+			index.blocks[hash] = append(bucket, offset)
+		}
+	}
+	return index
+}
+
+func blockHash(block []byte) uint32 {
+	var hash uint32
+	for _, c := range block {
+		hash = hash*deltaHashMultiplier + uint32(c)
+	}
+	return hash
+}
+
+// rollHash moves the hash of a block one byte along, dropping out and
+// taking in.
+func rollHash(hash uint32, out, in byte) uint32 {
+	return (hash-uint32(out)*deltaHashOut)*deltaHashMultiplier + uint32(in)
+}
+
+// longestMatch returns the base offset and length of the longest run of the
+// base equal to target from position, among the blocks hashing to hash.
+func (index *deltaIndex) longestMatch(hash uint32, target []byte, position int) (int, int) {
+	bestOffset, bestLength := 0, 0
+	for _, offset := range index.blocks[hash] {
+		length := 0
+		for offset+length < len(index.base) && position+length < len(target) && index.base[offset+length] == target[position+length] {
+			length++
+		}
+		if length > bestLength {
+			bestOffset, bestLength = offset, length
+		}
+	}
+	return bestOffset, bestLength
+}
+
+// createDelta encodes target as a delta against the indexed base. It gives
+// up and returns nil once the delta would be larger than maxSize.
+func createDelta(index *deltaIndex, target []byte, maxSize int) []byte {
+	base := index.base
+	delta := appendDeltaSize(nil, len(base))
+	delta = appendDeltaSize(delta, len(target))
+
+	insertStart := 0
+	position := 0
+	var hash uint32
+	if len(target) >= deltaBlockSize {
+		hash = blockHash(target[:deltaBlockSize])
+	}
+	for position+deltaBlockSize <= len(target) {
+		offset, length := index.longestMatch(hash, target, position)
+		if length < deltaBlockSize {
+			if position+deltaBlockSize < len(target) {
+				hash = rollHash(hash, target[position], target[position+deltaBlockSize])
+			}
+			position++
+			if len(delta)+position-insertStart > maxSize {
+				return nil
+			}
+			continue
+		}
+
+		// The match may start before the block that found it
+		for offset > 0 && position > insertStart && base[offset-1] == target[position-1] {
+			offset--
+			position--
+			length++
+		}
+		delta = appendDeltaInserts(delta, target[insertStart:position])
+		delta = appendDeltaCopies(delta, offset, length)
+		position += length
+		insertStart = position
+		if len(delta) > maxSize {
+			return nil
+		}
+		if position+deltaBlockSize <= len(target) {
+			hash = blockHash(target[position : position+deltaBlockSize])
+		}
+	}
+
+	delta = appendDeltaInserts(delta, target[insertStart:])
+	if len(delta) > maxSize {
+		return nil
+	}
+	return delta
+}
+
+// appendDeltaSize appends a delta header size, seven bits at a time.
+func appendDeltaSize(delta []byte, size int) []byte {
+	for size >= 0x80 {
+		delta = append(delta, byte(size&0x7F)|0x80)
+		size >>= 7
+	}
+	return append(delta, byte(size))
+}
+
+func appendDeltaInserts(delta []byte, data []byte) []byte {
+	for len(data) > 0 {
+		n := len(data)
+		if n > deltaMaxInsert {
+			n = deltaMaxInsert
+		}
+		delta = append(delta, byte(n))
+		delta = append(delta, data[:n]...)
+		data = data[n:]
+	}
+	return delta
+}
+
+// appendDeltaCopies appends copy instructions for length bytes of the base
+// at offset. Only the non-zero bytes of the offset and size are stored, as
+// flagged in the instruction's low bits.
+func appendDeltaCopies(delta []byte, offset, length int) []byte {
+	for length > 0 {
+		size := length
+		if size > deltaMaxCopy {
+			size = deltaMaxCopy
+		}
+
+		opcode := byte(0x80)
+		var arguments []byte
+		for i := 0; i < 4; i++ {
+			if b := byte(offset >> (8 * i)); b != 0 {
+				opcode |= 1 << i
+				arguments = append(arguments, b)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if b := byte(size >> (8 * i)); b != 0 {
+				opcode |= 1 << (4 + i)
+				arguments = append(arguments, b)
+			}
+		}
+		delta = append(delta, opcode)
+		delta = append(delta, arguments...)
+
+		offset += size
+		length -= size
+	}
+	return delta
+}
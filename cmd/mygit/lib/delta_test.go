@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(random *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	random.Read(data)
+	return data
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 200)
+	large := randomBytes(random, 300000)
+
+	tests := []struct {
+		name   string
+		base   []byte
+		target []byte
+		// smaller is whether the delta must be much smaller than the target
+		smaller bool
+	}{
+		{"identical", text, text, true},
+		{"empty target", text, nil, false},
+		{"empty base", nil, text, false},
+		{"short base", []byte("abc"), []byte("abcabc"), false},
+		{"appended", text, join(text, []byte("one more line\n")), true},
+		{"prepended", text, join([]byte("a new first line\n"), text), true},
+		{"changed middle", text, join(text[:4000], []byte("changed"), text[4100:]), true},
+		{"unrelated", randomBytes(random, 5000), randomBytes(random, 5000), false},
+		{"copy over 0x10000 bytes", large, join(large[:200000], []byte("edit"), large[200000:]), true},
+		{"copy from past 0x10000", large, join(large[250000:], large[:1000]), true},
+		{"long insert", text, join(text, randomBytes(random, 1000)), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delta := createDelta(newDeltaIndex(test.base), test.target, len(test.target)+1000)
+			if delta == nil {
+				t.Fatal("createDelta gave up below its size limit")
+			}
+			if test.smaller && len(delta) > len(test.target)/10 {
+				t.Errorf("delta is %d bytes for a %d byte target", len(delta), len(test.target))
+			}
+
+			result, err := applyDelta(test.base, delta)
+			if err != nil {
+				t.Fatalf("applyDelta: %s", err)
+			}
+			if !bytes.Equal(result, test.target) {
+				t.Fatalf("applyDelta gave %d bytes, want the %d byte target", len(result), len(test.target))
+			}
+		})
+	}
+}
+
+func TestCreateDeltaGivesUpPastMaxSize(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	base, target := randomBytes(random, 4096), randomBytes(random, 4096)
+	if delta := createDelta(newDeltaIndex(base), target, 1000); delta != nil {
+		t.Fatalf("createDelta returned %d bytes, want nil past 1000", len(delta))
+	}
+}
+
+func TestApplyDeltaRefusesWrongBase(t *testing.T) {
+	base := []byte("0123456789abcdef0123456789abcdef")
+	delta := createDelta(newDeltaIndex(base), base, 100)
+	if _, err := applyDelta(base[1:], delta); err == nil {
+		t.Fatal("applyDelta accepted a base of the wrong size")
+	}
+}
+
+func TestOfsDeltaOffsetRoundTrip(t *testing.T) {
+	for _, offset := range []int64{1, 127, 128, 129, 16383, 16511, 16512, 1 << 20, 1<<35 + 12345} {
+		encoded := encodeOfsDeltaOffset(offset)
+		decoded, used, err := readOfsDeltaOffset(append(encoded, 0xFF))
+		if err != nil {
+			t.Fatalf("readOfsDeltaOffset(%x): %s", encoded, err)
+		}
+		if decoded != offset || used != len(encoded) {
+			t.Errorf("offset %d encoded as %x decodes to %d using %d bytes", offset, encoded, decoded, used)
+		}
+		if len(encoded) > 1 {
+			if _, _, err := readOfsDeltaOffset(encoded[:len(encoded)-1]); err == nil {
+				t.Errorf("readOfsDeltaOffset accepted offset %d cut short", offset)
+			}
+		}
+	}
+}
+
+func TestApplyDeltaRefusesMalformedDeltas(t *testing.T) {
+	base := []byte("0123456789")
+	tests := []struct {
+		name  string
+		delta string
+	}{
+		{"empty", ""},
+		{"base size only", "\x0a"},
+		{"base size cut short", "\x8a"},
+		{"result size cut short", "\x0a\x85"},
+		{"wrong base size", "\x0b\x02\x02ab"},
+		{"copy arguments cut short", "\x0a\x04\x91\x00"},
+		{"copy past the base", "\x0a\x04\x91\x08\x04"},
+		{"insert cut short", "\x0a\x04\x04ab"},
+		{"zero opcode", "\x0a\x00\x00"},
+		{"result larger than declared", "\x0a\x02\x90\x0a"},
+		{"insert larger than declared", "\x0a\x02\x04abcd"},
+		{"result smaller than declared", "\x0a\x04\x02ab"},
+	}
+	for _, test := range tests {
+		if result, err := applyDelta(base, []byte(test.delta)); err == nil {
+			t.Errorf("%s: applyDelta = %q, want an error", test.name, result)
+		}
+	}
+}
+
+func TestReadObjectHeaderRefusesTruncatedHeaders(t *testing.T) {
+	for _, header := range []string{"", "\xb5", "\xb5\x80"} {
+		if _, _, _, err := readObjectHeader([]byte(header)); err == nil {
+			t.Errorf("readObjectHeader(%q) succeeded, want an error", header)
+		}
+	}
+	size, objType, used, err := readObjectHeader([]byte("\xb5\x01rest"))
+	if err != nil || size != 21 || objType != ObjBlob || used != 2 {
+		t.Fatalf("readObjectHeader = %d, %d, %d, %v, want a 21 byte blob in 2 bytes", size, objType, used, err)
+	}
+}
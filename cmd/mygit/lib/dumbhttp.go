@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// discoverDumbRefs reads the refs of a repository served as static files
+// from its info/refs file, and the branch HEAD names from the HEAD file.
+// Such a server has no capabilities and can only be fetched from.
+func (t *httpTransport) discoverDumbRefs(service string, infoRefs io.Reader) (*refAdvertisement, error) {
+	if service != UploadPackService {
+		return nil, fmt.Errorf("'%s' is served by a dumb HTTP server, which does not support pushing", t.url)
+	}
+	t.dumb = true
+
+	advertisement := &refAdvertisement{symrefs: make(map[string]string)}
+	scanner := bufio.NewScanner(infoRefs)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		hash, name, found := strings.Cut(line, "\t")
+		if !found || ValidateHash(hash) != nil {
+			return nil, fmt.Errorf("invalid info/refs line: %q", line)
+		}
+		advertisement.refs = append(advertisement.refs, Ref{Hash: hash, Name: name})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	head, err := t.getFile("HEAD")
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.status == http.StatusNotFound {
+		return advertisement, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	head = bytes.TrimSpace(head)
+	headHash := string(head)
+	if target := strings.TrimPrefix(headHash, "ref: "); target != headHash {
+		advertisement.symrefs["HEAD"] = target
+		headHash, _ = advertisement.lookup(target)
+	}
+	if ValidateHash(headHash) == nil {
+		advertisement.refs = append([]Ref{{Hash: headHash, Name: "HEAD"}}, advertisement.refs...)
+	}
+	return advertisement, nil
+}
+
+// getFile downloads a file of the remote repository into memory.
+func (t *httpTransport) getFile(path string) ([]byte, error) {
+	response, err := t.client.do("GET", fmt.Sprintf("%s/%s", t.url, path), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return io.ReadAll(response.Body)
+}
+
+// dumbWalker fetches objects from a dumb server one at a time, walking from
+// the wanted objects down to those we already had. Each object is taken
+// from its loose file when the server has one, or else by downloading the
+// whole pack its index lists it in.
+type dumbWalker struct {
+	transport *httpTransport
+	// packs is the remote's objects/info/packs, read on first use
+	packs       []*dumbPack
+	packsListed bool
+	// fetched are the objects this walk brought in, whose links still
+	// have to be followed
+	fetched map[string]bool
+}
+
+// dumbPack is a pack the remote lists, with its index once downloaded.
+type dumbPack struct {
+	name       string
+	index      *packIndex
+	downloaded bool
+}
+
+// fetchDumbObjects stores every object reachable from the wants that we do
+// not have. Objects we had before are taken to be complete.
+func (t *httpTransport) fetchDumbObjects(fetch fetchRequest) (string, *shallowInfo, error) {
+	if fetch.deepen.active() || fetch.filter != "" {
+		return "", nil, fmt.Errorf("dumb HTTP servers do not support shallow or partial fetches")
+	}
+
+	walker := &dumbWalker{transport: t, fetched: make(map[string]bool)}
+	seen := make(map[string]bool)
+	queue := append([]string{}, fetch.wants...)
+	for len(queue) > 0 {
+		hash := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		if !ObjectExists(hash) {
+			if err := walker.fetchObject(hash); err != nil {
+				return "", nil, err
+			}
+		} else if !walker.fetched[hash] && !walker.inDownloadedPack(hash) {
+			continue
+		}
+
+		links, err := objectLinks(hash)
+		if err != nil {
+			return "", nil, err
+		}
+		queue = append(queue, links...)
+	}
+	return "", nil, nil
+}
+
+// objectLinks returns the objects an object refers to: a commit's tree and
+// parents, a tree's entries and a tag's target.
+func objectLinks(hash string) ([]string, error) {
+	obj, objType, _, err := ReadObjectFile(hash)
+	if err != nil {
+		return nil, err
+	}
+	if objType == "commit" {
+		// Read through ReadCommit so shallow commits have no parents
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{commit.Tree}, commit.Parents...), nil
+	}
+	links, err := parseObjectLinks(obj, objType)
+	if err != nil {
+		return nil, fmt.Errorf("%s in %s", err, hash)
+	}
+	return links, nil
+}
+
+// parseObjectLinks returns the objects obj refers to, failing if it is not
+// a well-formed object of its type.
+func parseObjectLinks(obj []byte, objType string) ([]string, error) {
+	switch objType {
+	case "commit":
+		commit, err := ParseCommit(obj)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range commit.Parents {
+			if ValidateHash(parent) != nil {
+				return nil, fmt.Errorf("invalid commit: bad parent")
+			}
+		}
+		return append([]string{commit.Tree}, commit.Parents...), nil
+	case "tree":
+		var links []string
+		for len(obj) > 0 {
+			space := bytes.IndexByte(obj, ' ')
+			null := bytes.IndexByte(obj, 0)
+			if space < 0 || null < space || len(obj) < null+21 {
+				return nil, fmt.Errorf("invalid tree entry")
+			}
+			// Submodule commits live in another repository
+			if mode := string(obj[:space]); mode != "160000" {
+				links = append(links, hex.EncodeToString(obj[null+1:null+21]))
+			}
+			obj = obj[null+21:]
+		}
+		return links, nil
+	case "tag":
+		target, _, _ := strings.Cut(string(obj), "\n")
+		if !strings.HasPrefix(target, "object ") || ValidateHash(strings.TrimPrefix(target, "object ")) != nil {
+			return nil, fmt.Errorf("invalid tag object")
+		}
+		return []string{strings.TrimPrefix(target, "object ")}, nil
+	}
+	return nil, nil
+}
+
+func (w *dumbWalker) fetchObject(hash string) error {
+	data, err := w.transport.getFile(fmt.Sprintf("objects/%s/%s", hash[:2], hash[2:]))
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.status == http.StatusNotFound {
+		return w.fetchPackContaining(hash)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Loose objects are served as they are stored, compressed
+	reader, err := decompressBytes(data)
+	if err != nil {
+		return fmt.Errorf("object %s is corrupt: %s", hash, err)
+	}
+	obj, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("object %s is corrupt: %s", hash, err)
+	}
+	if hex.EncodeToString(HashBytes(obj)) != hash {
+		return fmt.Errorf("object %s does not match its name", hash)
+	}
+
+	if err := os.MkdirAll(filepath.Join(ObjectsDir, hash[:2]), 0755); err != nil {
+		return err
+	}
+	if err := WriteFile(filepath.Join(ObjectsDir, hash[:2], hash[2:]), data); err != nil {
+		return err
+	}
+	w.fetched[hash] = true
+	return nil
+}
+
+// fetchPackContaining downloads the first pack whose index lists hash.
+func (w *dumbWalker) fetchPackContaining(hash string) error {
+	if err := w.listPacks(); err != nil {
+		return err
+	}
+	rawHash, _ := hex.DecodeString(hash)
+
+	for _, pack := range w.packs {
+		if pack.downloaded {
+			continue
+		}
+		if pack.index == nil {
+			data, err := w.transport.getFile(fmt.Sprintf("objects/pack/%s.idx", pack.name))
+			if err != nil {
+				return err
+			}
+			pack.index, err = parsePackIndex(pack.name+".idx", data)
+			if err != nil {
+				return err
+			}
+		}
+		if _, ok := pack.index.find(rawHash); !ok {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Getting pack %s\n", strings.TrimPrefix(pack.name, "pack-"))
+		response, err := w.transport.client.do("GET", fmt.Sprintf("%s/objects/pack/%s.pack", w.transport.url, pack.name), nil, nil)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if _, err := writePackfile(response.Body); err != nil {
+			return fmt.Errorf("storing %s: %s", pack.name, err)
+		}
+		pack.downloaded = true
+		return nil
+	}
+	return fmt.Errorf("unable to find %s on the remote", hash)
+}
+
+// listPacks reads objects/info/packs, which names a pack on every
+// "P pack-<hash>.pack" line.
+func (w *dumbWalker) listPacks() error {
+	if w.packsListed {
+		return nil
+	}
+	w.packsListed = true
+
+	data, err := w.transport.getFile("objects/info/packs")
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name := strings.TrimPrefix(line, "P "); name != line && strings.HasSuffix(name, ".pack") {
+			w.packs = append(w.packs, &dumbPack{name: strings.TrimSuffix(name, ".pack")})
+		}
+	}
+	return nil
+}
+
+// inDownloadedPack reports whether hash came in one of the packs this walk
+// downloaded, so that its links have to be followed too.
+func (w *dumbWalker) inDownloadedPack(hash string) bool {
+	rawHash, _ := hex.DecodeString(hash)
+	for _, pack := range w.packs {
+		if pack.downloaded {
+			if _, ok := pack.index.find(rawHash); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
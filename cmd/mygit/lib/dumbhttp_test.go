@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// updateServerInfo writes the files a dumb server needs besides the
+// objects, as git update-server-info does.
+func updateServerInfo(t *testing.T) {
+	t.Helper()
+	refs, err := ListRefs("refs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infoRefs strings.Builder
+	for _, ref := range refs {
+		fmt.Fprintf(&infoRefs, "%s\t%s\n", ref.Hash, ref.Name)
+	}
+	packs, err := filepath.Glob(filepath.Join(PackDir, "pack-*.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infoPacks strings.Builder
+	for _, pack := range packs {
+		fmt.Fprintf(&infoPacks, "P %s\n", filepath.Base(pack))
+	}
+
+	for path, contents := range map[string]string{
+		filepath.Join(GitDir, "info", "refs"):      infoRefs.String(),
+		filepath.Join(ObjectsDir, "info", "packs"): infoPacks.String(),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// packHistory moves everything tip reaches into a pack.
+func packHistory(t *testing.T, tip string) {
+	t.Helper()
+	if err := os.MkdirAll(PackDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	options := PackObjectsOptions{BaseName: filepath.Join(PackDir, "pack"), Revs: true, Window: 10, Depth: 50}
+	if err := PackObjects(strings.NewReader(tip+"\n"), &out, options); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := listObjects([]string{tip}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if err := os.Remove(filepath.Join(ObjectsDir, object.hash[:2], object.hash[2:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resetStoredPacks()
+}
+
+func TestDumbHTTPCloneAndFetch(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+	serverDir := filepath.Join(dir, "server.git")
+	initTestRepository(t, serverDir)
+	packed := newTestHistory(t, 3)
+	packHistory(t, packed)
+	tip := packed
+	for i := 0; i < 2; i++ {
+		tip = writeTestCommit(t, fmt.Sprintf("loose %d\n", i), tip)
+	}
+	if err := UpdateRef("refs/heads/main", tip); err != nil {
+		t.Fatal(err)
+	}
+	updateServerInfo(t)
+	SetGitDir(DefaultGitDir)
+
+	var mu sync.Mutex
+	var requested []string
+	files := http.FileServer(http.Dir(serverDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	CloneRepository(server.URL, filepath.Join(dir, "client"), CloneOptions{})
+	if head, err := ResolveRef("HEAD"); err != nil || head != tip {
+		t.Fatalf("cloned HEAD = %s, %v, want %s", head, err, tip)
+	}
+	history, err := listObjects([]string{tip}, nil)
+	if err != nil {
+		t.Fatalf("the clone is incomplete: %s", err)
+	}
+	for _, object := range history {
+		if !ObjectExists(object.hash) {
+			t.Errorf("%s %s is missing from the clone", object.objType, object.hash)
+		}
+	}
+
+	// The older commits could only have come from the pack
+	mu.Lock()
+	fetchedPack := false
+	for _, path := range requested {
+		fetchedPack = fetchedPack || strings.HasPrefix(path, "/objects/pack/pack-") && strings.HasSuffix(path, ".pack")
+	}
+	mu.Unlock()
+	if !fetchedPack {
+		t.Errorf("the clone did not download the pack: %q", requested)
+	}
+
+	// A fetch walks only down to the objects it already has
+	var newer string
+	withGitDir(serverDir, func() error {
+		newer = writeTestCommit(t, "newer\n", tip)
+		if err := UpdateRef("refs/heads/main", newer); err != nil {
+			t.Fatal(err)
+		}
+		updateServerInfo(t)
+		return nil
+	})
+	mu.Lock()
+	requested = nil
+	mu.Unlock()
+	if err := FetchRemote(FetchOptions{Remote: DefaultRemoteName}); err != nil {
+		t.Fatalf("FetchRemote: %s", err)
+	}
+	if remote, err := ResolveRef("refs/remotes/origin/main"); err != nil || remote != newer {
+		t.Fatalf("refs/remotes/origin/main = %s, %v, want %s", remote, err, newer)
+	}
+	for _, path := range requested {
+		if strings.HasPrefix(path, "/objects/pack/") || strings.Contains(path, tip[2:]) {
+			t.Errorf("the fetch requested %s, which it already had", path)
+		}
+	}
+
+	// Only fetching is possible
+	err = PushRemote(PushOptions{Remote: DefaultRemoteName})
+	if err == nil {
+		t.Fatal("pushed to a dumb server")
+	}
+}
@@ -0,0 +1,374 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type FetchOptions struct {
+	Remote   string
+	Refspecs []string
+	// Depth limits history to that many commits from the fetched tips,
+	// Deepen extends the current shallow boundary by that many commits and
+	// Unshallow fetches all missing history
+	Depth     int
+	Deepen    int
+	Unshallow bool
+	// Filter fetches from the remote as a promisor, leaving out the filtered
+	// objects; a promisor remote's recorded filter applies by default
+	Filter string
+	// UpdateHeadOK allows fetching into the branch the working tree has
+	// checked out, which is otherwise refused
+	UpdateHeadOK bool
+}
+
+type refUpdate struct {
+	remoteName string
+	localName  string
+	hash       string
+	force      bool
+}
+
+func FetchRemote(options FetchOptions) error {
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return err
+	}
+
+	remote := options.Remote
+	if remote == "" {
+		remote = defaultRemote(config)
+	}
+
+	url, ok := config.Get(fmt.Sprintf("remote.%s.url", remote))
+	specs := options.Refspecs
+	if !ok {
+		if !strings.ContainsAny(remote, "/:") {
+			return fmt.Errorf("'%s' does not appear to be a git repository", remote)
+		}
+		url = remote
+	}
+	if len(specs) == 0 && ok {
+		specs = config.GetAll(fmt.Sprintf("remote.%s.fetch", remote))
+	}
+	if len(specs) == 0 {
+		specs = []string{"HEAD"}
+	}
+
+	var refspecs []Refspec
+	for _, spec := range specs {
+		refspec, err := ParseRefspec(spec)
+		if err != nil {
+			return err
+		}
+		refspecs = append(refspecs, refspec)
+	}
+
+	remoteTransport, err := openTransport(url)
+	if err != nil {
+		return err
+	}
+	defer remoteTransport.close()
+	advertisement, err := remoteTransport.discoverRefs(UploadPackService, refspecPrefixes(refspecs))
+	if err != nil {
+		return err
+	}
+
+	deepen, err := fetchDeepenRequest(options)
+	if err != nil {
+		return err
+	}
+	err = advertisement.checkDeepenSupport(deepen)
+	if err != nil {
+		return err
+	}
+
+	filter := options.Filter
+	if filter == "" && ok {
+		filter = promisorFilter(config, remote)
+	}
+	err = advertisement.checkFilterSupport(filter)
+	if err != nil {
+		return err
+	}
+	if options.Filter != "" && ok {
+		err = registerPromisorRemote(remote, options.Filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	updates, err := matchRefspecs(advertisement, refspecs)
+	if err != nil {
+		return err
+	}
+	if !options.UpdateHeadOK {
+		for _, update := range updates {
+			if isCheckedOutBranch(update.localName) {
+				return fmt.Errorf("refusing to fetch into branch '%s' checked out in this repository", update.localName)
+			}
+		}
+	}
+
+	// Deepening has to name tips we already have to extend history below them
+	var wants []string
+	seen := make(map[string]bool)
+	for _, update := range updates {
+		if !seen[update.hash] && (deepen.active() || !ObjectExists(update.hash)) {
+			seen[update.hash] = true
+			wants = append(wants, update.hash)
+		}
+	}
+
+	if len(wants) > 0 {
+		tips, err := localHaveTips()
+		if err != nil {
+			return err
+		}
+
+		fetch := fetchRequest{wants: wants, deepen: deepen, filter: filter}
+		packPath, shallow, err := remoteTransport.fetchPack(advertisement, fetch, newHaveWalker(tips))
+		if err != nil {
+			return err
+		}
+
+		if filter != "" && packPath != "" {
+			var refs []Ref
+			for _, update := range updates {
+				refs = append(refs, Ref{Hash: update.hash, Name: update.remoteName})
+			}
+			err = markPromisorPack(packPath, refs)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = updateShallow(shallow)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ok {
+		updates = append(updates, followTags(advertisement, updates)...)
+	}
+
+	return applyRefUpdates(url, updates, mergeRef(config, remote))
+}
+
+func fetchDeepenRequest(options FetchOptions) (deepenRequest, error) {
+	switch {
+	case options.Unshallow && (options.Depth > 0 || options.Deepen > 0):
+		return deepenRequest{}, fmt.Errorf("--unshallow cannot be used with --depth or --deepen")
+	case options.Depth > 0 && options.Deepen > 0:
+		return deepenRequest{}, fmt.Errorf("--deepen and --depth are mutually exclusive")
+	case options.Unshallow:
+		shallow, err := IsShallowRepository()
+		if err != nil {
+			return deepenRequest{}, err
+		}
+		if !shallow {
+			return deepenRequest{}, fmt.Errorf("--unshallow on a complete repository does not make sense")
+		}
+		return deepenRequest{depth: infiniteDepth}, nil
+	case options.Deepen > 0:
+		return deepenRequest{depth: options.Deepen, relative: true}, nil
+	}
+	return deepenRequest{depth: options.Depth}, nil
+}
+
+// mergeRef returns the upstream ref of the current branch when it tracks
+// remote; FETCH_HEAD marks it as the one to merge.
+func mergeRef(config *Config, remote string) string {
+	branch, err := ReadSymbolicRef("HEAD")
+	if err != nil || branch == "" {
+		return ""
+	}
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+
+	if upstream, _ := config.Get(fmt.Sprintf("branch.%s.remote", branch)); upstream != remote {
+		return ""
+	}
+	ref, _ := config.Get(fmt.Sprintf("branch.%s.merge", branch))
+	return ref
+}
+
+// refspecPrefixes returns the ref prefixes a protocol v2 server needs to
+// list for refspecs to match, plus tags for auto-following.
+func refspecPrefixes(refspecs []Refspec) []string {
+	prefixes := []string{"refs/tags/"}
+	for _, refspec := range refspecs {
+		if refspec.IsGlob() {
+			prefix, _, _ := strings.Cut(refspec.Src, "*")
+			prefixes = append(prefixes, prefix)
+		} else {
+			prefixes = append(prefixes, expandRefName(refspec.Src)...)
+		}
+	}
+	return prefixes
+}
+
+func defaultRemote(config *Config) string {
+	if branch, err := ReadSymbolicRef("HEAD"); err == nil && branch != "" {
+		key := fmt.Sprintf("branch.%s.remote", strings.TrimPrefix(branch, "refs/heads/"))
+		if remote, ok := config.Get(key); ok {
+			return remote
+		}
+	}
+	return DefaultRemoteName
+}
+
+// matchRefspecs returns the updates refspecs make of the advertised refs. A
+// refspec naming a single ref takes the first of its expansions the remote
+// has, in expandRefName's order, whatever order the refs come in.
+func matchRefspecs(advertisement *refAdvertisement, refspecs []Refspec) ([]refUpdate, error) {
+	var updates []refUpdate
+	for _, refspec := range refspecs {
+		if !refspec.IsGlob() {
+			update, ok := matchSingleRefspec(advertisement, refspec)
+			if !ok {
+				return nil, fmt.Errorf("couldn't find remote ref %s", refspec.Src)
+			}
+			updates = append(updates, update)
+			continue
+		}
+
+		for _, ref := range advertisement.refs {
+			if strings.HasSuffix(ref.Name, "^{}") {
+				continue
+			}
+			if localName, ok := refspec.MatchSource(ref.Name); ok {
+				updates = append(updates, refUpdate{remoteName: ref.Name, localName: localName, hash: ref.Hash, force: refspec.Force})
+			}
+		}
+	}
+	return updates, nil
+}
+
+func matchSingleRefspec(advertisement *refAdvertisement, refspec Refspec) (refUpdate, bool) {
+	for _, candidate := range expandRefName(refspec.Src) {
+		if hash, ok := advertisement.lookup(candidate); ok {
+			return refUpdate{remoteName: candidate, localName: expandDestination(refspec.Dst), hash: hash, force: refspec.Force}, true
+		}
+	}
+	return refUpdate{}, false
+}
+
+// followTags returns updates for advertised tags that point into history we
+// now have but that are not yet present locally.
+func followTags(advertisement *refAdvertisement, updates []refUpdate) []refUpdate {
+	updating := make(map[string]bool)
+	for _, update := range updates {
+		updating[update.localName] = true
+	}
+
+	var tags []refUpdate
+	for _, ref := range advertisement.refs {
+		if !strings.HasPrefix(ref.Name, "refs/tags/") || strings.HasSuffix(ref.Name, "^{}") || updating[ref.Name] {
+			continue
+		}
+		if existing, err := ResolveRef(ref.Name); err != nil || existing != "" {
+			continue
+		}
+		if ObjectExists(ref.Hash) && ObjectExists(advertisement.peeled(ref.Name, ref.Hash)) {
+			tags = append(tags, refUpdate{remoteName: ref.Name, localName: ref.Name, hash: ref.Hash})
+		}
+	}
+	return tags
+}
+
+func applyRefUpdates(url string, updates []refUpdate, mergeRef string) error {
+	var fetchHead bytes.Buffer
+	var rejected bool
+	printedHeader := false
+
+	for i, update := range updates {
+		mergeStatus := "not-for-merge"
+		if update.remoteName == mergeRef || (mergeRef == "" && i == 0 && !strings.HasPrefix(update.remoteName, "refs/tags/")) {
+			mergeStatus = ""
+		}
+		fmt.Fprintf(&fetchHead, "%s\t%s\t%s\n", update.hash, mergeStatus, describeFetchedRef(update.remoteName, url))
+
+		if update.localName == "" {
+			continue
+		}
+
+		flag, summary, suffix, err := updateLocalRef(update)
+		if err != nil {
+			return err
+		}
+		if summary == "" {
+			continue
+		}
+		if flag == '!' {
+			rejected = true
+		}
+
+		if !printedHeader {
+			fmt.Fprintf(os.Stderr, "From %s\n", url)
+			printedHeader = true
+		}
+		fmt.Fprintf(os.Stderr, " %c %-17s %-10s -> %s%s\n", flag, summary, ShortRefName(update.remoteName), ShortRefName(update.localName), suffix)
+	}
+
+	if err := WriteFile(FetchHeadFilePath, fetchHead.Bytes()); err != nil {
+		return err
+	}
+	if rejected {
+		return fmt.Errorf("some local refs could not be updated")
+	}
+	return nil
+}
+
+// updateLocalRef moves a remote-tracking ref, detecting forced updates. It
+// returns git's status flag, summary and suffix for display.
+func updateLocalRef(update refUpdate) (byte, string, string, error) {
+	old, err := ResolveRef(update.localName)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	if old == update.hash {
+		return '=', "", "", nil
+	}
+
+	if old == "" {
+		summary := "[new ref]"
+		if strings.HasPrefix(update.localName, "refs/tags/") {
+			summary = "[new tag]"
+		} else if strings.HasPrefix(update.remoteName, "refs/heads/") {
+			summary = "[new branch]"
+		}
+		return '*', summary, "", UpdateRef(update.localName, update.hash)
+	}
+
+	fastForward := false
+	if !strings.HasPrefix(update.localName, "refs/tags/") {
+		fastForward, _ = IsAncestor(old, update.hash)
+	}
+
+	if fastForward {
+		return ' ', fmt.Sprintf("%s..%s", old[:7], update.hash[:7]), "", UpdateRef(update.localName, update.hash)
+	}
+	if update.force {
+		return '+', fmt.Sprintf("%s...%s", old[:7], update.hash[:7]), "  (forced update)", UpdateRef(update.localName, update.hash)
+	}
+	if strings.HasPrefix(update.localName, "refs/tags/") {
+		return '!', "[rejected]", "  (would clobber existing tag)", nil
+	}
+	return '!', "[rejected]", "  (non-fast-forward)", nil
+}
+
+func describeFetchedRef(name, url string) string {
+	switch {
+	case strings.HasPrefix(name, "refs/heads/"):
+		return fmt.Sprintf("branch '%s' of %s", strings.TrimPrefix(name, "refs/heads/"), url)
+	case strings.HasPrefix(name, "refs/tags/"):
+		return fmt.Sprintf("tag '%s' of %s", strings.TrimPrefix(name, "refs/tags/"), url)
+	case name == "HEAD":
+		return url
+	}
+	return fmt.Sprintf("'%s' of %s", name, url)
+}
@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchRefspecs(t *testing.T) {
+	hash := func(c string) string { return strings.Repeat(c, 40) }
+	advertisement := &refAdvertisement{refs: []Ref{
+		{Name: "HEAD", Hash: hash("1")},
+		{Name: "refs/heads/main", Hash: hash("1")},
+		{Name: "refs/heads/feature/x", Hash: hash("2")},
+		{Name: "refs/heads/v2", Hash: hash("4")},
+		{Name: "refs/tags/v1", Hash: hash("3")},
+		{Name: "refs/tags/v1^{}", Hash: hash("1")},
+		{Name: "refs/tags/v2", Hash: hash("5")},
+	}}
+
+	tests := []struct {
+		name     string
+		refspecs []string
+		want     []refUpdate
+		wantErr  bool
+	}{
+		{
+			name:     "glob",
+			refspecs: []string{"+refs/heads/*:refs/remotes/origin/*"},
+			want: []refUpdate{
+				{remoteName: "refs/heads/main", localName: "refs/remotes/origin/main", hash: hash("1"), force: true},
+				{remoteName: "refs/heads/feature/x", localName: "refs/remotes/origin/feature/x", hash: hash("2"), force: true},
+				{remoteName: "refs/heads/v2", localName: "refs/remotes/origin/v2", hash: hash("4"), force: true},
+			},
+		},
+		{
+			name:     "glob skips peeled tags",
+			refspecs: []string{"refs/tags/*:refs/tags/*"},
+			want: []refUpdate{
+				{remoteName: "refs/tags/v1", localName: "refs/tags/v1", hash: hash("3")},
+				{remoteName: "refs/tags/v2", localName: "refs/tags/v2", hash: hash("5")},
+			},
+		},
+		{
+			name:     "short source and destination",
+			refspecs: []string{"main:copy"},
+			want:     []refUpdate{{remoteName: "refs/heads/main", localName: "refs/heads/copy", hash: hash("1")}},
+		},
+		{
+			name:     "tag before branch",
+			refspecs: []string{"v1:refs/tags/v1"},
+			want:     []refUpdate{{remoteName: "refs/tags/v1", localName: "refs/tags/v1", hash: hash("3")}},
+		},
+		{
+			// The branch is advertised first, but a tag takes precedence
+			name:     "tag and branch of the same name",
+			refspecs: []string{"v2:refs/heads/copy"},
+			want:     []refUpdate{{remoteName: "refs/tags/v2", localName: "refs/heads/copy", hash: hash("5")}},
+		},
+		{
+			name:     "no destination",
+			refspecs: []string{"HEAD"},
+			want:     []refUpdate{{remoteName: "HEAD", localName: "", hash: hash("1")}},
+		},
+		{
+			name:     "unmatched glob",
+			refspecs: []string{"refs/pull/*:refs/remotes/pull/*"},
+		},
+		{
+			name:     "missing ref",
+			refspecs: []string{"refs/heads/missing:refs/heads/missing"},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var refspecs []Refspec
+			for _, spec := range test.refspecs {
+				refspec, err := ParseRefspec(spec)
+				if err != nil {
+					t.Fatalf("ParseRefspec(%q): %s", spec, err)
+				}
+				refspecs = append(refspecs, refspec)
+			}
+
+			updates, err := matchRefspecs(advertisement, refspecs)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("matchRefspecs = %+v, want an error", updates)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("matchRefspecs: %s", err)
+			}
+			if !reflect.DeepEqual(updates, test.want) {
+				t.Fatalf("matchRefspecs = %+v, want %+v", updates, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRefspecRefusesInvalid(t *testing.T) {
+	for _, spec := range []string{"", ":refs/heads/x", "refs/*/*:refs/*", "refs/heads/*:refs/heads/x", "+"} {
+		if refspec, err := ParseRefspec(spec); err == nil {
+			t.Errorf("ParseRefspec(%q) = %+v, want an error", spec, refspec)
+		}
+	}
+}
+
+// recordingConn serves each request with a stateless upload-pack run in
+// this process, keeping the requests.
+type recordingConn struct {
+	gitDir   string
+	protocol string
+	requests []string
+}
+
+func (c *recordingConn) roundTrip(request io.Reader) (io.ReadCloser, error) {
+	data, err := io.ReadAll(request)
+	if err != nil {
+		return nil, err
+	}
+	c.requests = append(c.requests, string(data))
+
+	var response bytes.Buffer
+	options := UploadPackOptions{StatelessRPC: true, Protocol: c.protocol}
+	if err := UploadPack(c.gitDir, bytes.NewReader(data), &response, options); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&response), nil
+}
+
+func (c *recordingConn) stateless() bool {
+	return true
+}
+
+func (c *recordingConn) advertisement(t *testing.T) *refAdvertisement {
+	t.Helper()
+	var response bytes.Buffer
+	options := UploadPackOptions{StatelessRPC: true, AdvertiseRefs: true, Protocol: c.protocol}
+	if err := UploadPack(c.gitDir, nil, &response, options); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := readRefAdvertisement(newPktLineReader(&response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isProtocolV2(lines) {
+		advertisement, err := parseRefAdvertisement(lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return advertisement
+	}
+	advertisement := parseV2CapabilityAdvertisement(lines)
+	if err := advertisement.listRefs(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.requests = nil
+	return advertisement
+}
+
+func TestNegotiatePackfile(t *testing.T) {
+	for _, protocol := range []string{"", "version=2"} {
+		t.Run("protocol "+protocol, func(t *testing.T) {
+			isolateTest(t)
+			serverDir := filepath.Join(t.TempDir(), "server.git")
+			initTestRepository(t, serverDir)
+			serverTip := newTestHistory(t, 40)
+
+			// The client shares the first 30 commits, the dates being fixed,
+			// and has more commits of its own than the first batch of haves
+			initTestRepository(t, filepath.Join(t.TempDir(), "client.git"))
+			common := newTestHistory(t, 30)
+			tip := common
+			for i := 0; i < 20; i++ {
+				tip = writeTestCommit(t, fmt.Sprintf("local %d\n", i), tip)
+			}
+			if err := UpdateRef("refs/heads/main", tip); err != nil {
+				t.Fatal(err)
+			}
+
+			conn := &recordingConn{gitDir: serverDir, protocol: protocol}
+			advertisement := conn.advertisement(t)
+			fetch := fetchRequest{wants: []string{serverTip}}
+			packfile, _, err := negotiatePackfile(conn, advertisement, fetch, newHaveWalker([]string{tip}))
+			if err != nil {
+				t.Fatalf("negotiatePackfile: %s", err)
+			}
+			defer packfile.Close()
+			pack, err := io.ReadAll(packfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Only the ten commits the client lacks, with their trees and
+			// blobs, are sent
+			if len(pack) < 12 || string(pack[:4]) != "PACK" {
+				t.Fatalf("response is not a pack: %q", pack)
+			}
+			if count := binary.BigEndian.Uint32(pack[8:12]); count != 30 {
+				t.Errorf("pack holds %d objects, want 30", count)
+			}
+
+			// The first round is all in vain and a later one finds the
+			// common commit, which the last request names again since the
+			// service is stateless. A v2 server that is ready sends the
+			// pack without waiting for done.
+			if len(conn.requests) < 2 {
+				t.Fatalf("negotiated in %d requests, want more than one", len(conn.requests))
+			}
+			if strings.Contains(conn.requests[0], "have "+common) {
+				t.Errorf("first request already has the common commit:\n%s", conn.requests[0])
+			}
+			last := conn.requests[len(conn.requests)-1]
+			if !strings.Contains(last, "have "+common) {
+				t.Errorf("last request does not name the common commit:\n%s", last)
+			}
+			if protocol == "" && !strings.Contains(last, encodePktLine("done\n")) {
+				t.Errorf("last request does not finish the negotiation:\n%s", last)
+			}
+		})
+	}
+}
+
+func TestFetchRefusesCheckedOutBranch(t *testing.T) {
+	serverDir, tip := newPushTest(t)
+	var newer string
+	withGitDir(serverDir, func() error {
+		newer = writeTestCommit(t, "newer\n", tip)
+		return UpdateRef("refs/heads/main", newer)
+	})
+
+	options := FetchOptions{Remote: DefaultRemoteName, Refspecs: []string{"main:main"}}
+	err := FetchRemote(options)
+	if err == nil || !strings.Contains(err.Error(), "refusing to fetch into branch 'refs/heads/main'") {
+		t.Fatalf("FetchRemote = %v, want a refusal", err)
+	}
+	if head, _ := ResolveRef("refs/heads/main"); head != tip {
+		t.Fatalf("main = %s after a refused fetch, want %s", head, tip)
+	}
+
+	options.UpdateHeadOK = true
+	if err := FetchRemote(options); err != nil {
+		t.Fatalf("FetchRemote with UpdateHeadOK: %s", err)
+	}
+	if head, _ := ResolveRef("refs/heads/main"); head != newer {
+		t.Fatalf("main = %s, want %s", head, newer)
+	}
+}
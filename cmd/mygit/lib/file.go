@@ -19,14 +19,14 @@ func WriteFile(file string, data []byte) error {
 func WriteObject(obj []byte) ([]byte, error) {
 	zObj, err := compressBytes(obj)
 	if err != nil {
-		HandleError("Error compressing object: %s\n", err)
+		return nil, fmt.Errorf("compressing object: %s", err)
 	}
 
 	objHashSum := HashBytes(obj)
 
 	objectDir, err := CreateObjectDirectory(objHashSum)
 	if err != nil {
-		HandleError("Error creating object directory: %s\n", err)
+		return nil, fmt.Errorf("creating object directory: %s", err)
 	}
 
 	hashString := fmt.Sprintf("%x", objHashSum)
@@ -34,19 +34,23 @@ func WriteObject(obj []byte) ([]byte, error) {
 
 	err = WriteFile(writePath, zObj)
 	if err != nil {
-		HandleError("Error writing object: %s\n", err)
+		return nil, err
 	}
 
 	return objHashSum, nil
 }
 
 func WriteObjectWithType(obj []byte, objType string) ([]byte, error) {
+	return WriteObject(encodeObject(obj, objType))
+}
+
+func encodeObject(obj []byte, objType string) []byte {
 	buf := bytes.Buffer{}
 	fmt.Fprintf(&buf, "%s %d", objType, len(obj))
 	buf.WriteByte(0)
 	buf.Write(obj)
 
-	return WriteObject(buf.Bytes())
+	return buf.Bytes()
 }
 
 func CreateObjectDirectory(hashSum []byte) (string, error) {
@@ -61,14 +65,43 @@ func CreateObjectDirectory(hashSum []byte) (string, error) {
 }
 
 func ObjectFileExists(hashString string) bool {
+	if ValidateHash(hashString) != nil {
+		return false
+	}
 	objectPath := filepath.Join(ObjectsDir, hashString[:2], hashString[2:])
 	_, err := os.Stat(objectPath)
 	return !os.IsNotExist(err)
 }
 
+func ObjectExists(hashString string) bool {
+	if ObjectFileExists(hashString) {
+		return true
+	}
+	pack, _, err := findStoredPack(hashString)
+	return err == nil && pack != nil
+}
+
 func ReadObjectFile(hashString string) ([]byte, string, int, error) {
+	if err := ValidateHash(hashString); err != nil {
+		return nil, "", 0, err
+	}
+
 	objectPath := filepath.Join(ObjectsDir, hashString[:2], hashString[2:])
 	zObj, err := ReadFile(objectPath)
+	if os.IsNotExist(err) {
+		// A partial clone fetches objects it left out on first use
+		if !ObjectExists(hashString) {
+			if err := fetchPromisedObjects([]string{hashString}); err != nil {
+				return nil, "", 0, err
+			}
+		}
+
+		packedObj, objType, err := readPackedObject(hashString)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		return packedObj, objType, len(packedObj), nil
+	}
 	if err != nil {
 		return nil, "", 0, err
 	}
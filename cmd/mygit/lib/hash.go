@@ -30,6 +30,11 @@ func ValidateHash(hash string) error {
 	if len(hash) != 40 {
 		return fmt.Errorf("invalid hash: %s", hash)
 	}
+	for i := 0; i < len(hash); i++ {
+		if c := hash[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("invalid hash: %s", hash)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,406 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultUserAgent identifies us to servers unless http.userAgent or
+// GIT_HTTP_USER_AGENT says otherwise. Some servers only speak the smart
+// protocol to agents starting with "git/".
+const defaultUserAgent = "git/mygit"
+
+// httpConnectTimeout bounds how long connecting to a server may take; a
+// stalled transfer is caught by http.lowSpeedLimit and http.lowSpeedTime.
+const httpConnectTimeout = 30 * time.Second
+
+// A server that has read a request must start answering within
+// httpResponseHeaderTimeout, and a transfer that moves less than
+// defaultLowSpeedLimit bytes per second over defaultLowSpeedTime is taken
+// to have stalled, unless http.lowSpeedLimit and http.lowSpeedTime say
+// otherwise. They are variables so tests need not wait minutes.
+var (
+	httpResponseHeaderTimeout       = 5 * time.Minute
+	defaultLowSpeedLimit      int64 = 1
+	defaultLowSpeedTime             = 5 * time.Minute
+)
+
+// httpClient sends the requests of one smart HTTP session. When the server
+// answers 401 Unauthorized it obtains credentials and repeats the request,
+// and sends them with every request after that.
+type httpClient struct {
+	// url is the remote repository, named in errors
+	url           string
+	client        *http.Client
+	userAgent     string
+	extraHeaders  []string
+	lowSpeedLimit int64
+	lowSpeedTime  time.Duration
+	credential    *credential
+	authorization string
+}
+
+// newHTTPTransport takes any username and password out of url, so they are
+// only sent once the server asks for them.
+func newHTTPTransport(url string) (*httpTransport, error) {
+	parsed, err := neturl.Parse(strings.TrimSuffix(url, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", url)
+	}
+
+	cred := &credential{protocol: parsed.Scheme, host: parsed.Host}
+	if parsed.User != nil {
+		cred.username = parsed.User.Username()
+		cred.password, _ = parsed.User.Password()
+	}
+	// Percent-encoded, these would reach credential helpers as keys of
+	// their own
+	if strings.ContainsAny(cred.username+cred.password+parsed.Host+parsed.Path, "\n\x00") {
+		return nil, fmt.Errorf("URL contains a newline or NUL: %s", parsed.Redacted())
+	}
+	parsed.User = nil
+
+	config, err := readUserAndRepositoryConfig()
+	if err != nil {
+		return nil, err
+	}
+	if useHTTPPath, _ := config.Get("credential.useHttpPath"); useHTTPPath == "true" {
+		cred.path = strings.TrimPrefix(parsed.Path, "/")
+	}
+	if cred.username == "" {
+		cred.username, _ = config.Get("credential.username")
+	}
+
+	client, err := newHTTPClient(parsed.String(), config)
+	if err != nil {
+		return nil, err
+	}
+	client.credential = cred
+	return &httpTransport{url: parsed.String(), client: client}, nil
+}
+
+// newHTTPClient applies the http.* settings for url, and the environment
+// variables that override them.
+func newHTTPClient(url string, config *Config) (*httpClient, error) {
+	setting := func(key, env string) string {
+		if value := os.Getenv(env); value != "" {
+			return value
+		}
+		values := httpConfigValues(config, url, key)
+		if len(values) == 0 {
+			return ""
+		}
+		return values[len(values)-1]
+	}
+
+	tlsConfig := &tls.Config{}
+	if caInfo := setting("sslCAInfo", "GIT_SSL_CAINFO"); caInfo != "" {
+		pem, err := os.ReadFile(caInfo)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read http.sslCAInfo: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caInfo)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	switch strings.ToLower(setting("sslVerify", "")) {
+	case "false", "no", "off", "0":
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if os.Getenv("GIT_SSL_NO_VERIFY") != "" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	// http.proxy takes precedence over HTTPS_PROXY and friends
+	proxy := http.ProxyFromEnvironment
+	if value := setting("proxy", ""); value != "" {
+		if !strings.Contains(value, "://") {
+			value = "http://" + value
+		}
+		proxyURL, err := neturl.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http.proxy: %s", value)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	client := &httpClient{
+		url: url,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           (&net.Dialer{Timeout: httpConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   httpConnectTimeout,
+			ResponseHeaderTimeout: httpResponseHeaderTimeout,
+			ForceAttemptHTTP2:     true,
+		}},
+		userAgent:     setting("userAgent", "GIT_HTTP_USER_AGENT"),
+		lowSpeedLimit: defaultLowSpeedLimit,
+		lowSpeedTime:  defaultLowSpeedTime,
+	}
+	if client.userAgent == "" {
+		client.userAgent = defaultUserAgent
+	}
+
+	for _, header := range httpConfigValues(config, url, "extraHeader") {
+		// An empty value clears the headers configured before it
+		if header == "" {
+			client.extraHeaders = nil
+		} else {
+			client.extraHeaders = append(client.extraHeaders, header)
+		}
+	}
+
+	if limit := setting("lowSpeedLimit", "GIT_HTTP_LOW_SPEED_LIMIT"); limit != "" {
+		value, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http.lowSpeedLimit: %s", limit)
+		}
+		client.lowSpeedLimit = value
+	}
+	if seconds := setting("lowSpeedTime", "GIT_HTTP_LOW_SPEED_TIME"); seconds != "" {
+		value, err := strconv.Atoi(seconds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http.lowSpeedTime: %s", seconds)
+		}
+		client.lowSpeedTime = time.Duration(value) * time.Second
+	}
+	return client, nil
+}
+
+// httpConfigValues returns the values of http.<key> followed by those set
+// in http.<url>.<key> sections whose URL is a prefix of url, so the most
+// specific setting comes last.
+func httpConfigValues(config *Config, url, key string) []string {
+	values := config.GetAll("http." + key)
+	var matches []string
+	for _, subsection := range config.Subsections("http") {
+		prefix := strings.TrimSuffix(subsection, "/")
+		if url == prefix || strings.HasPrefix(url, prefix+"/") {
+			matches = append(matches, subsection)
+		}
+	}
+	// Longer prefixes are more specific, so their values come last
+	sort.SliceStable(matches, func(i, j int) bool { return len(matches[i]) < len(matches[j]) })
+	for _, subsection := range matches {
+		values = append(values, config.GetAll(fmt.Sprintf("http.%s.%s", subsection, key))...)
+	}
+	return values
+}
+
+// httpStatusError is a response with a status other than 200 OK.
+type httpStatusError struct {
+	url    string
+	status int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unable to access '%s': The requested URL returned error: %d", e.url, e.status)
+}
+
+// do sends a request and returns the response if the server answered 200
+// OK. On 401 Unauthorized the request is sent once more with credentials,
+// which the credential helpers are then told to store or erase.
+func (c *httpClient) do(method, url string, body io.Reader, header http.Header) (*http.Response, error) {
+	response, err := c.send(method, url, body, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusUnauthorized && c.authorization == "" {
+		challenges := response.Header.Values("WWW-Authenticate")
+		response.Body.Close()
+		// Only a body held in memory can be sent again
+		seeker, replayable := body.(io.Seeker)
+		if body != nil && !replayable {
+			return nil, fmt.Errorf("Authentication failed for '%s'", c.url)
+		}
+		if err := c.credential.fill(); err != nil {
+			return nil, err
+		}
+		c.authorization = c.credential.authorization(challenges)
+		if replayable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err = c.send(method, url, body, header)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode == http.StatusOK {
+			c.credential.approve()
+		}
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response, nil
+	case http.StatusUnauthorized:
+		response.Body.Close()
+		c.credential.reject()
+		return nil, fmt.Errorf("Authentication failed for '%s'", c.url)
+	default:
+		response.Body.Close()
+		return nil, &httpStatusError{url: c.url, status: response.StatusCode}
+	}
+}
+
+func (c *httpClient) send(method, url string, body io.Reader, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var monitor *speedMonitor
+	if c.lowSpeedLimit > 0 && c.lowSpeedTime > 0 {
+		monitor = newSpeedMonitor(c.lowSpeedLimit, c.lowSpeedTime, cancel)
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = monitor.countReads(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Bodies held in memory are sent with their length, streamed ones in
+	// chunks
+	if sized, ok := body.(interface{ Len() int }); ok {
+		request.ContentLength = int64(sized.Len())
+	}
+	request.Header.Set("User-Agent", c.userAgent)
+	for _, extraHeader := range c.extraHeaders {
+		key, value, _ := strings.Cut(extraHeader, ":")
+		request.Header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if c.authorization != "" {
+		request.Header.Set("Authorization", c.authorization)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		monitor.stop()
+		cancel()
+		if monitor.tooSlow() {
+			return nil, monitor.err()
+		}
+		return nil, err
+	}
+	response.Body = &monitoredBody{ReadCloser: response.Body, monitor: monitor, cancel: cancel}
+	return response, nil
+}
+
+// speedMonitor aborts a transfer that moves fewer than limit bytes per
+// second over a whole period, the way curl applies http.lowSpeedLimit and
+// http.lowSpeedTime. Both the request body and the response count. A nil
+// monitor watches nothing.
+type speedMonitor struct {
+	limit       int64
+	period      time.Duration
+	transferred atomic.Int64
+	aborted     atomic.Bool
+	done        chan struct{}
+}
+
+func newSpeedMonitor(limit int64, period time.Duration, abort context.CancelFunc) *speedMonitor {
+	m := &speedMonitor{limit: limit, period: period, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		var last int64
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+				current := m.transferred.Load()
+				if current-last < limit*int64(period/time.Second) {
+					m.aborted.Store(true)
+					abort()
+					return
+				}
+				last = current
+			}
+		}
+	}()
+	return m
+}
+
+func (m *speedMonitor) countReads(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &countingReader{r: r, monitor: m}
+}
+
+func (m *speedMonitor) stop() {
+	if m != nil {
+		select {
+		case <-m.done:
+		default:
+			close(m.done)
+		}
+	}
+}
+
+func (m *speedMonitor) tooSlow() bool {
+	return m != nil && m.aborted.Load()
+}
+
+func (m *speedMonitor) err() error {
+	return fmt.Errorf("Operation too slow. Less than %d bytes/sec transferred the last %d seconds", m.limit, int(m.period/time.Second))
+}
+
+type countingReader struct {
+	r       io.Reader
+	monitor *speedMonitor
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.monitor.transferred.Add(int64(n))
+	return n, err
+}
+
+// monitoredBody counts the response towards the transfer speed and ends
+// the request when it is closed.
+type monitoredBody struct {
+	io.ReadCloser
+	monitor *speedMonitor
+	cancel  context.CancelFunc
+}
+
+func (b *monitoredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.monitor != nil {
+		b.monitor.transferred.Add(int64(n))
+		if err != nil && b.monitor.tooSlow() {
+			err = b.monitor.err()
+		}
+	}
+	return n, err
+}
+
+func (b *monitoredBody) Close() error {
+	b.monitor.stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallingServer answers with the head of a ref advertisement, if
+// sendHeaders, and then goes quiet until the client gives up.
+func stallingServer(t *testing.T, sendHeaders bool) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sendHeaders {
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			io.WriteString(w, encodePktLine("# service=git-upload-pack\n"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// shortenHTTPTimeouts makes the default timeouts short enough to test.
+func shortenHTTPTimeouts(t *testing.T) {
+	headerTimeout, limit, period := httpResponseHeaderTimeout, defaultLowSpeedLimit, defaultLowSpeedTime
+	httpResponseHeaderTimeout, defaultLowSpeedLimit, defaultLowSpeedTime = 200*time.Millisecond, 1, time.Second
+	t.Cleanup(func() {
+		httpResponseHeaderTimeout, defaultLowSpeedLimit, defaultLowSpeedTime = headerTimeout, limit, period
+	})
+}
+
+func TestHTTPGivesUpOnSilentServer(t *testing.T) {
+	isolateTest(t)
+	shortenHTTPTimeouts(t)
+	// Only the response header timeout should catch this one
+	defaultLowSpeedLimit = 0
+
+	transport, err := newHTTPTransport(stallingServer(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = transport.discoverRefs(UploadPackService, nil)
+	if err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Fatalf("discoverRefs = %v, want a response header timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("discoverRefs took %s to give up", elapsed)
+	}
+}
+
+func TestHTTPGivesUpOnStalledTransfer(t *testing.T) {
+	isolateTest(t)
+	shortenHTTPTimeouts(t)
+
+	transport, err := newHTTPTransport(stallingServer(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = transport.discoverRefs(UploadPackService, nil)
+	if err == nil || !strings.Contains(err.Error(), "Operation too slow") {
+		t.Fatalf("discoverRefs = %v, want the transfer refused as too slow", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("discoverRefs took %s to give up", elapsed)
+	}
+
+	// Configured limits take the place of the defaults
+	t.Setenv("GIT_HTTP_LOW_SPEED_LIMIT", "1000")
+	t.Setenv("GIT_HTTP_LOW_SPEED_TIME", "1")
+	transport, err = newHTTPTransport(stallingServer(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = transport.discoverRefs(UploadPackService, nil)
+	if err == nil || !strings.Contains(err.Error(), "Less than 1000 bytes/sec transferred the last 1 seconds") {
+		t.Fatalf("discoverRefs = %v, want the configured limits in the error", err)
+	}
+}
@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IndexPackOptions controls how IndexPack reads a pack and where the index
+// goes.
+type IndexPackOptions struct {
+	// Stdin reads the pack from r and stores it, in the repository unless
+	// a pack path is given
+	Stdin bool
+	// FixThin completes a thin pack with the delta bases it refers to from
+	// the repository
+	FixThin bool
+	// Output is where the index is written instead of beside the pack
+	Output string
+}
+
+// IndexPack computes the name of every object in a pack, resolving its
+// deltas, and writes the pack's index. It prints the pack's checksum.
+func IndexPack(packPath string, r io.Reader, options IndexPackOptions) error {
+	if options.FixThin && !options.Stdin {
+		return fmt.Errorf("the option '--fix-thin' requires '--stdin'")
+	}
+	if packPath != "" && !strings.HasSuffix(packPath, ".pack") && (options.Output == "" || options.Stdin) {
+		return fmt.Errorf("packfile name '%s' does not end with '.pack'", packPath)
+	}
+	if options.Stdin {
+		return indexPackFromStdin(packPath, r, options)
+	}
+
+	file, err := os.Open(packPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	objects, _, checksum, err := readPackEntries(newPackStream(file, io.Discard), true)
+	if err != nil {
+		return err
+	}
+	externalBases, err := applyDeltas(file, objects)
+	if err != nil {
+		return err
+	}
+	if len(externalBases) > 0 {
+		return fmt.Errorf("pack has %d unresolved deltas", len(externalBases))
+	}
+
+	indexPath := options.Output
+	if indexPath == "" {
+		indexPath = strings.TrimSuffix(packPath, ".pack") + ".idx"
+	}
+	if err := writePackIndex(indexPath, objects, checksum); err != nil {
+		return err
+	}
+	fmt.Printf("%x\n", checksum)
+	return nil
+}
+
+// indexPackFromStdin spools the pack on r like a fetched one, then stores it
+// with its index at packPath, or in the repository's object store.
+func indexPackFromStdin(packPath string, r io.Reader, options IndexPackOptions) error {
+	if !isGitDir(GitDir) {
+		return fmt.Errorf("--stdin requires a git repository")
+	}
+
+	pack, err := spoolPack(PackDir, r, true)
+	if err != nil {
+		return err
+	}
+	defer pack.discard()
+
+	externalBases, err := applyDeltas(pack.file, pack.objects)
+	if err != nil {
+		return err
+	}
+	if len(externalBases) > 0 {
+		if !options.FixThin {
+			return fmt.Errorf("pack has %d unresolved deltas", len(externalBases))
+		}
+		if err := pack.completeThin(externalBases); err != nil {
+			return err
+		}
+	}
+
+	if packPath == "" {
+		if _, err := pack.store(); err != nil {
+			return err
+		}
+		fmt.Printf("pack\t%x\n", pack.checksum)
+		return nil
+	}
+	if err := pack.storeAs(packPath); err != nil {
+		return err
+	}
+	if options.Output != "" {
+		defaultIndex := strings.TrimSuffix(packPath, ".pack") + ".idx"
+		if err := os.Rename(defaultIndex, options.Output); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%x\n", pack.checksum)
+	return nil
+}
+
+// VerifyPack checks a pack against its index: both checksums, and the name,
+// offset and CRC the index records for every object. Verbose lists the
+// objects and a histogram of delta chain lengths.
+func VerifyPack(path string, verbose bool) error {
+	indexPath := strings.TrimSuffix(path, ".pack")
+	indexPath = strings.TrimSuffix(indexPath, ".idx") + ".idx"
+	packPath := strings.TrimSuffix(indexPath, ".idx") + ".pack"
+
+	index, err := readPackIndex(indexPath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(packPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	objects, size, checksum, err := readPackEntries(newPackStream(file, io.Discard), true)
+	if err != nil {
+		return fmt.Errorf("%s: %s", packPath, err)
+	}
+	if !bytes.Equal(checksum, index.packChecksum) {
+		return fmt.Errorf("packfile %s does not match index", packPath)
+	}
+	externalBases, err := applyDeltas(file, objects)
+	if err != nil {
+		return fmt.Errorf("%s: %s", packPath, err)
+	}
+	if len(externalBases) > 0 {
+		return fmt.Errorf("%s: pack has %d unresolved deltas", packPath, len(externalBases))
+	}
+
+	failed := checkPackIndexEntries(index, objects)
+
+	if verbose {
+		listPackObjects(objects, size)
+	}
+	if failed {
+		return fmt.Errorf("%s: bad", packPath)
+	}
+	if verbose {
+		fmt.Printf("%s: ok\n", packPath)
+	}
+	return nil
+}
+
+// checkPackIndexEntries compares what the index records for each object
+// with the pack, reporting every mismatch.
+func checkPackIndexEntries(index *packIndex, objects []*packObject) bool {
+	failed := false
+	if index.count() != len(objects) {
+		fmt.Fprintf(os.Stderr, "error: index lists %d objects but the pack has %d\n", index.count(), len(objects))
+		failed = true
+	}
+
+	positions := make(map[string]int, index.count())
+	for i := 0; i < index.count(); i++ {
+		positions[hex.EncodeToString(index.hashAt(i))] = i
+	}
+	for _, object := range objects {
+		i, ok := positions[object.hash]
+		switch {
+		case !ok:
+			fmt.Fprintf(os.Stderr, "error: object %s at offset %d is missing from the index\n", object.hash, object.offset)
+		case index.offsetAt(i) != object.offset:
+			fmt.Fprintf(os.Stderr, "error: index puts %s at offset %d, not %d\n", object.hash, index.offsetAt(i), object.offset)
+		case index.crcAt(i) != object.crc:
+			fmt.Fprintf(os.Stderr, "error: CRC of %s at offset %d does not match the index\n", object.hash, object.offset)
+		default:
+			continue
+		}
+		failed = true
+	}
+	return failed
+}
+
+// listPackObjects prints each object as verify-pack -v does: its name,
+// type, size, size in the pack and offset, followed for deltas by the
+// chain depth and base. A histogram of chain lengths follows.
+func listPackObjects(objects []*packObject, packSize int64) {
+	byOffset := make(map[int64]*packObject, len(objects))
+	byHash := make(map[string]*packObject, len(objects))
+	for _, object := range objects {
+		byOffset[object.offset] = object
+		byHash[object.hash] = object
+	}
+	deltaBase := func(object *packObject) *packObject {
+		switch object.objType {
+		case ObjOfsDelta:
+			return byOffset[object.baseOffset]
+		case ObjRefDelta:
+			return byHash[object.baseHash]
+		}
+		return nil
+	}
+
+	sorted := make([]*packObject, len(objects))
+	copy(sorted, objects)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].offset < sorted[j].offset })
+
+	chains := make(map[int]int)
+	for i, object := range sorted {
+		end := packSize
+		if i+1 < len(sorted) {
+			end = sorted[i+1].offset
+		}
+
+		depth := 0
+		resolved := object
+		for base := deltaBase(resolved); base != nil; base = deltaBase(resolved) {
+			resolved = base
+			depth++
+		}
+		objType, _ := getObjectTypeString(resolved.objType)
+		chains[depth]++
+
+		fmt.Printf("%s %-6s %d %d %d", object.hash, objType, object.size, end-object.offset, object.offset)
+		if base := deltaBase(object); base != nil {
+			fmt.Printf(" %d %s", depth, base.hash)
+		}
+		fmt.Println()
+	}
+
+	plural := func(count int) string {
+		if count == 1 {
+			return "object"
+		}
+		return "objects"
+	}
+	if count := chains[0]; count > 0 {
+		fmt.Printf("non delta: %d %s\n", count, plural(count))
+	}
+	lengths := make([]int, 0, len(chains))
+	for length := range chains {
+		if length > 0 {
+			lengths = append(lengths, length)
+		}
+	}
+	sort.Ints(lengths)
+	for _, length := range lengths {
+		fmt.Printf("chain length = %d: %d %s\n", length, chains[length], plural(chains[length]))
+	}
+}
@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestPack packs the history of a new repository into dir with
+// PackObjects, returning the paths of the pack and its index.
+func writeTestPack(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	initTestRepository(t, filepath.Join(t.TempDir(), "repo.git"))
+	tip := newTestHistory(t, 5)
+
+	var out bytes.Buffer
+	options := PackObjectsOptions{BaseName: filepath.Join(dir, "test"), Revs: true, Window: 10, Depth: 50, OfsDelta: true}
+	if err := PackObjects(strings.NewReader(tip+"\n"), &out, options); err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "test-"+strings.TrimSpace(out.String()))
+	return base + ".pack", base + ".idx"
+}
+
+func TestIndexPackRoundTrip(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+	packPath, indexPath := writeTestPack(t, dir)
+	written, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPack(packPath, false); err != nil {
+		t.Fatalf("VerifyPack of the written pack: %s", err)
+	}
+
+	// Indexing the pack again gives the index PackObjects wrote
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexPack(packPath, nil, IndexPackOptions{}); err != nil {
+		t.Fatalf("IndexPack: %s", err)
+	}
+	indexed, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(indexed, written) {
+		t.Fatal("IndexPack wrote a different index than PackObjects")
+	}
+	if err := VerifyPack(indexPath, true); err != nil {
+		t.Fatalf("VerifyPack of the indexed pack: %s", err)
+	}
+
+	output := filepath.Join(dir, "elsewhere.idx")
+	if err := IndexPack(packPath, nil, IndexPackOptions{Output: output}); err != nil {
+		t.Fatalf("IndexPack to %s: %s", output, err)
+	}
+	if data, err := os.ReadFile(output); err != nil || !bytes.Equal(data, written) {
+		t.Fatalf("index written to %s differs: %v", output, err)
+	}
+}
+
+func TestVerifyPackFindsDamage(t *testing.T) {
+	isolateTest(t)
+	packPath, indexPath := writeTestPack(t, t.TempDir())
+	pack, err := os.ReadFile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damage := func(path string, data []byte, offset int) {
+		t.Helper()
+		damaged := append([]byte{}, data...)
+		damaged[offset] ^= 0xff
+		if path == indexPath {
+			// Keep the index's own checksum right, so that only the damage shows
+			checksum := sha1.Sum(damaged[:len(damaged)-20])
+			copy(damaged[len(damaged)-20:], checksum[:])
+		}
+		if err := os.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restore := func(path string, data []byte) {
+		t.Helper()
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The CRCs follow the fan-out table and the names
+	count := int(binary.BigEndian.Uint32(index[8+255*4:]))
+	damage(indexPath, index, 8+256*4+count*20)
+	if err := VerifyPack(packPath, false); err == nil || !strings.HasSuffix(err.Error(), ": bad") {
+		t.Fatalf("VerifyPack with a damaged CRC = %v", err)
+	}
+	restore(indexPath, index)
+
+	// The index ends with the pack's checksum and then its own
+	damage(indexPath, index, len(index)-40)
+	if err := VerifyPack(packPath, false); err == nil || !strings.Contains(err.Error(), "does not match index") {
+		t.Fatalf("VerifyPack with an index of another pack = %v", err)
+	}
+	restore(indexPath, index)
+
+	damage(packPath, pack, len(pack)/2)
+	if err := VerifyPack(packPath, false); err == nil {
+		t.Fatal("VerifyPack accepted a damaged pack")
+	}
+}
+
+func TestIndexPackFixThin(t *testing.T) {
+	isolateTest(t)
+	initTestRepository(t, filepath.Join(t.TempDir(), "repo.git"))
+	base := []byte(strings.Repeat("a line shared by both blobs\n", 20) + "base\n")
+	target := []byte(strings.Repeat("a line shared by both blobs\n", 20) + "target\n")
+	baseHash, err := WriteObject(CreateBlob(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := []byte("in the pack in full\n")
+	otherEntry, err := encodePackEntry(other, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := createDelta(newDeltaIndex(base), target, len(target))
+	if delta == nil {
+		t.Fatal("createDelta found no delta")
+	}
+	thin := testPack(t, otherEntry, refDeltaEntry(t, hex.EncodeToString(baseHash), delta))
+
+	if err := IndexPack("", bytes.NewReader(thin), IndexPackOptions{FixThin: true}); err == nil {
+		t.Fatal("IndexPack accepted --fix-thin without --stdin")
+	}
+	err = IndexPack("", bytes.NewReader(thin), IndexPackOptions{Stdin: true})
+	if err == nil || !strings.Contains(err.Error(), "1 unresolved deltas") {
+		t.Fatalf("IndexPack of a thin pack without FixThin = %v", err)
+	}
+
+	if err := IndexPack("", bytes.NewReader(thin), IndexPackOptions{Stdin: true, FixThin: true}); err != nil {
+		t.Fatalf("IndexPack with FixThin: %s", err)
+	}
+	packs, err := filepath.Glob(filepath.Join(PackDir, "pack-*.pack"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("stored packs %q, %v, want one", packs, err)
+	}
+	// The base is appended, so the pack stands on its own
+	if err := VerifyPack(packs[0], false); err != nil {
+		t.Fatalf("VerifyPack of the completed pack: %s", err)
+	}
+	index, err := readPackIndex(strings.TrimSuffix(packs[0], ".pack") + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.count() != 3 {
+		t.Fatalf("completed pack has %d objects, want 3", index.count())
+	}
+
+	if err := os.RemoveAll(filepath.Join(ObjectsDir, hex.EncodeToString(baseHash)[:2])); err != nil {
+		t.Fatal(err)
+	}
+	resetStoredPacks()
+	for _, want := range [][]byte{base, target, other} {
+		data, _, _, err := ReadObjectFile(hex.EncodeToString(HashBytes(CreateBlob(want))))
+		if err != nil || !bytes.Equal(data, want) {
+			t.Errorf("reading %q back from the pack: %q, %v", want[len(want)-7:], data, err)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localTransport reaches a repository named by a plain path by reading it
+// directly. Fetching copies its objects wholesale, hard-linking them the
+// way git clone --local does.
+type localTransport struct {
+	gitDir string
+}
+
+func newLocalTransport(url string) (*localTransport, error) {
+	gitDir, err := localGitDir(url)
+	if err != nil {
+		return nil, err
+	}
+	return &localTransport{gitDir: gitDir}, nil
+}
+
+// localGitDir returns the repository directory a file:// URL or a plain
+// path names.
+func localGitDir(url string) (string, error) {
+	path, err := filepath.Abs(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		return "", err
+	}
+	return findGitDir(path)
+}
+
+// findGitDir returns the repository directory of the working tree or bare
+// repository at path.
+func findGitDir(path string) (string, error) {
+	if isGitDir(filepath.Join(path, DefaultGitDir)) {
+		return filepath.Join(path, DefaultGitDir), nil
+	}
+	if isGitDir(path) {
+		return path, nil
+	}
+	return "", fmt.Errorf("'%s' does not appear to be a git repository", path)
+}
+
+func isGitDir(path string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// withGitDir runs fn against the repository at gitDir.
+func withGitDir(gitDir string, fn func() error) error {
+	saved := GitDir
+	SetGitDir(gitDir)
+	defer SetGitDir(saved)
+	return fn()
+}
+
+// discoverRefs lists the repository's refs as a server would advertise
+// them. Everything is listed, as in protocol v0.
+func (t *localTransport) discoverRefs(service string, refPrefixes []string) (*refAdvertisement, error) {
+	var advertisement *refAdvertisement
+	err := withGitDir(t.gitDir, func() error {
+		var err error
+		advertisement, err = advertiseLocalRefs()
+		return err
+	})
+	return advertisement, err
+}
+
+// fetchPack copies every pack and loose object we lack from the repository
+// and adopts its shallow boundaries. Depth and filter requests do not apply.
+func (t *localTransport) fetchPack(advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (string, *shallowInfo, error) {
+	objectsDir := filepath.Join(t.gitDir, "objects")
+
+	packs, err := filepath.Glob(filepath.Join(objectsDir, "pack", "pack-*.pack"))
+	if err != nil {
+		return "", nil, err
+	}
+	for _, pack := range packs {
+		// The index goes last since it is what makes a pack visible
+		base := strings.TrimSuffix(pack, ".pack")
+		for _, ext := range []string{".pack", ".promisor", ".idx"} {
+			err := t.copyObjectFile(base+ext, filepath.Join(PackDir, filepath.Base(base)+ext))
+			if err != nil && !os.IsNotExist(err) {
+				return "", nil, err
+			}
+		}
+	}
+
+	looseObjects, err := filepath.Glob(filepath.Join(objectsDir, "[0-9a-f][0-9a-f]", "*"))
+	if err != nil {
+		return "", nil, err
+	}
+	for _, object := range looseObjects {
+		dir, name := filepath.Split(object)
+		err := t.copyObjectFile(object, filepath.Join(ObjectsDir, filepath.Base(dir), name))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	resetStoredPacks()
+
+	for _, want := range fetch.wants {
+		if !ObjectExists(want) {
+			return "", nil, fmt.Errorf("remote did not send all necessary objects")
+		}
+	}
+
+	// Having every object the source has, our history is exactly as
+	// shallow as its own
+	var remoteShallow map[string]bool
+	err = withGitDir(t.gitDir, func() error {
+		remoteShallow, err = readShallowCommits()
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	localShallow, err := readShallowCommits()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var shallow shallowInfo
+	for hash := range remoteShallow {
+		if !localShallow[hash] {
+			shallow.shallow = append(shallow.shallow, hash)
+		}
+	}
+	for hash := range localShallow {
+		if !remoteShallow[hash] {
+			shallow.unshallow = append(shallow.unshallow, hash)
+		}
+	}
+	sort.Strings(shallow.shallow)
+	sort.Strings(shallow.unshallow)
+	return "", &shallow, nil
+}
+
+// copyObjectFile links or copies an object store file unless we already
+// have it.
+func (t *localTransport) copyObjectFile(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func (t *localTransport) sendPack(advertisement *refAdvertisement, updates []*pushUpdate) error {
+	return fmt.Errorf("pushing to a local repository is not supported")
+}
+
+func (t *localTransport) close() error {
+	return nil
+}
+
+// fileTransport reaches a repository named by a file:// URL through
+// upload-pack, run in this process, so that fetches are negotiated and
+// honour depth and filter requests as they would over the network.
+type fileTransport struct {
+	gitDir string
+}
+
+func newFileTransport(url string) (*fileTransport, error) {
+	gitDir, err := localGitDir(url)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTransport{gitDir: gitDir}, nil
+}
+
+// discoverRefs reads the protocol v2 advertisement of upload-pack and
+// lists the refs under refPrefixes.
+func (t *fileTransport) discoverRefs(service string, refPrefixes []string) (*refAdvertisement, error) {
+	if service != UploadPackService {
+		return (&localTransport{gitDir: t.gitDir}).discoverRefs(service, refPrefixes)
+	}
+
+	var response bytes.Buffer
+	options := UploadPackOptions{StatelessRPC: true, AdvertiseRefs: true, Protocol: "version=2"}
+	if err := UploadPack(t.gitDir, bytes.NewReader(nil), &response, options); err != nil {
+		return nil, err
+	}
+
+	lines, err := readRefAdvertisement(newPktLineReader(&response))
+	if err != nil {
+		return nil, err
+	}
+	advertisement := parseV2CapabilityAdvertisement(lines)
+	return advertisement, advertisement.listRefs(t.conn(), refPrefixes)
+}
+
+func (t *fileTransport) fetchPack(advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (string, *shallowInfo, error) {
+	return storeNegotiatedPack(t.conn(), advertisement, fetch, walker)
+}
+
+func (t *fileTransport) sendPack(advertisement *refAdvertisement, updates []*pushUpdate) error {
+	return fmt.Errorf("pushing to a local repository is not supported")
+}
+
+func (t *fileTransport) close() error {
+	return nil
+}
+
+func (t *fileTransport) conn() *fileConn {
+	return &fileConn{gitDir: t.gitDir}
+}
+
+// fileConn serves each request with a stateless upload-pack, as smart HTTP
+// does. The response is spooled to a temporary file, since upload-pack
+// works on the repository while it runs and so cannot share the process
+// with the reader of its output.
+type fileConn struct {
+	gitDir string
+}
+
+func (c *fileConn) roundTrip(request io.Reader) (io.ReadCloser, error) {
+	response, err := os.CreateTemp("", "mygit-upload-pack-")
+	if err != nil {
+		return nil, err
+	}
+	spool := &spooledResponse{response}
+
+	// Whoever can read the repository can have any object in it, as the
+	// lazy fetches of a partial clone may ask for
+	options := UploadPackOptions{StatelessRPC: true, Protocol: "version=2", AllowAnySHA1InWant: true}
+	if err := UploadPack(c.gitDir, request, response, options); err != nil {
+		spool.Close()
+		return nil, err
+	}
+	if _, err := response.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+func (c *fileConn) stateless() bool {
+	return true
+}
+
+// spooledResponse is a response read back from a temporary file, which is
+// removed once it is closed.
+type spooledResponse struct {
+	*os.File
+}
+
+func (r *spooledResponse) Close() error {
+	err := r.File.Close()
+	os.Remove(r.File.Name())
+	return err
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// LsRemoteOptions selects the refs LsRemote lists.
+type LsRemoteOptions struct {
+	// Heads and Tags limit the listing to branches and tags
+	Heads bool
+	Tags  bool
+	// Symref also shows what symbolic refs such as HEAD point to
+	Symref bool
+	// Patterns keep only refs whose name ends in a matching component
+	// sequence, such as "main" for refs/heads/main
+	Patterns []string
+}
+
+// LsRemote prints the refs advertised by the remote named remote, or at the
+// URL it spells, as "<hash>\t<name>" lines.
+func LsRemote(remote string, options LsRemoteOptions) error {
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return err
+	}
+	url, ok := config.Get(fmt.Sprintf("remote.%s.url", remote))
+	if !ok {
+		url = remote
+	}
+
+	var refPrefixes []string
+	if options.Heads {
+		refPrefixes = append(refPrefixes, "refs/heads/")
+	}
+	if options.Tags {
+		refPrefixes = append(refPrefixes, "refs/tags/")
+	}
+
+	remoteTransport, err := openTransport(url)
+	if err != nil {
+		return err
+	}
+	defer remoteTransport.close()
+	advertisement, err := remoteTransport.discoverRefs(UploadPackService, refPrefixes)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range advertisement.refs {
+		if !refMatchesPrefixes(ref.Name, refPrefixes) || !refMatchesPatterns(ref.Name, options.Patterns) {
+			continue
+		}
+		if target, ok := advertisement.symrefs[ref.Name]; ok && options.Symref {
+			fmt.Printf("ref: %s\t%s\n", target, ref.Name)
+		}
+		fmt.Printf("%s\t%s\n", ref.Hash, ref.Name)
+	}
+	return nil
+}
+
+func refMatchesPrefixes(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// refMatchesPatterns reports whether a pattern matches the whole name or
+// the part of it after some '/'.
+func refMatchesPatterns(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		tail := name
+		for {
+			if matched, _ := path.Match(pattern, tail); matched {
+				return true
+			}
+			slash := strings.IndexByte(tail, '/')
+			if slash < 0 {
+				break
+			}
+			tail = tail[slash+1:]
+		}
+	}
+	return false
+}
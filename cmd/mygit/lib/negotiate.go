@@ -0,0 +1,358 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	initialHaveBatch = 16
+	maxHaveBatch     = 1024
+	maxInVainHaves   = 256
+)
+
+var fetchCapabilities = []string{"multi_ack_detailed", "thin-pack", "ofs-delta", "include-tag"}
+
+type walkEntry struct {
+	hash    string
+	time    int64
+	parents []string
+	common  bool
+	queued  bool
+}
+
+// haveWalker yields local commits newest first so the server can find the
+// most recent common ancestors quickly.
+type haveWalker struct {
+	queue    []*walkEntry
+	entries  map[string]*walkEntry
+	uncommon int
+}
+
+func newHaveWalker(tips []string) *haveWalker {
+	w := &haveWalker{entries: make(map[string]*walkEntry)}
+	for _, tip := range tips {
+		if commit, err := peelToCommit(tip); err == nil {
+			w.push(commit, false)
+		}
+	}
+	return w
+}
+
+func localHaveTips() ([]string, error) {
+	refs, err := ListRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+
+	var tips []string
+	for _, ref := range refs {
+		tips = append(tips, ref.Hash)
+	}
+	if head, err := ResolveRef("HEAD"); err == nil && head != "" {
+		tips = append(tips, head)
+	}
+	return tips, nil
+}
+
+func (w *haveWalker) push(hash string, common bool) {
+	if entry, ok := w.entries[hash]; ok {
+		if common {
+			w.markEntryCommon(entry)
+		}
+		return
+	}
+
+	commit, err := ReadCommit(hash)
+	if err != nil {
+		return
+	}
+
+	entry := &walkEntry{hash: hash, time: commit.CommitTime(), parents: commit.Parents, common: common, queued: true}
+	w.entries[hash] = entry
+	if !common {
+		w.uncommon++
+	}
+
+	i := sort.Search(len(w.queue), func(i int) bool {
+		return w.queue[i].time < entry.time
+	})
+	w.queue = append(w.queue, nil)
+	copy(w.queue[i+1:], w.queue[i:])
+	w.queue[i] = entry
+}
+
+func (w *haveWalker) next() (string, bool) {
+	for len(w.queue) > 0 && w.uncommon > 0 {
+		entry := w.queue[0]
+		w.queue = w.queue[1:]
+		entry.queued = false
+		if !entry.common {
+			w.uncommon--
+		}
+
+		for _, parent := range entry.parents {
+			w.push(parent, entry.common)
+		}
+		if !entry.common {
+			return entry.hash, true
+		}
+	}
+	return "", false
+}
+
+func (w *haveWalker) markCommon(hash string) {
+	if entry, ok := w.entries[hash]; ok {
+		w.markEntryCommon(entry)
+	}
+}
+
+func (w *haveWalker) markEntryCommon(entry *walkEntry) {
+	stack := []*walkEntry{entry}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if e.common {
+			continue
+		}
+
+		e.common = true
+		if e.queued {
+			w.uncommon--
+		}
+		for _, parent := range e.parents {
+			if p, ok := w.entries[parent]; ok {
+				stack = append(stack, p)
+			}
+		}
+	}
+}
+
+func (a *refAdvertisement) requestCapabilities(wanted []string) []string {
+	var capabilities []string
+	for _, capability := range wanted {
+		if a.hasCapability(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities
+}
+
+func buildUploadPackRequest(wants []string, capabilities []string, arguments []string, haves []string, done bool) []byte {
+	var request bytes.Buffer
+	for i, objName := range wants {
+		want := fmt.Sprintf("want %s", objName)
+		if i == 0 && len(capabilities) > 0 {
+			want += " " + strings.Join(capabilities, " ")
+		}
+		request.WriteString(encodePktLine(want + "\n"))
+	}
+	for _, argument := range arguments {
+		request.WriteString(encodePktLine(argument + "\n"))
+	}
+	request.WriteString(flushPkt)
+	request.Write(buildHavesRequest(haves, done))
+	return request.Bytes()
+}
+
+// buildHavesRequest encodes a batch of haves, ending the round with a flush
+// or with done once negotiation is over.
+func buildHavesRequest(haves []string, done bool) []byte {
+	var request bytes.Buffer
+	for _, have := range haves {
+		request.WriteString(encodePktLine(fmt.Sprintf("have %s\n", have)))
+	}
+	if done {
+		request.WriteString(encodePktLine("done\n"))
+	} else {
+		request.WriteString(flushPkt)
+	}
+	return request.Bytes()
+}
+
+type acknowledgement struct {
+	hash   string
+	status string
+}
+
+// readFetchV0Response reads the shallow lines a deepen request is answered
+// with, followed by the acknowledgements of the round.
+func readFetchV0Response(reader *pktLineReader, deepen bool) (*fetchResponse, error) {
+	response := &fetchResponse{}
+	var err error
+	if deepen {
+		response.shallow, err = readShallowInfo(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	response.acks, err = readAcknowledgements(reader)
+	return response, err
+}
+
+// readAcknowledgements consumes the ACK/NAK lines ending a negotiation round.
+func readAcknowledgements(reader *pktLineReader) ([]acknowledgement, error) {
+	var acks []acknowledgement
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("reading acknowledgements: %s", err)
+		}
+		if line == nil {
+			continue
+		}
+
+		fields := strings.Fields(string(line))
+		switch {
+		case len(fields) == 1 && fields[0] == "NAK":
+			return acks, nil
+		case len(fields) == 2 && fields[0] == "ACK":
+			return append(acks, acknowledgement{hash: fields[1]}), nil
+		case len(fields) == 3 && fields[0] == "ACK":
+			acks = append(acks, acknowledgement{hash: fields[1], status: fields[2]})
+		case strings.HasPrefix(string(line), "ERR "):
+			return nil, fmt.Errorf("remote error: %s", line[4:])
+		default:
+			return nil, fmt.Errorf("unexpected negotiation line: %q", line)
+		}
+	}
+}
+
+// fetchRequest describes what a fetch asks the server for.
+type fetchRequest struct {
+	wants  []string
+	deepen deepenRequest
+	// filter is a partial clone filter spec such as "blob:none"
+	filter string
+}
+
+// arguments returns the request lines that follow the wants. Protocol v0
+// and v2 spell them the same way, except for deepen-relative.
+func (f fetchRequest) arguments(version int) ([]string, error) {
+	arguments, err := shallowArguments(f.deepen, version)
+	if err != nil {
+		return nil, err
+	}
+	if f.filter != "" {
+		arguments = append(arguments, "filter "+f.filter)
+	}
+	return arguments, nil
+}
+
+// negotiatePackfile runs the multi_ack_detailed negotiation and returns a
+// stream of the packfile the server sends once both sides agree, along with
+// the shallow boundary changes for a deepen request. A stateless service is
+// sent the wants and every common commit again with each batch of haves. The
+// caller must close the stream.
+func negotiatePackfile(conn serviceConn, advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (io.ReadCloser, *shallowInfo, error) {
+	capabilities := advertisement.requestCapabilities(fetchCapabilities)
+	sideband := advertisement.sidebandCapability()
+	if sideband != "" {
+		capabilities = append(capabilities, sideband)
+	}
+
+	if shallow, err := IsShallowRepository(); err != nil {
+		return nil, nil, err
+	} else if shallow || fetch.deepen.active() {
+		capabilities = append(capabilities, fetch.deepen.capabilities()...)
+	}
+	if fetch.filter != "" {
+		capabilities = append(capabilities, "filter")
+	}
+
+	arguments, err := fetch.arguments(advertisement.version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stateless := advertisement.version == 2 || conn.stateless()
+	var common []string
+	isCommon := make(map[string]bool)
+	batch := initialHaveBatch
+	inVain := 0
+	ready := false
+
+	for round := 0; ; round++ {
+		var haves []string
+		for !ready && len(haves) < batch {
+			hash, ok := walker.next()
+			if !ok {
+				break
+			}
+			haves = append(haves, hash)
+		}
+		done := ready || len(haves) < batch || inVain+len(haves) >= maxInVainHaves
+
+		var request []byte
+		switch {
+		case advertisement.version == 2:
+			request = buildFetchV2Request(fetch.wants, arguments, append(append([]string{}, common...), haves...), done)
+		case stateless:
+			request = buildUploadPackRequest(fetch.wants, capabilities, arguments, append(append([]string{}, common...), haves...), done)
+		case round == 0:
+			request = buildUploadPackRequest(fetch.wants, capabilities, arguments, haves, done)
+		default:
+			request = buildHavesRequest(haves, done)
+		}
+
+		response, err := conn.roundTrip(bytes.NewReader(request))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reader := newPktLineReader(response)
+		var result *fetchResponse
+		if advertisement.version == 2 {
+			result, err = readFetchV2Response(reader)
+			if err == nil && result.packfile == nil && done {
+				err = fmt.Errorf("server sent no packfile")
+			}
+		} else {
+			// Shallow lines answer the wants, which a stateful service only
+			// receives once
+			result, err = readFetchV0Response(reader, fetch.deepen.active() && (stateless || round == 0))
+			if err == nil && done {
+				result.packfile = response
+				if sideband != "" {
+					result.packfile = readSidebandPack(reader)
+				}
+			}
+		}
+		if err != nil {
+			response.Close()
+			return nil, nil, err
+		}
+		if result.packfile != nil {
+			return struct {
+				io.Reader
+				io.Closer
+			}{result.packfile, response}, result.shallow, nil
+		}
+		response.Close()
+
+		foundCommon := false
+		for _, ack := range result.acks {
+			if ack.status == "ready" {
+				ready = true
+			}
+			if ack.hash != "" && !isCommon[ack.hash] {
+				isCommon[ack.hash] = true
+				common = append(common, ack.hash)
+				walker.markCommon(ack.hash)
+				foundCommon = true
+			}
+		}
+
+		if foundCommon {
+			inVain = 0
+		} else {
+			inVain += len(haves)
+		}
+		if batch < maxHaveBatch {
+			batch *= 2
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package lib
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type packObject struct {
+	offset     int64
+	objType    int
+	size       uint64
+	baseHash   string
+	baseOffset int64
+	hash       string
+	crc        uint32
+}
+
+type storedPack struct {
+	path  string
+	index *packIndex
+	file  *os.File
+}
+
+var storedPacks []*storedPack
+var storedPacksLoaded bool
+
+// quarantineDir, while a push is checked, is the object directory holding
+// the objects it brought. They are found along with the repository's own
+// but only join them once the push is accepted.
+var quarantineDir string
+
+// encodePackEntry returns an undeltified pack entry: the type and size header
+// followed by the zlib-compressed object.
+func encodePackEntry(obj []byte, objType string) ([]byte, error) {
+	typeNumber := getObjectTypeNumber(objType)
+	if typeNumber == 0 {
+		return nil, fmt.Errorf("unknown object type: %s", objType)
+	}
+
+	compressed, err := compressBytes(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(encodeObjectHeader(typeNumber, uint64(len(obj))), compressed...), nil
+}
+
+func encodeObjectHeader(objType int, size uint64) []byte {
+	header := []byte{byte(objType<<4) | byte(size&0xF)}
+	size >>= 4
+	for size > 0 {
+		header[len(header)-1] |= 0x80
+		header = append(header, byte(size&0x7F))
+		size >>= 7
+	}
+	return header
+}
+
+func getObjectTypeNumber(objType string) int {
+	switch objType {
+	case "commit":
+		return ObjCommit
+	case "tree":
+		return ObjTree
+	case "blob":
+		return ObjBlob
+	case "tag":
+		return ObjTag
+	}
+	return 0
+}
+
+func loadStoredPacks() ([]*storedPack, error) {
+	if storedPacksLoaded {
+		return storedPacks, nil
+	}
+
+	indexPaths, err := filepath.Glob(filepath.Join(PackDir, "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	if quarantineDir != "" {
+		quarantined, err := filepath.Glob(filepath.Join(quarantineDir, "pack", "pack-*.idx"))
+		if err != nil {
+			return nil, err
+		}
+		indexPaths = append(indexPaths, quarantined...)
+	}
+
+	for _, indexPath := range indexPaths {
+		index, err := readPackIndex(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		storedPacks = append(storedPacks, &storedPack{
+			path:  strings.TrimSuffix(indexPath, ".idx") + ".pack",
+			index: index,
+		})
+	}
+
+	storedPacksLoaded = true
+	return storedPacks, nil
+}
+
+func resetStoredPacks() {
+	for _, pack := range storedPacks {
+		if pack.file != nil {
+			pack.file.Close()
+		}
+	}
+	storedPacks = nil
+	storedPacksLoaded = false
+}
+
+func findStoredPack(hashString string) (*storedPack, int64, error) {
+	hash, err := hex.DecodeString(hashString)
+	if err != nil || len(hash) != 20 {
+		return nil, 0, fmt.Errorf("invalid hash: %s", hashString)
+	}
+
+	packs, err := loadStoredPacks()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, pack := range packs {
+		if offset, ok := pack.index.find(hash); ok {
+			return pack, offset, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+func readPackedObject(hashString string) ([]byte, string, error) {
+	pack, offset, err := findStoredPack(hashString)
+	if err != nil {
+		return nil, "", err
+	}
+	if pack == nil {
+		return nil, "", fmt.Errorf("object %s not found", hashString)
+	}
+
+	if pack.file == nil {
+		pack.file, err = os.Open(pack.path)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return unpackObjectAt(pack.file, offset, readDeltaBase)
+}
+
+func readDeltaBase(hashString string) ([]byte, string, error) {
+	obj, objType, _, err := ReadObjectFile(hashString)
+	return obj, objType, err
+}
+
+// unpackObjectAt inflates the object stored at offset, resolving OFS_DELTA
+// bases within the pack and REF_DELTA bases through resolveRef.
+func unpackObjectAt(pack io.ReaderAt, offset int64, resolveRef func(string) ([]byte, string, error)) ([]byte, string, error) {
+	header := make([]byte, 32)
+	n, err := pack.ReadAt(header, offset)
+	if n == 0 && err != nil {
+		return nil, "", err
+	}
+	header = header[:n]
+
+	size, objType, bRead, err := readObjectHeader(header)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch objType {
+	case ObjCommit, ObjTree, ObjBlob, ObjTag:
+		objTypeString, _ := getObjectTypeString(objType)
+		obj, err := inflateAt(pack, offset+int64(bRead))
+		if err != nil {
+			return nil, "", err
+		}
+		if int(size) != len(obj) {
+			return nil, "", fmt.Errorf("invalid object header size at offset %d", offset)
+		}
+		return obj, objTypeString, nil
+	case ObjRefDelta:
+		if len(header) < bRead+20 {
+			return nil, "", fmt.Errorf("truncated delta header at offset %d", offset)
+		}
+		baseHash := hex.EncodeToString(header[bRead : bRead+20])
+		base, baseType, err := resolveRef(baseHash)
+		if err != nil {
+			return nil, "", err
+		}
+		delta, err := inflateAt(pack, offset+int64(bRead)+20)
+		if err != nil {
+			return nil, "", err
+		}
+		obj, err := applyDelta(base, delta)
+		if err != nil {
+			return nil, "", err
+		}
+		return obj, baseType, nil
+	case ObjOfsDelta:
+		negOffset, oRead, err := readOfsDeltaOffset(header[bRead:])
+		if err != nil {
+			return nil, "", err
+		}
+		if negOffset <= 0 || negOffset > offset {
+			return nil, "", fmt.Errorf("invalid delta base offset at offset %d", offset)
+		}
+		base, baseType, err := unpackObjectAt(pack, offset-negOffset, resolveRef)
+		if err != nil {
+			return nil, "", err
+		}
+		delta, err := inflateAt(pack, offset+int64(bRead+oRead))
+		if err != nil {
+			return nil, "", err
+		}
+		obj, err := applyDelta(base, delta)
+		if err != nil {
+			return nil, "", err
+		}
+		return obj, baseType, nil
+	}
+
+	return nil, "", fmt.Errorf("unknown object type %d at offset %d", objType, offset)
+}
+
+func inflateAt(pack io.ReaderAt, offset int64) ([]byte, error) {
+	section := io.NewSectionReader(pack, offset, math.MaxInt64-offset)
+	r, err := zlib.NewReader(bufio.NewReader(section))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// readOfsDeltaOffset decodes the negative base offset of an OFS_DELTA entry,
+// which unlike object sizes adds one before every shift.
+func readOfsDeltaOffset(data []byte) (int64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errors.New("bad delta base offset")
+	}
+	used := 0
+	c := data[used]
+	used++
+	offset := int64(c & 0x7F)
+	for c&0x80 != 0 {
+		if len(data) <= used || offset >= 1<<56 {
+			return 0, 0, errors.New("bad delta base offset")
+		}
+		c = data[used]
+		used++
+		offset = ((offset + 1) << 7) | int64(c&0x7F)
+	}
+	return offset, used, nil
+}
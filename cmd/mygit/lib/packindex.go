@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+var packIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+type packIndex struct {
+	fanout       [256]uint32
+	hashes       []byte
+	crcs         []byte
+	offsets      []byte
+	largeOffsets []byte
+	packChecksum []byte
+}
+
+func writePackIndex(path string, objects []*packObject, packChecksum []byte) error {
+	sorted := make([]*packObject, len(objects))
+	copy(sorted, objects)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].hash < sorted[j].hash
+	})
+
+	var buf bytes.Buffer
+	buf.Write(packIndexMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, obj := range sorted {
+		hash, err := hex.DecodeString(obj.hash)
+		if err != nil {
+			return err
+		}
+		fanout[hash[0]]++
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&buf, binary.BigEndian, fanout)
+
+	for _, obj := range sorted {
+		hash, _ := hex.DecodeString(obj.hash)
+		buf.Write(hash)
+	}
+	for _, obj := range sorted {
+		binary.Write(&buf, binary.BigEndian, obj.crc)
+	}
+
+	var largeOffsets []uint64
+	for _, obj := range sorted {
+		if obj.offset < 0x80000000 {
+			binary.Write(&buf, binary.BigEndian, uint32(obj.offset))
+		} else {
+			binary.Write(&buf, binary.BigEndian, uint32(0x80000000|len(largeOffsets)))
+			largeOffsets = append(largeOffsets, uint64(obj.offset))
+		}
+	}
+	for _, offset := range largeOffsets {
+		binary.Write(&buf, binary.BigEndian, offset)
+	}
+
+	buf.Write(packChecksum)
+	buf.Write(HashBytes(buf.Bytes()))
+
+	return WriteFile(path, buf.Bytes())
+}
+
+func readPackIndex(path string) (*packIndex, error) {
+	data, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePackIndex(path, data)
+}
+
+// parsePackIndex decodes a version 2 pack index; path only names it in
+// errors.
+func parsePackIndex(path string, data []byte) (*packIndex, error) {
+	if len(data) < 8+256*4+40 || !bytes.Equal(data[:4], packIndexMagic) {
+		return nil, fmt.Errorf("%s: invalid pack index header", path)
+	}
+	if version := decodeBigUint32(data[4:8]); version != 2 {
+		return nil, fmt.Errorf("%s: unsupported pack index version %d", path, version)
+	}
+
+	checksum := sha1.Sum(data[:len(data)-20])
+	if !bytes.Equal(checksum[:], data[len(data)-20:]) {
+		return nil, fmt.Errorf("%s: invalid pack index checksum", path)
+	}
+
+	idx := &packIndex{}
+	byteIndex := 8
+	for i := range idx.fanout {
+		idx.fanout[i] = decodeBigUint32(data[byteIndex:])
+		if i > 0 && idx.fanout[i] < idx.fanout[i-1] {
+			return nil, fmt.Errorf("%s: non-monotonic fanout table", path)
+		}
+		byteIndex += 4
+	}
+
+	count := int(idx.fanout[255])
+	if len(data) < byteIndex+count*28+40 {
+		return nil, fmt.Errorf("%s: truncated pack index", path)
+	}
+
+	idx.hashes = data[byteIndex : byteIndex+count*20]
+	byteIndex += count * 20
+	idx.crcs = data[byteIndex : byteIndex+count*4]
+	byteIndex += count * 4
+	idx.offsets = data[byteIndex : byteIndex+count*4]
+	byteIndex += count * 4
+	idx.largeOffsets = data[byteIndex : len(data)-40]
+	idx.packChecksum = data[len(data)-40 : len(data)-20]
+
+	// The checksum only guards against damage, so an index from elsewhere
+	// still has to keep every large offset inside its table
+	if len(idx.largeOffsets)%8 != 0 {
+		return nil, fmt.Errorf("%s: invalid large offset table", path)
+	}
+	for i := 0; i < count; i++ {
+		offset := decodeBigUint32(idx.offsets[i*4:])
+		if offset&0x80000000 != 0 && int(offset&0x7fffffff)*8+8 > len(idx.largeOffsets) {
+			return nil, fmt.Errorf("%s: large offset %d out of range", path, offset&0x7fffffff)
+		}
+	}
+
+	return idx, nil
+}
+
+func (idx *packIndex) count() int {
+	return int(idx.fanout[255])
+}
+
+func (idx *packIndex) hashAt(i int) []byte {
+	return idx.hashes[i*20 : i*20+20]
+}
+
+func (idx *packIndex) crcAt(i int) uint32 {
+	return decodeBigUint32(idx.crcs[i*4:])
+}
+
+func (idx *packIndex) offsetAt(i int) int64 {
+	offset := decodeBigUint32(idx.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	large := int(offset&0x7fffffff) * 8
+	return int64(binary.BigEndian.Uint64(idx.largeOffsets[large:]))
+}
+
+func (idx *packIndex) find(hash []byte) (int64, bool) {
+	var lo int
+	if hash[0] > 0 {
+		lo = int(idx.fanout[hash[0]-1])
+	}
+	hi := int(idx.fanout[hash[0]])
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.hashAt(lo+i), hash) >= 0
+	})
+	if i < hi && bytes.Equal(idx.hashAt(i), hash) {
+		return idx.offsetAt(i), true
+	}
+	return 0, false
+}
@@ -0,0 +1,391 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// packOptions tunes the delta search of writePackStream.
+type packOptions struct {
+	// window is how many of the preceding objects are tried as delta bases
+	window int
+	// depth bounds delta chains, which readers have to walk to the end
+	depth int
+	// ofsDelta refers to bases by their position in the pack rather than
+	// by name, which the reader has to have asked for
+	ofsDelta bool
+}
+
+func defaultPackOptions(ofsDelta bool) packOptions {
+	return packOptions{window: 10, depth: 50, ofsDelta: ofsDelta}
+}
+
+// PackObjectsOptions controls what PackObjects reads and writes.
+type PackObjectsOptions struct {
+	// BaseName is the path prefix of the pack and index written, which are
+	// named <BaseName>-<checksum>.pack and .idx
+	BaseName string
+	// Stdout writes the pack to the output instead, with no index
+	Stdout bool
+	// Revs reads revisions, including "^<rev>" exclusions, instead of
+	// object names, and packs everything they reach
+	Revs bool
+	// Window and Depth are the delta search window and chain depth limit;
+	// a window of 0 turns delta compression off
+	Window int
+	Depth  int
+	// OfsDelta writes OFS_DELTA entries rather than REF_DELTA ones
+	OfsDelta bool
+}
+
+// writtenPack describes a pack writePackStream wrote.
+type writtenPack struct {
+	objects  []*packObject
+	checksum []byte
+	deltas   int
+}
+
+// packEntry is an object on its way into a pack, with the base it is
+// stored as a delta against, if any.
+type packEntry struct {
+	packableObject
+	size     int
+	nameHash uint32
+	base     *packEntry
+	delta    []byte
+	depth    int
+	written  *packObject
+}
+
+// PackObjects writes the objects named on r, one per line and optionally
+// followed by the path they were found at, as a pack. The pack goes to w
+// with Stdout, or else to a file under BaseName whose checksum is printed
+// to w.
+func PackObjects(r io.Reader, w io.Writer, options PackObjectsOptions) error {
+	objects, err := readPackObjectsInput(r, options.Revs)
+	if err != nil {
+		return err
+	}
+	packOptions := packOptions{window: options.Window, depth: options.Depth, ofsDelta: options.OfsDelta}
+
+	if options.Stdout {
+		out := bufio.NewWriter(w)
+		pack, err := writePackStream(out, objects, packOptions)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Total %d (delta %d)\n", len(pack.objects), pack.deltas)
+		return out.Flush()
+	}
+
+	dir := filepath.Dir(options.BaseName)
+	file, err := os.CreateTemp(dir, "tmp_pack_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	out := bufio.NewWriter(file)
+	pack, err := writePackStream(out, objects, packOptions)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%x", options.BaseName, pack.checksum)
+	if err := os.Chmod(file.Name(), 0444); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), name+".pack"); err != nil {
+		return err
+	}
+	if err := writePackIndex(name+".idx", pack.objects, pack.checksum); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Total %d (delta %d)\n", len(pack.objects), pack.deltas)
+	fmt.Fprintf(w, "%x\n", pack.checksum)
+	return nil
+}
+
+// readPackObjectsInput reads the objects to pack: "<hash> [<path>]" lines,
+// or with revs, revisions whose history is listed.
+func readPackObjectsInput(r io.Reader, revs bool) ([]packableObject, error) {
+	var objects []packableObject
+	var include, exclude []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if revs {
+			excluded := strings.HasPrefix(line, "^")
+			_, hash, err := resolveRevision(strings.TrimPrefix(line, "^"))
+			if err != nil {
+				return nil, err
+			}
+			if excluded {
+				exclude = append(exclude, hash)
+			} else {
+				include = append(include, hash)
+			}
+			continue
+		}
+
+		hash, name, _ := strings.Cut(line, " ")
+		if err := ValidateHash(hash); err != nil {
+			return nil, fmt.Errorf("expected object ID, got garbage:\n %s", line)
+		}
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		_, objType, _, err := ReadObjectFile(hash)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, packableObject{hash: hash, objType: objType, name: name})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if revs {
+		return listObjects(include, exclude)
+	}
+	return objects, nil
+}
+
+// buildPackfile returns the pack writePackStream would write.
+func buildPackfile(objects []packableObject, options packOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := writePackStream(&buf, objects, options); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writePackStream writes the objects to w as a version 2 pack, storing
+// each as a delta against a similar object where that is smaller, followed
+// by the pack's SHA-1 trailer. Objects are written in the order given, but
+// always after their delta base. Besides the objects in the delta search
+// window, the deltas found are held in memory until they are written;
+// other objects are read again to be written.
+func writePackStream(w io.Writer, objects []packableObject, options packOptions) (*writtenPack, error) {
+	entries := make([]*packEntry, len(objects))
+	for i, object := range objects {
+		obj, _, _, err := ReadObjectFile(object.hash)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = &packEntry{packableObject: object, size: len(obj), nameHash: packNameHash(object.name)}
+	}
+
+	if options.window > 0 && options.depth > 0 {
+		if err := findDeltas(entries, options); err != nil {
+			return nil, err
+		}
+	}
+
+	writer := &packWriter{w: w, sha: sha1.New(), options: options}
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(entries)))
+	if err := writer.write(header); err != nil {
+		return nil, err
+	}
+
+	pack := &writtenPack{}
+	for _, entry := range entries {
+		if err := writer.writeEntry(entry, pack); err != nil {
+			return nil, err
+		}
+	}
+
+	pack.checksum = writer.sha.Sum(nil)
+	if _, err := w.Write(pack.checksum); err != nil {
+		return nil, err
+	}
+	return pack, nil
+}
+
+// packNameHash condenses a path so that files of the same name, which tend
+// to delta well against each other, sort next to each other. It is git's
+// hash, weighted towards the last characters of the name.
+func packNameHash(name string) uint32 {
+	var hash uint32
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if unicode.IsSpace(rune(c)) {
+			continue
+		}
+		hash = (hash >> 2) + (uint32(c) << 24)
+	}
+	return hash
+}
+
+// deltaCandidate is an object in the delta search window.
+type deltaCandidate struct {
+	entry *packEntry
+	data  []byte
+	index *deltaIndex
+}
+
+// findDeltas picks a delta base for each entry among the window objects
+// sorted before it. Sorting by type, name hash and decreasing size puts
+// versions of the same file together, newest and largest first, so most
+// deltas remove data from their base rather than add it.
+func findDeltas(entries []*packEntry, options packOptions) error {
+	sorted := make([]*packEntry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.objType != b.objType {
+			return getObjectTypeNumber(a.objType) < getObjectTypeNumber(b.objType)
+		}
+		if a.nameHash != b.nameHash {
+			return a.nameHash < b.nameHash
+		}
+		return a.size > b.size
+	})
+
+	var window []*deltaCandidate
+	for _, target := range sorted {
+		data, _, _, err := ReadObjectFile(target.hash)
+		if err != nil {
+			return err
+		}
+
+		// A delta also costs the base's name or offset and its headers
+		maxSize := target.size/2 - 20
+		for i := len(window) - 1; i >= 0 && maxSize > 0; i-- {
+			base := window[i]
+			if base.entry.objType != target.objType || base.entry.depth >= options.depth {
+				continue
+			}
+			if target.size-base.entry.size >= maxSize {
+				continue
+			}
+			if base.index == nil {
+				base.index = newDeltaIndex(base.data)
+			}
+			delta := createDelta(base.index, data, maxSize)
+			if delta == nil {
+				continue
+			}
+			target.base, target.delta, target.depth = base.entry, delta, base.entry.depth+1
+			maxSize = len(delta) - 1
+		}
+
+		window = append(window, &deltaCandidate{entry: target, data: data})
+		if len(window) > options.window {
+			window[0] = nil
+			window = window[1:]
+		}
+	}
+	return nil
+}
+
+// packWriter writes pack entries, keeping the running checksum and offset.
+type packWriter struct {
+	w       io.Writer
+	sha     hash.Hash
+	offset  int64
+	options packOptions
+}
+
+func (p *packWriter) write(data []byte) error {
+	p.sha.Write(data)
+	_, err := p.w.Write(data)
+	p.offset += int64(len(data))
+	return err
+}
+
+// writeEntry writes entry, after its delta base if that is not in the pack
+// yet.
+func (p *packWriter) writeEntry(entry *packEntry, pack *writtenPack) error {
+	if entry.written != nil {
+		return nil
+	}
+	if entry.base != nil {
+		if err := p.writeEntry(entry.base, pack); err != nil {
+			return err
+		}
+	}
+
+	object := &packObject{offset: p.offset, hash: entry.hash}
+	var header, data []byte
+	if entry.base == nil {
+		obj, _, _, err := ReadObjectFile(entry.hash)
+		if err != nil {
+			return err
+		}
+		object.objType = getObjectTypeNumber(entry.objType)
+		if object.objType == 0 {
+			return fmt.Errorf("unknown object type: %s", entry.objType)
+		}
+		data = obj
+		header = encodeObjectHeader(object.objType, uint64(len(data)))
+	} else if p.options.ofsDelta {
+		object.objType = ObjOfsDelta
+		object.baseOffset = entry.base.written.offset
+		data = entry.delta
+		header = append(encodeObjectHeader(ObjOfsDelta, uint64(len(data))), encodeOfsDeltaOffset(object.offset-object.baseOffset)...)
+		pack.deltas++
+	} else {
+		object.objType = ObjRefDelta
+		object.baseHash = entry.base.hash
+		baseHash, _ := hex.DecodeString(entry.base.hash)
+		data = entry.delta
+		header = append(encodeObjectHeader(ObjRefDelta, uint64(len(data))), baseHash...)
+		pack.deltas++
+	}
+	object.size = uint64(len(data))
+
+	compressed, err := compressBytes(data)
+	if err != nil {
+		return err
+	}
+	encoded := append(header, compressed...)
+	object.crc = crc32.ChecksumIEEE(encoded)
+	if err := p.write(encoded); err != nil {
+		return err
+	}
+
+	entry.written = object
+	entry.delta = nil
+	pack.objects = append(pack.objects, object)
+	return nil
+}
+
+// encodeOfsDeltaOffset encodes the distance back to an OFS_DELTA base the
+// way readOfsDeltaOffset decodes it.
+func encodeOfsDeltaOffset(offset int64) []byte {
+	encoded := []byte{byte(offset & 0x7F)}
+	for offset >>= 7; offset > 0; offset >>= 7 {
+		offset--
+		encoded = append([]byte{byte(offset&0x7F) | 0x80}, encoded...)
+	}
+	return encoded
+}
@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const packSpoolFlushSize = 32 * 1024
+
+// packStream reads a pack from the network one entry at a time. Every byte
+// it consumes is spooled to disk and fed to the pack checksum and the CRC32
+// of the current entry. It implements io.ByteReader so that zlib never reads
+// past the end of an entry.
+type packStream struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	sha     hash.Hash
+	crc     hash.Hash32
+	zr      io.ReadCloser
+	pending []byte
+	offset  int64
+}
+
+func newPackStream(r io.Reader, w io.Writer) *packStream {
+	return &packStream{
+		r:   bufio.NewReader(r),
+		w:   bufio.NewWriter(w),
+		sha: sha1.New(),
+		crc: crc32.NewIEEE(),
+	}
+}
+
+func (s *packStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.consume(p[:n])
+	return n, err
+}
+
+func (s *packStream) ReadByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	s.consume([]byte{c})
+	return c, nil
+}
+
+func (s *packStream) consume(data []byte) {
+	s.pending = append(s.pending, data...)
+	s.offset += int64(len(data))
+	if len(s.pending) >= packSpoolFlushSize {
+		s.flush()
+	}
+}
+
+// flush hands the bytes consumed so far to the checksums and the spool.
+func (s *packStream) flush() error {
+	s.sha.Write(s.pending)
+	s.crc.Write(s.pending)
+	_, err := s.w.Write(s.pending)
+	s.pending = s.pending[:0]
+	return err
+}
+
+// inflate decompresses the zlib stream at the current position into w and
+// returns the inflated size.
+func (s *packStream) inflate(w io.Writer) (uint64, error) {
+	var err error
+	if s.zr == nil {
+		s.zr, err = zlib.NewReader(s)
+	} else {
+		err = s.zr.(zlib.Resetter).Reset(s, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, s.zr)
+	return uint64(n), err
+}
+
+func (s *packStream) readHeader() (uint32, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(s, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("packfile failed validation: invalid size")
+	} else if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return 0, fmt.Errorf("packfile failed validation: invalid header")
+	}
+	version := binary.BigEndian.Uint32(header[4:8])
+	if version != 2 && version != 3 {
+		return 0, fmt.Errorf("packfile failed validation: invalid version")
+	}
+	return binary.BigEndian.Uint32(header[8:12]), nil
+}
+
+// readEntry parses the next pack entry. Undeltified objects are hashed as
+// they are inflated; deltas are resolved later from the spooled pack.
+func (s *packStream) readEntry() (*packObject, error) {
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	s.crc.Reset()
+	entry := &packObject{offset: s.offset}
+
+	c, err := s.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	entry.objType = int((c >> 4) & 0x7)
+	entry.size = uint64(c & 0xF)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		if shift >= 64 {
+			return nil, errors.New("bad object header")
+		}
+		if c, err = s.ReadByte(); err != nil {
+			return nil, err
+		}
+		entry.size += uint64(c&0x7F) << shift
+	}
+
+	var inflated uint64
+	switch entry.objType {
+	case ObjCommit, ObjTree, ObjBlob, ObjTag:
+		objType, _ := getObjectTypeString(entry.objType)
+		hasher := sha1.New()
+		fmt.Fprintf(hasher, "%s %d\x00", objType, entry.size)
+		inflated, err = s.inflate(hasher)
+		entry.hash = hex.EncodeToString(hasher.Sum(nil))
+	case ObjRefDelta:
+		base := make([]byte, 20)
+		if _, err := io.ReadFull(s, base); err != nil {
+			return nil, fmt.Errorf("truncated delta header at offset %d", entry.offset)
+		}
+		entry.baseHash = hex.EncodeToString(base)
+		inflated, err = s.inflate(io.Discard)
+	case ObjOfsDelta:
+		var negOffset int64
+		negOffset, err = s.readOfsDeltaOffset()
+		if err != nil {
+			return nil, err
+		}
+		if negOffset <= 0 || negOffset > entry.offset {
+			return nil, fmt.Errorf("invalid delta base offset at offset %d", entry.offset)
+		}
+		entry.baseOffset = entry.offset - negOffset
+		inflated, err = s.inflate(io.Discard)
+	default:
+		return nil, fmt.Errorf("invalid object type %d at offset %d", entry.objType, entry.offset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inflating object at offset %d: %s", entry.offset, err)
+	}
+	if inflated != entry.size {
+		return nil, fmt.Errorf("invalid object header size at offset %d", entry.offset)
+	}
+
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	entry.crc = s.crc.Sum32()
+	return entry, nil
+}
+
+func (s *packStream) readOfsDeltaOffset() (int64, error) {
+	c, err := s.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(c & 0x7F)
+	for c&0x80 != 0 {
+		if offset >= 1<<56 {
+			return 0, errors.New("bad delta base offset")
+		}
+		if c, err = s.ReadByte(); err != nil {
+			return 0, err
+		}
+		offset = ((offset + 1) << 7) | int64(c&0x7F)
+	}
+	return offset, nil
+}
+
+// readTrailer checks the pack checksum against everything read so far.
+// With untilEOF it also makes sure nothing follows it, which only holds
+// when the sender closes the stream after the pack.
+func (s *packStream) readTrailer(untilEOF bool) ([]byte, error) {
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	checksum := make([]byte, 20)
+	if _, err := io.ReadFull(s.r, checksum); err != nil {
+		return nil, fmt.Errorf("packfile failed validation: truncated pack")
+	}
+	if !bytes.Equal(checksum, s.sha.Sum(nil)) {
+		return nil, fmt.Errorf("packfile failed validation: invalid checksum")
+	}
+	if untilEOF {
+		if _, err := s.r.ReadByte(); err != io.EOF {
+			return nil, fmt.Errorf("packfile failed validation: trailing data after pack")
+		}
+	}
+	if _, err := s.w.Write(checksum); err != nil {
+		return nil, err
+	}
+	return checksum, s.w.Flush()
+}
+
+// spooledPack is a received pack kept in a temporary file until it has been
+// resolved and can be moved into the object store.
+type spooledPack struct {
+	file     *os.File
+	objects  []*packObject
+	size     int64
+	checksum []byte
+}
+
+// spoolPack streams a pack from r into a temporary file in the pack
+// directory packDir, so memory use does not grow with the size of the
+// pack. untilEOF requires the pack to be the last thing r yields.
+func spoolPack(packDir string, r io.Reader, untilEOF bool) (*spooledPack, error) {
+	err := os.MkdirAll(packDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(packDir, "tmp_pack_")
+	if err != nil {
+		return nil, err
+	}
+	pack := &spooledPack{file: file}
+
+	pack.objects, pack.size, pack.checksum, err = readPackEntries(newPackStream(r, file), untilEOF)
+	if err != nil {
+		pack.discard()
+		return nil, err
+	}
+	return pack, nil
+}
+
+// readPackEntries reads a whole pack from stream, returning its entries,
+// the offset of its trailer and its checksum.
+func readPackEntries(stream *packStream, untilEOF bool) ([]*packObject, int64, []byte, error) {
+	count, err := stream.readHeader()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	var objects []*packObject
+	for i := uint32(0); i < count; i++ {
+		entry, err := stream.readEntry()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("packfile failed validation: expected %d objects, read %d", count, i)
+		}
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		objects = append(objects, entry)
+	}
+
+	size := stream.offset
+	checksum, err := stream.readTrailer(untilEOF)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return objects, size, checksum, nil
+}
+
+// completeThin appends the external delta bases of a thin pack so the stored
+// pack is self-contained, rewriting its object count and trailer.
+func (p *spooledPack) completeThin(bases []string) error {
+	for _, hash := range bases {
+		obj, objType, _, err := ReadObjectFile(hash)
+		if err != nil {
+			return err
+		}
+
+		entry, err := encodePackEntry(obj, objType)
+		if err != nil {
+			return err
+		}
+		if _, err := p.file.WriteAt(entry, p.size); err != nil {
+			return err
+		}
+
+		p.objects = append(p.objects, &packObject{
+			offset:  p.size,
+			objType: getObjectTypeNumber(objType),
+			size:    uint64(len(obj)),
+			hash:    hash,
+			crc:     crc32.ChecksumIEEE(entry),
+		})
+		p.size += int64(len(entry))
+	}
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(len(p.objects)))
+	if _, err := p.file.WriteAt(count, 8); err != nil {
+		return err
+	}
+
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(p.file, 0, p.size)); err != nil {
+		return err
+	}
+	p.checksum = hasher.Sum(nil)
+	_, err := p.file.WriteAt(p.checksum, p.size)
+	return err
+}
+
+// store moves the pack into place under its checksum, in the directory it
+// was spooled to, and writes its index.
+func (p *spooledPack) store() (string, error) {
+	packPath := filepath.Join(filepath.Dir(p.file.Name()), fmt.Sprintf("pack-%x.pack", p.checksum))
+	if err := p.storeAs(packPath); err != nil {
+		return "", err
+	}
+	resetStoredPacks()
+	return packPath, nil
+}
+
+// storeAs moves the pack to packPath and writes its index beside it.
+func (p *spooledPack) storeAs(packPath string) error {
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(p.file.Name(), 0444); err != nil {
+		return err
+	}
+	if err := os.Rename(p.file.Name(), packPath); err != nil {
+		return err
+	}
+	p.file = nil
+
+	return writePackIndex(packPath[:len(packPath)-len(".pack")]+".idx", p.objects, p.checksum)
+}
+
+// discard removes the temporary file unless the pack has been stored.
+func (p *spooledPack) discard() {
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+		p.file = nil
+	}
+}
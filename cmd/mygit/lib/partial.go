@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// lazyFetchFilter keeps on-demand fetches of trees from pulling in their
+// blobs; explicitly requested objects are always sent.
+const lazyFetchFilter = "blob:none"
+
+// fetchingPromisedObjects is set while a lazy fetch runs, so that objects
+// found missing meanwhile, such as the bases of the thin pack it receives,
+// do not start another. It is atomic since deltas are resolved on several
+// goroutines.
+var fetchingPromisedObjects atomic.Bool
+
+// ValidateFilterSpec checks a partial clone filter: blob:none,
+// blob:limit=<n>[kmg] or tree:<depth>.
+func ValidateFilterSpec(spec string) error {
+	kind, value, _ := strings.Cut(spec, ":")
+	switch {
+	case spec == "blob:none":
+		return nil
+	case kind == "blob" && strings.HasPrefix(value, "limit="):
+		limit := strings.TrimPrefix(value, "limit=")
+		if n := len(limit); n > 0 && strings.ContainsRune("kmgKMG", rune(limit[n-1])) {
+			limit = limit[:n-1]
+		}
+		if _, err := strconv.ParseUint(limit, 10, 64); err == nil {
+			return nil
+		}
+	case kind == "tree":
+		if _, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid filter-spec '%s'", spec)
+}
+
+// objectFilter is a parsed filter spec, applied by upload-pack to the
+// objects it lists.
+type objectFilter struct {
+	noBlobs bool
+	// blobLimit leaves out blobs of at least that many bytes when set
+	blobLimit    uint64
+	hasBlobLimit bool
+	// treeDepth leaves out trees and blobs that many levels below the
+	// root tree, or deeper, when set
+	treeDepth    int
+	hasTreeDepth bool
+}
+
+// parseFilterSpec parses a filter spec checked by ValidateFilterSpec.
+func parseFilterSpec(spec string) (*objectFilter, error) {
+	if err := ValidateFilterSpec(spec); err != nil {
+		return nil, err
+	}
+
+	filter := &objectFilter{}
+	kind, value, _ := strings.Cut(spec, ":")
+	switch {
+	case spec == "blob:none":
+		filter.noBlobs = true
+	case kind == "blob":
+		limit := strings.TrimPrefix(value, "limit=")
+		scale := uint64(1)
+		switch limit[len(limit)-1] {
+		case 'k', 'K':
+			scale = 1 << 10
+		case 'm', 'M':
+			scale = 1 << 20
+		case 'g', 'G':
+			scale = 1 << 30
+		}
+		if scale > 1 {
+			limit = limit[:len(limit)-1]
+		}
+		n, _ := strconv.ParseUint(limit, 10, 64)
+		filter.blobLimit = n * scale
+		filter.hasBlobLimit = true
+	case kind == "tree":
+		depth, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		filter.treeDepth = int(depth)
+		filter.hasTreeDepth = true
+	}
+	return filter, nil
+}
+
+// includesTree reports whether a tree depth levels below a root tree is
+// sent. Root trees are at depth 0.
+func (f *objectFilter) includesTree(depth int) bool {
+	return f == nil || !f.hasTreeDepth || depth < f.treeDepth
+}
+
+// includesBlob reports whether a blob of size bytes, depth levels below a
+// root tree, is sent.
+func (f *objectFilter) includesBlob(size int, depth int) bool {
+	if f == nil {
+		return true
+	}
+	if f.noBlobs || f.hasBlobLimit && uint64(size) >= f.blobLimit {
+		return false
+	}
+	return f.includesTree(depth)
+}
+
+// needsBlobSize reports whether includesBlob looks at the size of blobs.
+func (f *objectFilter) needsBlobSize() bool {
+	return f != nil && f.hasBlobLimit
+}
+
+// checkFilterSupport fails when the server cannot filter the pack it sends.
+func (a *refAdvertisement) checkFilterSupport(filter string) error {
+	if filter == "" {
+		return nil
+	}
+	if a.version == 2 && a.hasV2Feature("fetch", "filter") || a.version < 2 && a.hasCapability("filter") {
+		return nil
+	}
+	return fmt.Errorf("server does not support filters; filtering not recognized by server")
+}
+
+// registerPromisorRemote records remote as the source of objects a filtered
+// fetch left out, so they can be fetched when needed.
+func registerPromisorRemote(remote, filter string) error {
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return err
+	}
+
+	config.Set("core.repositoryformatversion", "1")
+	config.Set("extensions.partialclone", remote)
+	config.Set(fmt.Sprintf("remote.%s.promisor", remote), "true")
+	config.Set(fmt.Sprintf("remote.%s.partialclonefilter", remote), filter)
+	return config.Write(ConfigFilePath)
+}
+
+// promisorFilter returns the filter to fetch from remote with, or "" when it
+// is not a promisor remote.
+func promisorFilter(config *Config, remote string) string {
+	if promisor, _ := config.Get(fmt.Sprintf("remote.%s.promisor", remote)); promisor != "true" {
+		return ""
+	}
+	filter, _ := config.Get(fmt.Sprintf("remote.%s.partialclonefilter", remote))
+	return filter
+}
+
+// markPromisorPack writes the .promisor file that marks a pack as coming
+// from a promisor remote, listing the refs it was fetched for.
+func markPromisorPack(packPath string, refs []Ref) error {
+	var content bytes.Buffer
+	for _, ref := range refs {
+		fmt.Fprintf(&content, "%s %s\n", ref.Hash, ref.Name)
+	}
+	return WriteFile(strings.TrimSuffix(packPath, ".pack")+".promisor", content.Bytes())
+}
+
+// fetchPromisedObjects downloads objects a partial clone left out from the
+// promisor remote. It does nothing outside a partial clone.
+func fetchPromisedObjects(hashes []string) error {
+	if len(hashes) == 0 || !fetchingPromisedObjects.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer fetchingPromisedObjects.Store(false)
+
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return err
+	}
+	remote, ok := config.Get("extensions.partialclone")
+	if !ok {
+		return nil
+	}
+	url, ok := config.Get(fmt.Sprintf("remote.%s.url", remote))
+	if !ok {
+		return fmt.Errorf("promisor remote '%s' has no url", remote)
+	}
+
+	remoteTransport, err := openTransport(url)
+	if err != nil {
+		return err
+	}
+	defer remoteTransport.close()
+	// Only the capabilities matter; keep the v2 ref listing short
+	advertisement, err := remoteTransport.discoverRefs(UploadPackService, []string{"HEAD"})
+	if err != nil {
+		return err
+	}
+
+	fetch := fetchRequest{wants: hashes, filter: lazyFetchFilter}
+	packPath, _, err := remoteTransport.fetchPack(advertisement, fetch, newHaveWalker(nil))
+	if err != nil {
+		return fmt.Errorf("could not fetch %s from promisor remote: %s", hashes[0], err)
+	}
+	if packPath == "" {
+		return nil
+	}
+	return markPromisorPack(packPath, nil)
+}
+
+// prefetchTree fetches the blobs missing below treeHash in one request
+// rather than one at a time during checkout.
+func prefetchTree(treeHash string) error {
+	var missing []string
+	var walk func(hash string) error
+	walk = func(hash string) error {
+		entries, err := ReadTreeObjectFile(hash)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entryHash := hex.EncodeToString(entry.hash)
+			if entry.mode == ModeTree {
+				if err := walk(entryHash); err != nil {
+					return err
+				}
+			} else if (entry.mode == ModeBlob || entry.mode == ModeBlobExec) && !ObjectExists(entryHash) {
+				missing = append(missing, entryHash)
+			}
+		}
+		return nil
+	}
+
+	if err := walk(treeHash); err != nil {
+		return err
+	}
+	return fetchPromisedObjects(missing)
+}
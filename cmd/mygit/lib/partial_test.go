@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *objectFilter
+	}{
+		{"blob:none", &objectFilter{noBlobs: true}},
+		{"blob:limit=0", &objectFilter{hasBlobLimit: true}},
+		{"blob:limit=512", &objectFilter{blobLimit: 512, hasBlobLimit: true}},
+		{"blob:limit=2k", &objectFilter{blobLimit: 2 << 10, hasBlobLimit: true}},
+		{"blob:limit=3M", &objectFilter{blobLimit: 3 << 20, hasBlobLimit: true}},
+		{"blob:limit=1g", &objectFilter{blobLimit: 1 << 30, hasBlobLimit: true}},
+		{"tree:0", &objectFilter{hasTreeDepth: true}},
+		{"tree:3", &objectFilter{treeDepth: 3, hasTreeDepth: true}},
+		{"blob:some", nil},
+		{"blob:limit=", nil},
+		{"blob:limit=k", nil},
+		{"blob:limit=-1", nil},
+		{"tree:", nil},
+		{"tree:-1", nil},
+		{"sparse:oid=HEAD", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		filter, err := parseFilterSpec(test.spec)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parseFilterSpec(%q) = %+v, want an error", test.spec, filter)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFilterSpec(%q): %s", test.spec, err)
+		} else if !reflect.DeepEqual(filter, test.want) {
+			t.Errorf("parseFilterSpec(%q) = %+v, want %+v", test.spec, filter, test.want)
+		}
+	}
+}
+
+// writeNestedCommit writes a commit of big.txt, small.txt and dir/nested.txt.
+func writeNestedCommit(t *testing.T) (string, map[string]string) {
+	t.Helper()
+	hashes := make(map[string]string)
+	writeObject := func(name, objType string, data []byte) []byte {
+		hash, err := WriteObjectWithType(data, objType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[name] = hex.EncodeToString(hash)
+		return hash
+	}
+	treeEntry := func(mode, name string, hash []byte) []byte {
+		return append([]byte(mode+" "+name+"\x00"), hash...)
+	}
+
+	nested := writeObject("dir/nested.txt", "blob", []byte("nested\n"))
+	dir := writeObject("dir", "tree", treeEntry("100644", "nested.txt", nested))
+	big := writeObject("big.txt", "blob", []byte(strings.Repeat("big\n", 25)))
+	small := writeObject("small.txt", "blob", []byte("small\n"))
+
+	var root []byte
+	root = append(root, treeEntry("100644", "big.txt", big)...)
+	root = append(root, treeEntry("40000", "dir", dir)...)
+	root = append(root, treeEntry("100644", "small.txt", small)...)
+	tree := writeObject("", "tree", root)
+
+	commit := fmt.Sprintf("tree %x\nauthor %s <%s> 1620000000 +0000\ncommitter %s <%s> 1620000000 +0000\n\nnested\n",
+		tree, DefaultAuthor, DefaultAuthorEmail, DefaultAuthor, DefaultAuthorEmail)
+	return hex.EncodeToString(writeObject("commit", "commit", []byte(commit))), hashes
+}
+
+func TestListFilteredObjects(t *testing.T) {
+	isolateTest(t)
+	initTestRepository(t, filepath.Join(t.TempDir(), "repo.git"))
+	commit, hashes := writeNestedCommit(t)
+
+	tests := []struct {
+		spec    string
+		include []string
+		want    []string
+	}{
+		{"", nil, []string{"commit", "", "big.txt", "dir", "dir/nested.txt", "small.txt"}},
+		{"blob:none", nil, []string{"commit", "", "dir"}},
+		{"blob:limit=50", nil, []string{"commit", "", "dir", "dir/nested.txt", "small.txt"}},
+		{"tree:0", nil, []string{"commit"}},
+		{"tree:1", nil, []string{"commit", ""}},
+		{"tree:2", nil, []string{"commit", "", "big.txt", "dir", "small.txt"}},
+		// Objects asked for by name are sent whatever the filter
+		{"blob:none", []string{"big.txt"}, []string{"commit", "", "big.txt", "dir"}},
+	}
+	for _, test := range tests {
+		var filter *objectFilter
+		if test.spec != "" {
+			var err error
+			if filter, err = parseFilterSpec(test.spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		include := []string{commit}
+		for _, name := range test.include {
+			include = append(include, hashes[name])
+		}
+		objects, err := listFilteredObjects(include, nil, filter)
+		if err != nil {
+			t.Fatalf("listFilteredObjects(%q): %s", test.spec, err)
+		}
+
+		names := make(map[string]string)
+		for name, hash := range hashes {
+			names[hash] = name
+		}
+		var got []string
+		for _, object := range objects {
+			got = append(got, names[object.hash])
+		}
+		sort.Strings(got)
+		want := append([]string{}, test.want...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("filter %q with %q lists %q, want %q", test.spec, test.include, got, want)
+		}
+	}
+}
+
+func TestPartialCloneFetchesLazily(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+	serverDir := filepath.Join(dir, "server.git")
+	initTestRepository(t, serverDir)
+	newTestHistory(t, 3)
+	SetGitDir(DefaultGitDir)
+
+	CloneRepository("file://"+serverDir, filepath.Join(dir, "client"), CloneOptions{Filter: "blob:none"})
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"extensions.partialclone":          DefaultRemoteName,
+		"remote.origin.promisor":           "true",
+		"remote.origin.partialclonefilter": "blob:none",
+	} {
+		if value, _ := config.Get(key); value != want {
+			t.Errorf("%s = %q, want %q", key, value, want)
+		}
+	}
+
+	blobHash := func(contents string) string {
+		return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("blob %d\x00%s", len(contents), contents))))
+	}
+	// The checkout fetched the blob it needed, and only that one
+	if !ObjectExists(blobHash("version 2\n")) {
+		t.Fatal("the checked out blob is missing")
+	}
+	old := blobHash("version 0\n")
+	if ObjectExists(old) {
+		t.Fatal("the clone has a blob the filter leaves out")
+	}
+
+	// A missing object found while a lazy fetch runs is not fetched again
+	fetchingPromisedObjects.Store(true)
+	_, _, _, err = ReadObjectFile(old)
+	fetchingPromisedObjects.Store(false)
+	if err == nil {
+		t.Fatal("read a left out blob while a lazy fetch was running")
+	}
+
+	data, objType, _, err := ReadObjectFile(old)
+	if err != nil {
+		t.Fatalf("ReadObjectFile of a left out blob: %s", err)
+	}
+	if objType != "blob" || string(data) != "version 0\n" {
+		t.Fatalf("lazily fetched %s %q, want blob %q", objType, data, "version 0\n")
+	}
+	promisors, err := filepath.Glob(filepath.Join(PackDir, "*.promisor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(promisors) < 2 {
+		t.Errorf("promisor packs %q, want the clone's and the lazy fetch's", promisors)
+	}
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const flushPkt = "0000"
+
+type pktLineReader struct {
+	r io.Reader
+}
+
+func newPktLineReader(r io.Reader) *pktLineReader {
+	return &pktLineReader{r: r}
+}
+
+// readPacket returns the length header and raw payload of the next pkt-line.
+// Special packets such as flush have a length below 4 and no payload.
+func (p *pktLineReader) readPacket() (int, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(p.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	dest := [2]byte{}
+	if _, err := hex.Decode(dest[:], header[:]); err != nil {
+		return 0, nil, fmt.Errorf("invalid pkt-line header %q", header)
+	}
+
+	size := int(dest[0])<<8 | int(dest[1])
+	if size < 4 {
+		return size, nil, nil
+	}
+
+	payload := make([]byte, size-4)
+	if _, err := io.ReadFull(p.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return size, payload, nil
+}
+
+// readLine returns the next pkt-line payload without its trailing newline,
+// or nil for a flush packet.
+func (p *pktLineReader) readLine() ([]byte, error) {
+	_, payload, err := p.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(payload, []byte("\n")), nil
+}
+
+func encodePktLine(data string) string {
+	return fmt.Sprintf("%04x%s", len(data)+4, data)
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncodePktLine(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"", "0004"},
+		{"a\n", "0006a\n"},
+		{"want " + ZeroHash + "\n", "0032want " + ZeroHash + "\n"},
+		{strings.Repeat("x", 65516), "fff0" + strings.Repeat("x", 65516)},
+	}
+	for _, test := range tests {
+		if got := encodePktLine(test.data); got != test.want {
+			t.Errorf("encodePktLine(%.20q) = %.20q, want %.20q", test.data, got, test.want)
+		}
+	}
+}
+
+func TestPktLineReader(t *testing.T) {
+	stream := encodePktLine("first\n") + encodePktLine("second") + flushPkt + "0001" + encodePktLine("") + encodePktLine("binary\x00\xff")
+	reader := newPktLineReader(strings.NewReader(stream))
+
+	tests := []struct {
+		size    int
+		payload string
+	}{
+		{10, "first\n"},
+		{10, "second"},
+		{0, ""},
+		{1, ""},
+		{4, ""},
+		{12, "binary\x00\xff"},
+	}
+	for _, test := range tests {
+		size, payload, err := reader.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %s", err)
+		}
+		if size != test.size || string(payload) != test.payload {
+			t.Fatalf("readPacket = %d, %q, want %d, %q", size, payload, test.size, test.payload)
+		}
+	}
+	if _, _, err := reader.readPacket(); err != io.EOF {
+		t.Fatalf("readPacket at the end = %v, want EOF", err)
+	}
+
+	reader = newPktLineReader(strings.NewReader(encodePktLine("line\n") + flushPkt))
+	if line, err := reader.readLine(); err != nil || string(line) != "line" {
+		t.Fatalf("readLine = %q, %v, want \"line\"", line, err)
+	}
+	if line, err := reader.readLine(); err != nil || line != nil {
+		t.Fatalf("readLine at a flush = %q, %v, want nil", line, err)
+	}
+}
+
+func TestPktLineReaderRefusesBadPackets(t *testing.T) {
+	for _, stream := range []string{"00", "zzzz", "0009abc", "000aab"} {
+		if _, _, err := newPktLineReader(strings.NewReader(stream)).readPacket(); err == nil || err == io.EOF {
+			t.Errorf("readPacket(%q) = %v, want an error", stream, err)
+		}
+	}
+}
+
+func TestSidebandRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, packetSize := range []int{6, 1000, 65520} {
+		var framed bytes.Buffer
+		fmt.Fprint(&framed, encodePktLine("\x02Counting objects\r"))
+		n, err := newSidebandWriter(&framed, sidebandData, packetSize).Write(data)
+		if err != nil || n != len(data) {
+			t.Fatalf("Write = %d, %v, want %d", n, err, len(data))
+		}
+		fmt.Fprint(&framed, encodePktLine("\x02done.\n"))
+		fmt.Fprint(&framed, flushPkt)
+
+		// Every data packet has to fit the negotiated size
+		packets := newPktLineReader(bytes.NewReader(framed.Bytes()))
+		for {
+			size, payload, err := packets.readPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size < 4 {
+				break
+			}
+			if payload[0] == sidebandData && size > packetSize {
+				t.Fatalf("packet of %d bytes with a packet size of %d", size, packetSize)
+			}
+		}
+
+		var progress bytes.Buffer
+		got, err := demuxSideband(newPktLineReader(bytes.NewReader(framed.Bytes())), &progress)
+		if err != nil {
+			t.Fatalf("demuxSideband: %s", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("demuxSideband gave %d bytes, want %d", len(got), len(data))
+		}
+		if !strings.Contains(progress.String(), "done.") {
+			t.Errorf("progress = %q, want the server's messages", progress.String())
+		}
+	}
+}
+
+func TestSidebandErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		{"error channel", encodePktLine("\x01PACK") + encodePktLine("\x03access denied\n"), "remote error: access denied"},
+		{"ERR packet", encodePktLine("ERR no such repository\n"), "remote error: no such repository"},
+		{"unknown channel", encodePktLine("\x07data"), "invalid side-band channel 7"},
+		{"hang up", encodePktLine("\x01PACK") + "00", "remote end hung up unexpectedly"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := demuxSideband(newPktLineReader(strings.NewReader(test.stream)), io.Discard)
+			if err == nil || err.Error() != test.want {
+				t.Fatalf("demuxSideband error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const delimPkt = "0001"
+
+var fetchV2Arguments = []string{"thin-pack", "ofs-delta", "include-tag"}
+
+func isProtocolV2(packLines [][]byte) bool {
+	for _, line := range packLines {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return string(line) == "version 2"
+	}
+	return false
+}
+
+func parseV2CapabilityAdvertisement(packLines [][]byte) *refAdvertisement {
+	advertisement := &refAdvertisement{version: 2, symrefs: make(map[string]string)}
+	for _, line := range packLines {
+		if len(line) == 0 || line[0] == '#' || string(line) == "version 2" {
+			continue
+		}
+		advertisement.capabilities = append(advertisement.capabilities, string(line))
+	}
+	return advertisement
+}
+
+// hasV2Feature reports whether a v2 command advertises feature, as in
+// "fetch=shallow filter".
+func (a *refAdvertisement) hasV2Feature(command, feature string) bool {
+	for _, capability := range a.capabilities {
+		name, value, _ := strings.Cut(capability, "=")
+		if name != command {
+			continue
+		}
+		for _, candidate := range strings.Fields(value) {
+			if candidate == feature {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func buildCommandRequest(command string, arguments []string) []byte {
+	var request bytes.Buffer
+	request.WriteString(encodePktLine(fmt.Sprintf("command=%s\n", command)))
+	request.WriteString(delimPkt)
+	for _, argument := range arguments {
+		request.WriteString(encodePktLine(argument + "\n"))
+	}
+	request.WriteString(flushPkt)
+	return request.Bytes()
+}
+
+// listRefs runs the ls-refs command, limited to refs under refPrefixes.
+func (a *refAdvertisement) listRefs(conn serviceConn, refPrefixes []string) error {
+	arguments := []string{"peel", "symrefs"}
+	for _, prefix := range refPrefixes {
+		arguments = append(arguments, "ref-prefix "+prefix)
+	}
+
+	response, err := conn.roundTrip(bytes.NewReader(buildCommandRequest("ls-refs", arguments)))
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+
+	reader := newPktLineReader(response)
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return fmt.Errorf("reading ls-refs response: %s", err)
+		}
+		if line == nil {
+			return nil
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) < 2 || ValidateHash(fields[0]) != nil {
+			return fmt.Errorf("invalid ls-refs line: %q", line)
+		}
+
+		a.refs = append(a.refs, Ref{Hash: fields[0], Name: fields[1]})
+		for _, attribute := range fields[2:] {
+			if strings.HasPrefix(attribute, "symref-target:") {
+				a.symrefs[fields[1]] = strings.TrimPrefix(attribute, "symref-target:")
+			} else if strings.HasPrefix(attribute, "peeled:") {
+				a.refs = append(a.refs, Ref{Hash: strings.TrimPrefix(attribute, "peeled:"), Name: fields[1] + "^{}"})
+			}
+		}
+	}
+}
+
+func buildFetchV2Request(wants []string, extraArguments []string, haves []string, done bool) []byte {
+	arguments := append([]string{}, fetchV2Arguments...)
+	for _, want := range wants {
+		arguments = append(arguments, "want "+want)
+	}
+	arguments = append(arguments, extraArguments...)
+	for _, have := range haves {
+		arguments = append(arguments, "have "+have)
+	}
+	if done {
+		arguments = append(arguments, "done")
+	}
+	return buildCommandRequest("fetch", arguments)
+}
+
+// fetchResponse is what a fetch request yields: the server's
+// acknowledgements, any shallow boundary changes and, once negotiation is
+// over, the packfile stream.
+type fetchResponse struct {
+	acks     []acknowledgement
+	shallow  *shallowInfo
+	packfile io.Reader
+}
+
+// readFetchV2Response parses the sections of a v2 fetch response up to the
+// packfile. The packfile is nil when the server expects another negotiation
+// round.
+func readFetchV2Response(reader *pktLineReader) (*fetchResponse, error) {
+	response := &fetchResponse{}
+	for {
+		header, err := reader.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("reading fetch response: %s", err)
+		}
+
+		switch string(header) {
+		case "acknowledgments":
+			var more bool
+			response.acks, more, err = readV2Acknowledgements(reader)
+			if err != nil {
+				return nil, err
+			}
+			if !more {
+				return response, nil
+			}
+		case "shallow-info":
+			response.shallow, err = readShallowInfo(reader)
+			if err != nil {
+				return nil, err
+			}
+		case "wanted-refs", "packfile-uris":
+			if err := skipV2Section(reader); err != nil {
+				return nil, err
+			}
+		case "packfile":
+			response.packfile = readSidebandPack(reader)
+			return response, nil
+		default:
+			if strings.HasPrefix(string(header), "ERR ") {
+				return nil, fmt.Errorf("remote error: %s", header[4:])
+			}
+			return nil, fmt.Errorf("unexpected fetch response section: %q", header)
+		}
+	}
+}
+
+// readV2Acknowledgements reads the acknowledgments section and reports
+// whether further sections follow.
+func readV2Acknowledgements(reader *pktLineReader) ([]acknowledgement, bool, error) {
+	var acks []acknowledgement
+	for {
+		size, payload, err := reader.readPacket()
+		if err != nil {
+			return nil, false, fmt.Errorf("reading acknowledgments: %s", err)
+		}
+		if size == 0 {
+			return acks, false, nil
+		}
+		if size == 1 {
+			return acks, true, nil
+		}
+
+		fields := strings.Fields(string(payload))
+		switch {
+		case len(fields) == 1 && fields[0] == "NAK":
+		case len(fields) == 1 && fields[0] == "ready":
+			acks = append(acks, acknowledgement{status: "ready"})
+		case len(fields) == 2 && fields[0] == "ACK":
+			acks = append(acks, acknowledgement{hash: fields[1], status: "common"})
+		default:
+			return nil, false, fmt.Errorf("unexpected acknowledgment line: %q", payload)
+		}
+	}
+}
+
+func skipV2Section(reader *pktLineReader) error {
+	for {
+		size, _, err := reader.readPacket()
+		if err != nil {
+			return err
+		}
+		if size == 1 {
+			return nil
+		}
+		if size == 0 {
+			return fmt.Errorf("unexpected end of fetch response")
+		}
+	}
+}
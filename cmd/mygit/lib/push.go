@@ -0,0 +1,464 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type PushOptions struct {
+	Remote         string
+	Refspecs       []string
+	Force          bool
+	ForceWithLease bool
+	// Lease optionally narrows --force-with-lease to "<ref>[:<expect>]"
+	Lease string
+}
+
+type pushUpdate struct {
+	src     string
+	dst     string
+	oldHash string
+	newHash string
+	force   bool
+	flag    byte
+	summary string
+	reason  string
+}
+
+var pushCapabilities = []string{"report-status", "delete-refs", "ofs-delta"}
+
+func PushRemote(options PushOptions) error {
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return err
+	}
+
+	remote := options.Remote
+	if remote == "" {
+		remote = defaultRemote(config)
+	}
+
+	url, ok := config.Get(fmt.Sprintf("remote.%s.url", remote))
+	if !ok {
+		if !strings.ContainsAny(remote, "/:") {
+			return fmt.Errorf("'%s' does not appear to be a git repository", remote)
+		}
+		url = remote
+	}
+
+	specs := options.Refspecs
+	if len(specs) == 0 {
+		branch, err := ReadSymbolicRef("HEAD")
+		if err != nil {
+			return err
+		}
+		if branch == "" {
+			return fmt.Errorf("you are not currently on a branch")
+		}
+		specs = []string{branch}
+	}
+
+	remoteTransport, err := openTransport(url)
+	if err != nil {
+		return err
+	}
+	defer remoteTransport.close()
+	advertisement, err := remoteTransport.discoverRefs(ReceivePackService, nil)
+	if err != nil {
+		return err
+	}
+
+	updates, err := resolvePushRefspecs(specs, options.Force)
+	if err != nil {
+		return err
+	}
+
+	var pending []*pushUpdate
+	for _, update := range updates {
+		update.oldHash = ZeroHash
+		if hash, ok := advertisement.lookup(update.dst); ok {
+			update.oldHash = hash
+		}
+		if err := checkPushUpdate(update, advertisement, options, config, remote); err != nil {
+			return err
+		}
+		if update.flag != '=' && update.flag != '!' {
+			pending = append(pending, update)
+		}
+	}
+
+	if len(pending) > 0 {
+		err = remoteTransport.sendPack(advertisement, pending)
+		if err != nil {
+			return err
+		}
+	}
+
+	return reportPushResults(url, config, remote, updates)
+}
+
+func resolvePushRefspecs(specs []string, force bool) ([]*pushUpdate, error) {
+	var updates []*pushUpdate
+	for _, spec := range specs {
+		specForce := force
+		if strings.HasPrefix(spec, "+") {
+			specForce = true
+			spec = spec[1:]
+		}
+
+		if strings.HasPrefix(spec, ":") {
+			dst := expandPushDestination(spec[1:], "")
+			updates = append(updates, &pushUpdate{dst: dst, newHash: ZeroHash, force: specForce})
+			continue
+		}
+
+		refspec, err := ParseRefspec(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if refspec.IsGlob() {
+			refs, err := ListRefs("refs/")
+			if err != nil {
+				return nil, err
+			}
+			for _, ref := range refs {
+				if dst, ok := refspec.MatchSource(ref.Name); ok {
+					updates = append(updates, &pushUpdate{src: ref.Name, dst: dst, newHash: ref.Hash, force: specForce})
+				}
+			}
+			continue
+		}
+
+		src, hash, err := resolvePushSource(refspec.Src)
+		if err != nil {
+			return nil, err
+		}
+		dst := refspec.Dst
+		if dst == "" {
+			if src == "" {
+				return nil, fmt.Errorf("destination required when pushing %s", refspec.Src)
+			}
+			dst = src
+		}
+		updates = append(updates, &pushUpdate{src: src, dst: expandPushDestination(dst, src), newHash: hash, force: specForce})
+	}
+	return updates, nil
+}
+
+func resolvePushSource(name string) (string, string, error) {
+	for _, candidate := range expandRefName(name) {
+		hash, err := ResolveRef(candidate)
+		if err != nil {
+			return "", "", err
+		}
+		if hash != "" {
+			if candidate == "HEAD" {
+				if branch, _ := ReadSymbolicRef("HEAD"); branch != "" {
+					return branch, hash, nil
+				}
+			}
+			return candidate, hash, nil
+		}
+	}
+	if ValidateHash(name) == nil && ObjectExists(name) {
+		return "", name, nil
+	}
+	return "", "", fmt.Errorf("src refspec %s does not match any", name)
+}
+
+func expandPushDestination(dst, src string) string {
+	if strings.HasPrefix(dst, "refs/") {
+		return dst
+	}
+	if strings.HasPrefix(src, "refs/tags/") {
+		return "refs/tags/" + dst
+	}
+	return "refs/heads/" + dst
+}
+
+// checkPushUpdate classifies an update, rejecting non-fast-forwards unless
+// forced and enforcing --force-with-lease expectations, which hold for
+// creating and deleting refs too.
+func checkPushUpdate(update *pushUpdate, advertisement *refAdvertisement, options PushOptions, config *Config, remote string) error {
+	if update.newHash == ZeroHash && !advertisement.hasCapability("delete-refs") {
+		update.flag, update.summary, update.reason = '!', "[rejected]", "remote does not support deleting refs"
+		return nil
+	}
+
+	if update.newHash != ZeroHash && update.oldHash == update.newHash {
+		update.flag, update.summary = '=', "[up to date]"
+		return nil
+	}
+
+	forced := update.force
+	if options.ForceWithLease && leaseApplies(options.Lease, update.dst) {
+		expected, err := leaseExpectation(options.Lease, update.dst, config, remote)
+		if err != nil {
+			return err
+		}
+		if expected != update.oldHash {
+			update.flag, update.summary, update.reason = '!', "[rejected]", "stale info"
+			return nil
+		}
+		forced = true
+	}
+
+	if update.newHash == ZeroHash {
+		if update.oldHash == ZeroHash {
+			update.flag, update.summary, update.reason = '!', "[rejected]", "remote ref does not exist"
+		} else {
+			update.flag, update.summary = '-', "[deleted]"
+		}
+		return nil
+	}
+
+	if update.oldHash == ZeroHash {
+		update.flag = '*'
+		switch {
+		case strings.HasPrefix(update.dst, "refs/tags/"):
+			update.summary = "[new tag]"
+		case strings.HasPrefix(update.dst, "refs/heads/"):
+			update.summary = "[new branch]"
+		default:
+			update.summary = "[new reference]"
+		}
+		return nil
+	}
+
+	fastForward := false
+	if ObjectExists(update.oldHash) && !strings.HasPrefix(update.dst, "refs/tags/") {
+		var err error
+		fastForward, err = IsAncestor(update.oldHash, update.newHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case fastForward:
+		update.flag, update.summary = ' ', fmt.Sprintf("%s..%s", update.oldHash[:7], update.newHash[:7])
+	case forced:
+		update.flag, update.summary, update.reason = '+', fmt.Sprintf("%s...%s", update.oldHash[:7], update.newHash[:7]), "forced update"
+	case strings.HasPrefix(update.dst, "refs/tags/"):
+		update.flag, update.summary, update.reason = '!', "[rejected]", "already exists"
+	case !ObjectExists(update.oldHash):
+		update.flag, update.summary, update.reason = '!', "[rejected]", "fetch first"
+	default:
+		update.flag, update.summary, update.reason = '!', "[rejected]", "non-fast-forward"
+	}
+	return nil
+}
+
+func leaseApplies(lease, dst string) bool {
+	if lease == "" {
+		return true
+	}
+	ref, _, _ := strings.Cut(lease, ":")
+	for _, candidate := range expandRefName(ref) {
+		if candidate == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseExpectation returns the value the remote ref must still have: the
+// explicit expectation if given, otherwise our remote-tracking ref.
+func leaseExpectation(lease, dst string, config *Config, remote string) (string, error) {
+	if _, expect, found := strings.Cut(lease, ":"); found {
+		if ValidateHash(expect) == nil {
+			return expect, nil
+		}
+		_, hash, err := resolvePushSource(expect)
+		return hash, err
+	}
+
+	trackingRef := remoteTrackingRef(config, remote, dst)
+	if trackingRef == "" {
+		return ZeroHash, nil
+	}
+	hash, err := ResolveRef(trackingRef)
+	if err != nil || hash == "" {
+		return ZeroHash, err
+	}
+	return hash, nil
+}
+
+func remoteTrackingRef(config *Config, remote, name string) string {
+	for _, spec := range config.GetAll(fmt.Sprintf("remote.%s.fetch", remote)) {
+		refspec, err := ParseRefspec(spec)
+		if err != nil {
+			continue
+		}
+		if localName, ok := refspec.MatchSource(name); ok && localName != "" {
+			return localName
+		}
+	}
+	return ""
+}
+
+func sendPushUpdates(conn serviceConn, advertisement *refAdvertisement, updates []*pushUpdate) error {
+	capabilities := advertisement.requestCapabilities(pushCapabilities)
+	sideband := advertisement.sidebandCapability()
+	if sideband != "" {
+		capabilities = append(capabilities, sideband)
+	}
+
+	var commands bytes.Buffer
+	var newHashes []string
+	for i, update := range updates {
+		command := fmt.Sprintf("%s %s %s", update.oldHash, update.newHash, update.dst)
+		if i == 0 && len(capabilities) > 0 {
+			command += "\x00" + strings.Join(capabilities, " ")
+		}
+		commands.WriteString(encodePktLine(command + "\n"))
+		if update.newHash != ZeroHash {
+			newHashes = append(newHashes, update.newHash)
+		}
+	}
+	commands.WriteString(flushPkt)
+
+	var request io.Reader = bytes.NewReader(commands.Bytes())
+	if len(newHashes) > 0 {
+		var exclude []string
+		for _, ref := range advertisement.refs {
+			if ObjectExists(ref.Hash) {
+				exclude = append(exclude, ref.Hash)
+			}
+		}
+
+		objects, err := listObjects(newHashes, exclude)
+		if err != nil {
+			return err
+		}
+		// The pack is written as it is sent rather than held in memory
+		packReader, packWriter := io.Pipe()
+		go func() {
+			_, err := writePackStream(packWriter, objects, defaultPackOptions(advertisement.hasCapability("ofs-delta")))
+			packWriter.CloseWithError(err)
+		}()
+		defer packReader.Close()
+		request = io.MultiReader(request, packReader)
+	}
+
+	response, err := conn.roundTrip(request)
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+
+	if !advertisement.hasCapability("report-status") {
+		return nil
+	}
+
+	reader := newPktLineReader(response)
+	if sideband != "" {
+		// The status report is itself pkt-line framed inside channel 1
+		body, err := demuxSideband(reader, os.Stderr)
+		if err != nil {
+			return err
+		}
+		reader = newPktLineReader(bytes.NewReader(body))
+	}
+	return applyReportStatus(reader, updates)
+}
+
+// applyReportStatus reads the server's report-status and marks the updates
+// it refused.
+func applyReportStatus(reader *pktLineReader, updates []*pushUpdate) error {
+	line, err := reader.readLine()
+	if err != nil {
+		return fmt.Errorf("reading push status: %s", err)
+	}
+	if !strings.HasPrefix(string(line), "unpack ") {
+		return fmt.Errorf("unexpected push status line: %q", line)
+	}
+	unpackStatus := strings.TrimPrefix(string(line), "unpack ")
+
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return fmt.Errorf("reading push status: %s", err)
+		}
+		if line == nil {
+			break
+		}
+
+		status, rest, _ := strings.Cut(string(line), " ")
+		refName, reason, _ := strings.Cut(rest, " ")
+		for _, update := range updates {
+			if update.dst != refName {
+				continue
+			}
+			if status == "ng" {
+				update.flag, update.summary, update.reason = '!', "[remote rejected]", reason
+			} else if unpackStatus != "ok" {
+				update.flag, update.summary, update.reason = '!', "[remote rejected]", "unpacker error"
+			}
+		}
+	}
+
+	if unpackStatus != "ok" {
+		return fmt.Errorf("remote unpack failed: %s", unpackStatus)
+	}
+	return nil
+}
+
+func reportPushResults(url string, config *Config, remote string, updates []*pushUpdate) error {
+	var rejected, changed bool
+
+	for _, update := range updates {
+		if update.flag == '=' {
+			continue
+		}
+		if !changed {
+			fmt.Fprintf(os.Stderr, "To %s\n", url)
+			changed = true
+		}
+
+		src := ShortRefName(update.src)
+		if src == "" {
+			src = update.newHash[:7]
+		}
+
+		line := fmt.Sprintf(" %c %-17s ", update.flag, update.summary)
+		if update.newHash == ZeroHash {
+			line += ShortRefName(update.dst)
+		} else {
+			line += fmt.Sprintf("%s -> %s", src, ShortRefName(update.dst))
+		}
+		if update.reason != "" {
+			line += fmt.Sprintf(" (%s)", update.reason)
+		}
+		fmt.Fprintln(os.Stderr, line)
+
+		if update.flag == '!' {
+			rejected = true
+			continue
+		}
+
+		if trackingRef := remoteTrackingRef(config, remote, update.dst); trackingRef != "" {
+			var err error
+			if update.newHash == ZeroHash {
+				err = DeleteRef(trackingRef)
+			} else {
+				err = UpdateRef(trackingRef, update.newHash)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !changed {
+		fmt.Fprintln(os.Stderr, "Everything up-to-date")
+	}
+	if rejected {
+		return fmt.Errorf("failed to push some refs to '%s'", url)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	neturl "net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newPushTest clones a repository served by ServeRepositories, leaving the
+// clone as the current repository, and returns the server's repository
+// and the tip of its main branch.
+func newPushTest(t *testing.T) (string, string) {
+	t.Helper()
+	isolateTest(t)
+	dir := t.TempDir()
+
+	serverDir := filepath.Join(dir, "server.git")
+	initTestRepository(t, serverDir)
+	tip := newTestHistory(t, 3)
+	SetGitDir(DefaultGitDir)
+	url := startTestServer(t, []string{serverDir}, ServeOptions{})
+
+	CloneRepository(url+"/server.git", filepath.Join(dir, "client"), CloneOptions{})
+	return serverDir, tip
+}
+
+func serverRef(t *testing.T, serverDir, name string) string {
+	t.Helper()
+	var hash string
+	err := withGitDir(serverDir, func() error {
+		var err error
+		hash, err = ResolveRef(name)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPushFastForward(t *testing.T) {
+	serverDir, tip := newPushTest(t)
+
+	pushed := writeTestCommit(t, "pushed\n", tip)
+	if err := UpdateRef("refs/heads/main", pushed); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushRemote(PushOptions{Remote: DefaultRemoteName}); err != nil {
+		t.Fatalf("PushRemote: %s", err)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != pushed {
+		t.Fatalf("server main = %s, want %s", head, pushed)
+	}
+	if remote, err := ResolveRef("refs/remotes/origin/main"); err != nil || remote != pushed {
+		t.Fatalf("refs/remotes/origin/main = %s, %v, want %s", remote, err, pushed)
+	}
+	if err := withGitDir(serverDir, func() error { _, err := ReadCommit(pushed); return err }); err != nil {
+		t.Fatalf("server cannot read the pushed commit: %s", err)
+	}
+
+	// Creating and deleting branches
+	if err := PushRemote(PushOptions{Remote: DefaultRemoteName, Refspecs: []string{"main:topic"}}); err != nil {
+		t.Fatalf("PushRemote main:topic: %s", err)
+	}
+	if topic := serverRef(t, serverDir, "refs/heads/topic"); topic != pushed {
+		t.Fatalf("server topic = %s, want %s", topic, pushed)
+	}
+	if err := PushRemote(PushOptions{Remote: DefaultRemoteName, Refspecs: []string{":topic"}}); err != nil {
+		t.Fatalf("PushRemote :topic: %s", err)
+	}
+	if topic := serverRef(t, serverDir, "refs/heads/topic"); topic != "" {
+		t.Fatalf("server topic = %s after deleting it", topic)
+	}
+}
+
+func TestPushRefusesNonFastForward(t *testing.T) {
+	serverDir, tip := newPushTest(t)
+
+	commit, err := ReadCommit(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := writeTestCommit(t, "rewritten\n", commit.Parents...)
+	if err := UpdateRef("refs/heads/main", rewritten); err != nil {
+		t.Fatal(err)
+	}
+
+	err = PushRemote(PushOptions{Remote: DefaultRemoteName})
+	if err == nil || !strings.Contains(err.Error(), "failed to push some refs") {
+		t.Fatalf("PushRemote = %v, want a rejection", err)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != tip {
+		t.Fatalf("server main = %s after a rejected push, want %s", head, tip)
+	}
+
+	for _, options := range []PushOptions{
+		{Remote: DefaultRemoteName, Refspecs: []string{"+main"}},
+		{Remote: DefaultRemoteName, Force: true},
+	} {
+		if err := UpdateRef("refs/remotes/origin/main", tip); err != nil {
+			t.Fatal(err)
+		}
+		if err := withGitDir(serverDir, func() error { return UpdateRef("refs/heads/main", tip) }); err != nil {
+			t.Fatal(err)
+		}
+		if err := PushRemote(options); err != nil {
+			t.Fatalf("PushRemote(%+v): %s", options, err)
+		}
+		if head := serverRef(t, serverDir, "refs/heads/main"); head != rewritten {
+			t.Fatalf("server main = %s after a forced push, want %s", head, rewritten)
+		}
+	}
+}
+
+func TestPushUpToDate(t *testing.T) {
+	serverDir, tip := newPushTest(t)
+	if err := PushRemote(PushOptions{Remote: DefaultRemoteName}); err != nil {
+		t.Fatalf("PushRemote: %s", err)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != tip {
+		t.Fatalf("server main = %s, want %s", head, tip)
+	}
+}
+
+func TestPushWithLease(t *testing.T) {
+	serverDir, tip := newPushTest(t)
+	commit, err := ReadCommit(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := writeTestCommit(t, "rewritten\n", commit.Parents...)
+	if err := UpdateRef("refs/heads/main", rewritten); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else's commit, in both repositories so either may point at it
+	theirs := writeTestCommit(t, "theirs\n", tip)
+	withGitDir(serverDir, func() error {
+		writeTestCommit(t, "theirs\n", tip)
+		return nil
+	})
+	setServerRef := func(name, hash string) {
+		t.Helper()
+		if err := withGitDir(serverDir, func() error { return UpdateRef(name, hash) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options PushOptions
+		ref     string
+		before  string
+		want    string
+	}{
+		{"tracking ref current", PushOptions{Refspecs: []string{"main"}}, "refs/heads/main", tip, rewritten},
+		{"tracking ref stale", PushOptions{Refspecs: []string{"main"}}, "refs/heads/main", theirs, theirs},
+		{"explicit expectation", PushOptions{Refspecs: []string{"main"}, Lease: "main:" + theirs}, "refs/heads/main", theirs, rewritten},
+		{"lease on another ref", PushOptions{Refspecs: []string{"main"}, Lease: "other:" + tip}, "refs/heads/main", theirs, theirs},
+		// Creating and deleting refs are held to the lease too
+		{"create where a ref appeared", PushOptions{Refspecs: []string{"main:other"}}, "refs/heads/other", theirs, theirs},
+		{"create expecting a ref", PushOptions{Refspecs: []string{"main:created"}, Lease: "created:" + tip}, "refs/heads/created", "", ""},
+		{"create expecting none", PushOptions{Refspecs: []string{"main:created"}, Lease: "created:" + ZeroHash}, "refs/heads/created", "", rewritten},
+		{"delete unseen ref", PushOptions{Refspecs: []string{":other"}}, "refs/heads/other", theirs, theirs},
+		{"delete expected ref", PushOptions{Refspecs: []string{":other"}, Lease: "other:" + theirs}, "refs/heads/other", theirs, ""},
+	}
+	for _, test := range tests {
+		if test.before != "" {
+			setServerRef(test.ref, test.before)
+		}
+		if err := UpdateRef("refs/remotes/origin/main", tip); err != nil {
+			t.Fatal(err)
+		}
+		test.options.Remote = DefaultRemoteName
+		test.options.ForceWithLease = true
+
+		err := PushRemote(test.options)
+		if got := serverRef(t, serverDir, test.ref); got != test.want {
+			t.Errorf("%s: server %s = %q, want %q", test.name, test.ref, got, test.want)
+		}
+		if rejected := test.want == test.before; rejected != (err != nil) {
+			t.Errorf("%s: PushRemote = %v", test.name, err)
+		}
+	}
+}
+
+func TestPushRefusesDeletesUnlessAdvertised(t *testing.T) {
+	update := &pushUpdate{dst: "refs/heads/topic", oldHash: strings.Repeat("1", 40), newHash: ZeroHash}
+	advertisement := &refAdvertisement{capabilities: []string{"report-status"}}
+	if err := checkPushUpdate(update, advertisement, PushOptions{}, &Config{}, DefaultRemoteName); err != nil {
+		t.Fatal(err)
+	}
+	if update.flag != '!' || update.reason != "remote does not support deleting refs" {
+		t.Fatalf("update flagged %q (%s), want a rejection", update.flag, update.reason)
+	}
+
+	update.flag, update.reason = 0, ""
+	advertisement.capabilities = append(advertisement.capabilities, "delete-refs")
+	if err := checkPushUpdate(update, advertisement, PushOptions{}, &Config{}, DefaultRemoteName); err != nil {
+		t.Fatal(err)
+	}
+	if update.flag != '-' {
+		t.Fatalf("update flagged %q (%s), want a deletion", update.flag, update.reason)
+	}
+}
+
+// TestPushStreamsPack pushes through a proxy that lets anyone read but
+// wants credentials for pushes, so the pack is only sent after an empty
+// probe has found that out.
+func TestPushStreamsPack(t *testing.T) {
+	serverDir, tip := newPushTest(t)
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, _ := config.Get("remote.origin.url")
+	target, err := neturl.Parse(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var posts []string
+	proxy := httputil.NewSingleHostReverseProxy(&neturl.URL{Scheme: target.Scheme, Host: target.Host})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			username, password, ok := r.BasicAuth()
+			mu.Lock()
+			posts = append(posts, fmt.Sprintf("%s %d %v", username, r.ContentLength, r.TransferEncoding))
+			mu.Unlock()
+			if !ok || username != "alice" || password != "secret" {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	pushed := writeTestCommit(t, "streamed\n", tip)
+	if err := UpdateRef("refs/heads/main", pushed); err != nil {
+		t.Fatal(err)
+	}
+	pushURL := strings.Replace(server.URL, "http://", "http://alice:secret@", 1) + target.Path
+	if err := PushRemote(PushOptions{Remote: pushURL, Refspecs: []string{"main"}}); err != nil {
+		t.Fatalf("PushRemote: %s", err)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != pushed {
+		t.Fatalf("server main = %s, want %s", head, pushed)
+	}
+
+	want := []string{" 4 []", "alice 4 []", "alice -1 [chunked]"}
+	if strings.Join(posts, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("POST requests %q, want the probe then the streamed pack %q", posts, want)
+	}
+}
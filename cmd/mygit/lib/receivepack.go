@@ -0,0 +1,528 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// receivePackCapabilities are advertised to pushing clients.
+var receivePackCapabilities = []string{
+	"report-status", "delete-refs", "side-band-64k", "atomic", "ofs-delta",
+	"object-format=sha1", serverAgent,
+}
+
+// ReceivePackOptions selects how receive-pack talks to its client.
+type ReceivePackOptions struct {
+	// StatelessRPC serves a single request without an advertisement, as
+	// over smart HTTP
+	StatelessRPC bool
+	// AdvertiseRefs only writes the advertisement
+	AdvertiseRefs bool
+}
+
+// ReceivePack serves a push to the repository at dir: it advertises the
+// refs, quarantines the pack the client sends, runs the pre-receive, update
+// and post-receive hooks and updates the refs the hooks accepted, moving the
+// pack into the repository first.
+func ReceivePack(dir string, r io.Reader, w io.Writer, options ReceivePackOptions) error {
+	gitDir, err := findGitDir(dir)
+	if err != nil {
+		return err
+	}
+	return withGitDir(gitDir, func() error {
+		out := bufio.NewWriter(w)
+		err := serveReceivePack(newPktLineReader(r), out, options)
+		if flushErr := out.Flush(); err == nil {
+			err = flushErr
+		}
+		return err
+	})
+}
+
+func serveReceivePack(reader *pktLineReader, w *bufio.Writer, options ReceivePackOptions) error {
+	if !options.StatelessRPC || options.AdvertiseRefs {
+		// Pushes are always spoken in protocol v0
+		refs, err := ListRefs("refs/")
+		if err != nil {
+			return err
+		}
+		advertisement := &refAdvertisement{refs: refs}
+		writeV0Advertisement(w, advertisement, receivePackCapabilities)
+		if options.AdvertiseRefs {
+			return nil
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	session := &receivePackSession{out: w, progress: os.Stderr}
+	if err := session.readCommands(reader); err != nil {
+		fmt.Fprint(w, encodePktLine(fmt.Sprintf("ERR receive-pack: %s\n", err)))
+		return err
+	}
+	if len(session.commands) == 0 {
+		return nil
+	}
+	if session.sidebandSize > 0 {
+		session.progress = newSidebandWriter(w, sidebandProgress, session.sidebandSize)
+	}
+
+	defer session.dropQuarantine()
+	unpackErr := session.receivePack(reader.r)
+	if unpackErr != nil {
+		for _, command := range session.commands {
+			command.reason = "unpacker error"
+		}
+	} else {
+		session.updateRefs()
+	}
+
+	if session.reportStatus {
+		if err := session.report(unpackErr); err != nil {
+			return err
+		}
+	}
+	return unpackErr
+}
+
+// receiveCommand is one ref update a client asked for.
+type receiveCommand struct {
+	oldHash string
+	newHash string
+	name    string
+	// reason tells the client why the update was refused; it is empty
+	// while the update can go ahead
+	reason string
+}
+
+type receivePackSession struct {
+	commands     []*receiveCommand
+	reportStatus bool
+	atomic       bool
+	sidebandSize int
+	out          *bufio.Writer
+	progress     io.Writer
+	// quarantine is the object directory the pushed objects are kept in
+	// until the push is accepted
+	quarantine string
+}
+
+// readCommands reads the client's ref update commands up to a flush packet,
+// taking its capabilities from the first.
+func (s *receivePackSession) readCommands(reader *pktLineReader) error {
+	for {
+		line, err := reader.readLine()
+		if err == io.EOF && len(s.commands) == 0 {
+			// The client found nothing to push
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading commands: %s", err)
+		}
+		if line == nil {
+			return nil
+		}
+
+		command, capabilities, found := strings.Cut(string(line), "\x00")
+		if found && len(s.commands) == 0 {
+			s.setCapabilities(strings.Fields(capabilities))
+		}
+		if strings.HasPrefix(command, "shallow ") {
+			return fmt.Errorf("pushing from a shallow repository is not supported")
+		}
+
+		fields := strings.Split(command, " ")
+		if len(fields) != 3 || ValidateHash(fields[0]) != nil || ValidateHash(fields[1]) != nil {
+			return fmt.Errorf("protocol error: expected old/new/ref, got '%s'", command)
+		}
+		s.commands = append(s.commands, &receiveCommand{oldHash: fields[0], newHash: fields[1], name: fields[2]})
+	}
+}
+
+func (s *receivePackSession) setCapabilities(capabilities []string) {
+	for _, capability := range capabilities {
+		switch capability {
+		case "report-status":
+			s.reportStatus = true
+		case "atomic":
+			s.atomic = true
+		case "side-band-64k":
+			s.sidebandSize = sideband64kPacketSize
+		}
+	}
+}
+
+// receivePack stores the pack that follows the commands in a quarantine
+// directory, where its objects can be checked without anyone else seeing
+// them. Clients that only delete refs send none.
+func (s *receivePackSession) receivePack(r io.Reader) error {
+	for _, command := range s.commands {
+		if command.newHash == ZeroHash {
+			continue
+		}
+
+		quarantine, err := os.MkdirTemp(ObjectsDir, "tmp_objdir-incoming-")
+		if err != nil {
+			return err
+		}
+		s.quarantine = quarantine
+		quarantineDir = quarantine
+		resetStoredPacks()
+
+		// The client keeps the connection open to read our report, so the
+		// pack does not end at EOF
+		pack, err := spoolPack(filepath.Join(quarantine, "pack"), r, false)
+		if err != nil {
+			return err
+		}
+		_, err = storeSpooledPack(pack)
+		return err
+	}
+	return nil
+}
+
+// migrateQuarantine moves the pushed objects into the repository. Indexes
+// go last, since they are what makes a pack visible.
+func (s *receivePackSession) migrateQuarantine() error {
+	if s.quarantine == "" {
+		return nil
+	}
+	if err := os.MkdirAll(PackDir, 0755); err != nil {
+		return err
+	}
+
+	packs, err := filepath.Glob(filepath.Join(s.quarantine, "pack", "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+	for _, pack := range packs {
+		base := strings.TrimSuffix(pack, ".pack")
+		for _, ext := range []string{".pack", ".idx"} {
+			if err := os.Rename(base+ext, filepath.Join(PackDir, filepath.Base(base)+ext)); err != nil {
+				return err
+			}
+		}
+	}
+	s.dropQuarantine()
+	return nil
+}
+
+// dropQuarantine removes the quarantine directory along with whatever is
+// left in it.
+func (s *receivePackSession) dropQuarantine() {
+	if s.quarantine == "" {
+		return
+	}
+	os.RemoveAll(s.quarantine)
+	s.quarantine = ""
+	quarantineDir = ""
+	resetStoredPacks()
+}
+
+// updateRefs checks the commands, lets the hooks veto them and applies the
+// rest. An atomic push is applied entirely or not at all.
+func (s *receivePackSession) updateRefs() {
+	existing, err := ListRefs("refs/")
+	if err != nil {
+		s.refuseAll(fmt.Sprintf("cannot read refs: %s", err))
+		return
+	}
+	var existingHashes []string
+	for _, ref := range existing {
+		existingHashes = append(existingHashes, ref.Hash)
+	}
+
+	for _, command := range s.commands {
+		command.reason = checkReceiveCommand(command, existingHashes)
+	}
+	if s.atomicFailed() {
+		return
+	}
+
+	if err := s.runHook("pre-receive", s.hookInput()); err != nil {
+		s.refuseAll("pre-receive hook declined")
+		return
+	}
+	for _, command := range s.pending() {
+		if err := s.runHook("update", "", command.name, command.oldHash, command.newHash); err != nil {
+			command.reason = "hook declined"
+		}
+	}
+	if s.atomicFailed() || len(s.pending()) == 0 {
+		return
+	}
+
+	if err := s.migrateQuarantine(); err != nil {
+		s.refuseAll("unable to migrate objects to permanent storage")
+		return
+	}
+
+	// Every ref is locked before any is updated, so that an atomic push
+	// can still back out
+	locks := make(map[*receiveCommand]*refLock)
+	for _, command := range s.pending() {
+		lock, err := lockReceiveCommand(command)
+		if err != nil {
+			command.reason = err.Error()
+			continue
+		}
+		locks[command] = lock
+	}
+	if s.atomicFailed() {
+		for _, lock := range locks {
+			lock.unlock()
+		}
+		return
+	}
+
+	var applied []*receiveCommand
+	for _, command := range s.pending() {
+		lock := locks[command]
+		delete(locks, command)
+		if err := applyReceiveCommand(command, lock); err != nil {
+			command.reason = err.Error()
+			if s.atomic {
+				for _, lock := range locks {
+					lock.unlock()
+				}
+				rollBackReceiveCommands(applied)
+				s.refuseAll("atomic transaction failed")
+				return
+			}
+			continue
+		}
+		applied = append(applied, command)
+	}
+
+	if len(applied) > 0 {
+		// The refs are already updated, so the outcome does not matter
+		s.runHook("post-receive", s.hookInput())
+	}
+}
+
+// checkReceiveCommand returns why a command cannot be applied, or "" when
+// it can. The objects it points to must be complete down to what the
+// existing refs already reach.
+func checkReceiveCommand(command *receiveCommand, existingHashes []string) string {
+	if !strings.HasPrefix(command.name, "refs/") || !checkRefFormat(command.name) {
+		return "funny refname"
+	}
+
+	current, err := ResolveRef(command.name)
+	if err != nil {
+		return "failed to lock"
+	}
+	if current == "" {
+		current = ZeroHash
+	}
+	if current != command.oldHash {
+		return "failed to lock"
+	}
+
+	if isCheckedOutBranch(command.name) {
+		config, err := ReadRepositoryConfig()
+		if err != nil {
+			return err.Error()
+		}
+		deny, _ := config.Get("receive.denyCurrentBranch")
+		if deny != "ignore" && deny != "warn" && deny != "false" {
+			return "branch is currently checked out"
+		}
+	}
+
+	if command.newHash == ZeroHash {
+		return ""
+	}
+	objects, err := listObjects([]string{command.newHash}, existingHashes)
+	if err != nil {
+		return "missing necessary objects"
+	}
+	for _, object := range objects {
+		if !ObjectExists(object.hash) {
+			return "missing necessary objects"
+		}
+	}
+	return ""
+}
+
+// isCheckedOutBranch reports whether name is the branch the working tree of
+// a non-bare repository has checked out.
+func isCheckedOutBranch(name string) bool {
+	if isBareRepository() {
+		return false
+	}
+	head, _ := ReadSymbolicRef("HEAD")
+	return head == name
+}
+
+// isBareRepository reports whether the repository has no working tree.
+func isBareRepository() bool {
+	if config, err := ReadRepositoryConfig(); err == nil {
+		if bare, ok := config.Get("core.bare"); ok {
+			return bare == "true"
+		}
+	}
+	return filepath.Base(GitDir) != DefaultGitDir
+}
+
+// lockReceiveCommand locks the ref and checks again, now that nobody else
+// can move it, that it still has the value the client expects.
+func lockReceiveCommand(command *receiveCommand) (*refLock, error) {
+	lock, err := lockRef(command.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock")
+	}
+
+	current, err := ResolveRef(command.name)
+	if current == "" {
+		current = ZeroHash
+	}
+	if err != nil || current != command.oldHash {
+		lock.unlock()
+		return nil, fmt.Errorf("failed to lock")
+	}
+	return lock, nil
+}
+
+// applyReceiveCommand updates the locked ref and releases its lock.
+func applyReceiveCommand(command *receiveCommand, lock *refLock) error {
+	var err error
+	if command.newHash == ZeroHash {
+		err = DeleteRef(command.name)
+		lock.unlock()
+	} else {
+		err = lock.commit(command.newHash)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update ref")
+	}
+	return nil
+}
+
+// rollBackReceiveCommands restores the refs a failed atomic push already
+// updated.
+func rollBackReceiveCommands(applied []*receiveCommand) {
+	for _, command := range applied {
+		if command.oldHash == ZeroHash {
+			DeleteRef(command.name)
+		} else {
+			UpdateRef(command.name, command.oldHash)
+		}
+	}
+}
+
+// pending returns the commands nothing has refused so far.
+func (s *receivePackSession) pending() []*receiveCommand {
+	var pending []*receiveCommand
+	for _, command := range s.commands {
+		if command.reason == "" {
+			pending = append(pending, command)
+		}
+	}
+	return pending
+}
+
+// refuseAll refuses every command that has not been refused already.
+func (s *receivePackSession) refuseAll(reason string) {
+	for _, command := range s.pending() {
+		command.reason = reason
+	}
+}
+
+// atomicFailed refuses the whole push once any command of an atomic push
+// has been refused, reporting whether it did.
+func (s *receivePackSession) atomicFailed() bool {
+	if !s.atomic || len(s.pending()) == len(s.commands) {
+		return false
+	}
+	s.refuseAll("atomic transaction failed")
+	return true
+}
+
+// hookInput is what pre-receive and post-receive read: one
+// "<old> <new> <ref>" line per update still going ahead.
+func (s *receivePackSession) hookInput() string {
+	var input strings.Builder
+	for _, command := range s.pending() {
+		fmt.Fprintf(&input, "%s %s %s\n", command.oldHash, command.newHash, command.name)
+	}
+	return input.String()
+}
+
+// runHook runs the named hook from the repository's hooks directory, sending
+// its output to the client. A hook that is missing or not executable
+// succeeds.
+func (s *receivePackSession) runHook(name, input string, args ...string) error {
+	gitDir, err := filepath.Abs(GitDir)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(gitDir, "hooks", name)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(path, args...)
+	// Hooks run in the working tree, or the repository itself when bare
+	cmd.Dir = gitDir
+	if !isBareRepository() {
+		cmd.Dir = filepath.Dir(gitDir)
+	}
+	cmd.Env = append(os.Environ(), "GIT_DIR="+gitDir)
+	if s.quarantine != "" {
+		// The pushed objects are only in the quarantine while hooks judge
+		// them, so point hooks there with the repository as an alternate
+		quarantine, err := filepath.Abs(s.quarantine)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env,
+			"GIT_QUARANTINE_PATH="+quarantine,
+			"GIT_OBJECT_DIRECTORY="+quarantine,
+			"GIT_ALTERNATE_OBJECT_DIRECTORIES="+filepath.Join(gitDir, "objects"),
+		)
+	}
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = s.progress
+	cmd.Stderr = s.progress
+
+	err = cmd.Run()
+	s.out.Flush()
+	return err
+}
+
+// report writes the report-status telling the client how each command
+// fared, inside side-band channel 1 when the client asked for side-band.
+func (s *receivePackSession) report(unpackErr error) error {
+	var status strings.Builder
+	if unpackErr != nil {
+		status.WriteString(encodePktLine(fmt.Sprintf("unpack %s\n", unpackErr)))
+	} else {
+		status.WriteString(encodePktLine("unpack ok\n"))
+	}
+	for _, command := range s.commands {
+		if command.reason == "" {
+			status.WriteString(encodePktLine(fmt.Sprintf("ok %s\n", command.name)))
+		} else {
+			status.WriteString(encodePktLine(fmt.Sprintf("ng %s %s\n", command.name, command.reason)))
+		}
+	}
+	status.WriteString(flushPkt)
+
+	if s.sidebandSize == 0 {
+		_, err := s.out.WriteString(status.String())
+		return err
+	}
+	if _, err := newSidebandWriter(s.out, sidebandData, s.sidebandSize).Write([]byte(status.String())); err != nil {
+		return err
+	}
+	_, err := s.out.WriteString(flushPkt)
+	return err
+}
@@ -0,0 +1,359 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPack builds a pack of raw entries, each an object header followed by
+// whatever the entry's type calls for.
+func testPack(t *testing.T, entries ...[]byte) []byte {
+	t.Helper()
+	pack := []byte("PACK")
+	pack = binary.BigEndian.AppendUint32(pack, 2)
+	pack = binary.BigEndian.AppendUint32(pack, uint32(len(entries)))
+	for _, entry := range entries {
+		pack = append(pack, entry...)
+	}
+	checksum := sha1.Sum(pack)
+	return append(pack, checksum[:]...)
+}
+
+// refDeltaEntry is a REF_DELTA pack entry holding delta against base.
+func refDeltaEntry(t *testing.T, base string, delta []byte) []byte {
+	t.Helper()
+	baseHash, err := hex.DecodeString(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := compressBytes(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := append(encodeObjectHeader(ObjRefDelta, uint64(len(delta))), baseHash...)
+	return append(entry, compressed...)
+}
+
+// receivePackRequest is a stateless push of commands, the first carrying
+// the capabilities, followed by pack.
+func receivePackRequest(commands []string, capabilities string, pack []byte) []byte {
+	var request bytes.Buffer
+	for i, command := range commands {
+		if i == 0 {
+			command += "\x00" + capabilities
+		}
+		request.WriteString(encodePktLine(command + "\n"))
+	}
+	request.WriteString(flushPkt)
+	request.Write(pack)
+	return request.Bytes()
+}
+
+func TestReceivePackRefusesMalformedDeltas(t *testing.T) {
+	isolateTest(t)
+	gitDir := filepath.Join(t.TempDir(), "repo.git")
+	initTestRepository(t, gitDir)
+	tip := newTestHistory(t, 1)
+	SetGitDir(DefaultGitDir)
+
+	for _, delta := range []string{"", "\x0a", "\x8a", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"} {
+		pack := testPack(t, refDeltaEntry(t, tip, []byte(delta)))
+		command := ZeroHash + " " + strings.Repeat("1", 40) + " refs/heads/pushed"
+		request := receivePackRequest([]string{command}, "report-status", pack)
+
+		var response bytes.Buffer
+		err := ReceivePack(gitDir, bytes.NewReader(request), &response, ReceivePackOptions{StatelessRPC: true})
+		if err == nil {
+			t.Errorf("ReceivePack accepted a pack with the delta %q", delta)
+		}
+		if !strings.Contains(response.String(), "unpack ") || strings.Contains(response.String(), "unpack ok") {
+			t.Errorf("delta %q: response %q does not report the unpack error", delta, response.String())
+		}
+	}
+
+	var pushed string
+	err := withGitDir(gitDir, func() error {
+		var err error
+		pushed, err = ResolveRef("refs/heads/pushed")
+		return err
+	})
+	if err != nil || pushed != "" {
+		t.Fatalf("refs/heads/pushed = %q, %v after refused pushes", pushed, err)
+	}
+}
+
+func TestCheckRefFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"refs/heads/main", true},
+		{"refs/heads/feature/x-1.2", true},
+		{"refs/tags/v1.0", true},
+		{"refs/heads/x.lock", false},
+		{"refs/heads/x.lock/y", false},
+		{"refs/heads/a//b", false},
+		{"refs/heads/a/", false},
+		{"/refs/heads/a", false},
+		{"refs/heads/.hidden", false},
+		{"refs/heads/a.", false},
+		{"refs/heads/a..b", false},
+		{"refs/heads/a b", false},
+		{"refs/heads/a\tb", false},
+		{"refs/heads/a\x7fb", false},
+		{"refs/heads/a~1", false},
+		{"refs/heads/a^", false},
+		{"refs/heads/a:b", false},
+		{"refs/heads/a?", false},
+		{"refs/heads/a*", false},
+		{"refs/heads/a[b", false},
+		{"refs/heads/a\\b", false},
+		{"refs/heads/a@{1}", false},
+		{"@", false},
+		{"main", false},
+	}
+	for _, test := range tests {
+		if valid := checkRefFormat(test.name); valid != test.valid {
+			t.Errorf("checkRefFormat(%q) = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+// newReceivePackTest sets up a repository to push to at serverDir and a
+// client repository, left current, that shares its history.
+func newReceivePackTest(t *testing.T, serverDir string) string {
+	t.Helper()
+	isolateTest(t)
+	initTestRepository(t, serverDir)
+	tip := newTestHistory(t, 2)
+
+	// The commits have fixed dates, so the client's history is the server's
+	initTestRepository(t, filepath.Join(t.TempDir(), "client.git"))
+	if clientTip := newTestHistory(t, 2); clientTip != tip {
+		t.Fatalf("client tip %s differs from the server's %s", clientTip, tip)
+	}
+	return tip
+}
+
+// pushPack is a pack of what tips reach beyond exclude.
+func pushPack(t *testing.T, tips []string, exclude ...string) []byte {
+	t.Helper()
+	objects, err := listObjects(tips, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := buildPackfile(objects, defaultPackOptions(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pack
+}
+
+// receive pushes commands and pack to the repository at serverDir,
+// returning its report.
+func receive(t *testing.T, serverDir string, commands []string, capabilities string, pack []byte) string {
+	t.Helper()
+	var response bytes.Buffer
+	request := receivePackRequest(commands, "report-status "+capabilities, pack)
+	if err := ReceivePack(serverDir, bytes.NewReader(request), &response, ReceivePackOptions{StatelessRPC: true}); err != nil {
+		t.Fatalf("ReceivePack: %s", err)
+	}
+	return response.String()
+}
+
+func writeHook(t *testing.T, serverDir, name, script string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(serverDir, "hooks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(serverDir, "hooks", name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceivePackRefusesBadRefNames(t *testing.T) {
+	serverDir := filepath.Join(t.TempDir(), "server.git")
+	tip := newReceivePackTest(t, serverDir)
+
+	for _, name := range []string{"refs/heads/x.lock", "refs/heads/a//b", "refs/heads/a/", "refs/heads/a\x01", "refs/heads/a..b", "HEAD"} {
+		response := receive(t, serverDir, []string{ZeroHash + " " + tip + " " + name}, "", pushPack(t, []string{tip}, tip))
+		if !strings.Contains(response, "ng "+name+" funny refname") {
+			t.Errorf("push to %q: response %q does not refuse the name", name, response)
+		}
+	}
+}
+
+func TestReceivePackHooks(t *testing.T) {
+	dir := t.TempDir()
+	serverDir := filepath.Join(dir, "server.git")
+	tip := newReceivePackTest(t, serverDir)
+	pushed := writeTestCommit(t, "pushed\n", tip)
+	pack := pushPack(t, []string{pushed}, tip)
+	commands := []string{
+		tip + " " + pushed + " refs/heads/main",
+		ZeroHash + " " + pushed + " refs/heads/topic",
+	}
+	looseObject := filepath.Join(serverDir, "objects", pushed[:2], pushed[2:])
+
+	// pre-receive sees the pushed objects in the quarantine only
+	writeHook(t, serverDir, "pre-receive", fmt.Sprintf(`cat > %s
+ls "$GIT_QUARANTINE_PATH"/pack/*.pack > %s || exit 1
+test "$GIT_OBJECT_DIRECTORY" = "$GIT_QUARANTINE_PATH" || exit 1
+test ! -e %s
+`, shellQuote(filepath.Join(dir, "pre-receive.in")), shellQuote(filepath.Join(dir, "quarantined")), shellQuote(looseObject)))
+	writeHook(t, serverDir, "update", `test "$1" != refs/heads/topic`)
+	writeHook(t, serverDir, "post-receive", fmt.Sprintf("cat > %s\n", shellQuote(filepath.Join(dir, "post-receive.in"))))
+
+	response := receive(t, serverDir, commands, "", pack)
+	if !strings.Contains(response, "ok refs/heads/main") || !strings.Contains(response, "ng refs/heads/topic hook declined") {
+		t.Fatalf("response %q, want main updated and topic declined", response)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != pushed {
+		t.Fatalf("server main = %s, want %s", head, pushed)
+	}
+	if topic := serverRef(t, serverDir, "refs/heads/topic"); topic != "" {
+		t.Fatalf("server topic = %s, want none", topic)
+	}
+
+	input, err := os.ReadFile(filepath.Join(dir, "pre-receive.in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(commands, "\n") + "\n"; string(input) != want {
+		t.Errorf("pre-receive read %q, want %q", input, want)
+	}
+	input, err = os.ReadFile(filepath.Join(dir, "post-receive.in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := commands[0] + "\n"; string(input) != want {
+		t.Errorf("post-receive read %q, want %q", input, want)
+	}
+	quarantined, err := os.ReadFile(filepath.Join(dir, "quarantined"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(serverDir, "objects", "pack", filepath.Base(strings.TrimSpace(string(quarantined))))); err != nil {
+		t.Errorf("the quarantined pack was not moved into the repository: %s", err)
+	}
+	assertNoQuarantine(t, serverDir)
+}
+
+func TestReceivePackDropsDeclinedObjects(t *testing.T) {
+	serverDir := filepath.Join(t.TempDir(), "server.git")
+	tip := newReceivePackTest(t, serverDir)
+	pushed := writeTestCommit(t, "declined\n", tip)
+	writeHook(t, serverDir, "pre-receive", "exit 1\n")
+
+	response := receive(t, serverDir, []string{tip + " " + pushed + " refs/heads/main"}, "", pushPack(t, []string{pushed}, tip))
+	if !strings.Contains(response, "ng refs/heads/main pre-receive hook declined") {
+		t.Fatalf("response %q, want main declined", response)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != tip {
+		t.Fatalf("server main = %s, want %s", head, tip)
+	}
+	if err := withGitDir(serverDir, func() error { _, err := ReadCommit(pushed); return err }); err == nil {
+		t.Fatal("the server kept the objects of a declined push")
+	}
+	assertNoQuarantine(t, serverDir)
+}
+
+func assertNoQuarantine(t *testing.T, serverDir string) {
+	t.Helper()
+	left, err := filepath.Glob(filepath.Join(serverDir, "objects", "tmp_objdir-incoming-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Errorf("quarantine directories left behind: %q", left)
+	}
+}
+
+func TestReceivePackAtomic(t *testing.T) {
+	serverDir := filepath.Join(t.TempDir(), "server.git")
+	tip := newReceivePackTest(t, serverDir)
+	pushed := writeTestCommit(t, "atomic\n", tip)
+	pack := pushPack(t, []string{pushed}, tip)
+	commands := []string{
+		tip + " " + pushed + " refs/heads/main",
+		ZeroHash + " " + pushed + " refs/heads/topic",
+	}
+
+	// topic cannot be locked, so main must not move either
+	lockFile := filepath.Join(serverDir, "refs", "heads", "topic.lock")
+	if err := os.WriteFile(lockFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	response := receive(t, serverDir, commands, "atomic", pack)
+	if !strings.Contains(response, "ng refs/heads/main atomic transaction failed") || !strings.Contains(response, "ng refs/heads/topic failed to lock") {
+		t.Fatalf("response %q, want the whole push refused", response)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != tip {
+		t.Fatalf("server main = %s after a failed atomic push, want %s", head, tip)
+	}
+	if _, err := os.Stat(filepath.Join(serverDir, "refs", "heads", "main.lock")); !os.IsNotExist(err) {
+		t.Fatalf("main is still locked after a failed atomic push: %v", err)
+	}
+
+	// Without atomic, main goes ahead on its own
+	response = receive(t, serverDir, commands, "", pack)
+	if !strings.Contains(response, "ok refs/heads/main") || !strings.Contains(response, "ng refs/heads/topic failed to lock") {
+		t.Fatalf("response %q, want main updated and topic refused", response)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != pushed {
+		t.Fatalf("server main = %s, want %s", head, pushed)
+	}
+
+	// A stale old value fails an atomic push during the checks
+	if err := os.Remove(lockFile); err != nil {
+		t.Fatal(err)
+	}
+	newer := writeTestCommit(t, "newer\n", pushed)
+	commands = []string{
+		pushed + " " + newer + " refs/heads/main",
+		tip + " " + newer + " refs/heads/topic",
+	}
+	response = receive(t, serverDir, commands, "atomic", pushPack(t, []string{newer}, pushed))
+	if !strings.Contains(response, "ng refs/heads/main atomic transaction failed") {
+		t.Fatalf("response %q, want the whole push refused", response)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != pushed {
+		t.Fatalf("server main = %s after a failed atomic push, want %s", head, pushed)
+	}
+}
+
+func TestReceivePackDenyCurrentBranch(t *testing.T) {
+	serverDir := filepath.Join(t.TempDir(), "work", DefaultGitDir)
+	tip := newReceivePackTest(t, serverDir)
+	pushed := writeTestCommit(t, "checked out\n", tip)
+	pack := pushPack(t, []string{pushed}, tip)
+	commands := []string{tip + " " + pushed + " refs/heads/main"}
+
+	response := receive(t, serverDir, commands, "", pack)
+	if !strings.Contains(response, "ng refs/heads/main branch is currently checked out") {
+		t.Fatalf("response %q, want the checked out branch refused", response)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != tip {
+		t.Fatalf("server main = %s, want %s", head, tip)
+	}
+
+	config := &Config{}
+	config.Set("receive.denyCurrentBranch", "ignore")
+	if err := config.Write(filepath.Join(serverDir, "config")); err != nil {
+		t.Fatal(err)
+	}
+	response = receive(t, serverDir, commands, "", pack)
+	if !strings.Contains(response, "ok refs/heads/main") {
+		t.Fatalf("response %q, want main updated", response)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != pushed {
+		t.Fatalf("server main = %s, want %s", head, pushed)
+	}
+}
@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Ref struct {
+	Name string
+	Hash string
+}
+
+func UpdateRef(name, hash string) error {
+	if err := ValidateHash(hash); err != nil {
+		return err
+	}
+	return writeRefFile(name, hash+"\n")
+}
+
+func UpdateSymbolicRef(name, target string) error {
+	return writeRefFile(name, fmt.Sprintf("ref: %s\n", target))
+}
+
+func DeleteRef(name string) error {
+	err := os.Remove(filepath.Join(GitDir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := ReadFile(PackedRefsFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kept bytes.Buffer
+	skipPeeled := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "^") && skipPeeled {
+			continue
+		}
+		_, refName, _ := strings.Cut(strings.TrimSpace(line), " ")
+		skipPeeled = refName == name
+		if !skipPeeled {
+			kept.WriteString(line)
+		}
+	}
+	return WriteFile(PackedRefsFilePath, kept.Bytes())
+}
+
+func writeRefFile(name, contents string) error {
+	if strings.Contains(name, "..") || strings.HasPrefix(name, "/") {
+		return fmt.Errorf("invalid ref name: %s", name)
+	}
+
+	refPath := filepath.Join(GitDir, name)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return err
+	}
+
+	return WriteFile(refPath, []byte(contents))
+}
+
+// refLock is a held <ref>.lock file. Whoever holds it may update the ref,
+// which it does by writing the new value into the lock and renaming that
+// over the ref.
+type refLock struct {
+	path string
+	file *os.File
+}
+
+// lockRef takes the lock of ref name, failing if anyone else holds it.
+func lockRef(name string) (*refLock, error) {
+	if strings.Contains(name, "..") || strings.HasPrefix(name, "/") {
+		return nil, fmt.Errorf("invalid ref name: %s", name)
+	}
+
+	refPath := filepath.Join(GitDir, name)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(refPath+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("unable to lock %s: %s.lock exists", name, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &refLock{path: refPath, file: file}, nil
+}
+
+// commit points the ref at hash and releases the lock.
+func (l *refLock) commit(hash string) error {
+	_, err := l.file.WriteString(hash + "\n")
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(l.file.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(l.file.Name())
+	}
+	return err
+}
+
+// unlock releases the lock, leaving the ref as it is.
+func (l *refLock) unlock() {
+	l.file.Close()
+	os.Remove(l.file.Name())
+}
+
+// ResolveRef follows symbolic refs and returns the object name, or an empty
+// string if the ref does not exist.
+func ResolveRef(name string) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		data, err := ReadFile(filepath.Join(GitDir, name))
+		if os.IsNotExist(err) {
+			return readPackedRef(name)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		contents := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(contents, "ref: ") {
+			return contents, ValidateHash(contents)
+		}
+		name = strings.TrimPrefix(contents, "ref: ")
+	}
+	return "", fmt.Errorf("symbolic ref loop at %s", name)
+}
+
+// ReadSymbolicRef returns the target of a symbolic ref such as HEAD, or an
+// empty string if the ref is detached or missing.
+func ReadSymbolicRef(name string) (string, error) {
+	data, err := ReadFile(filepath.Join(GitDir, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	contents := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(contents, "ref: ") {
+		return "", nil
+	}
+	return strings.TrimPrefix(contents, "ref: "), nil
+}
+
+func readPackedRef(name string) (string, error) {
+	refs, err := readPackedRefs()
+	if err != nil {
+		return "", err
+	}
+	return refs[name], nil
+}
+
+func readPackedRefs() (map[string]string, error) {
+	refs := make(map[string]string)
+
+	data, err := ReadFile(PackedRefsFilePath)
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		hash, name, found := strings.Cut(line, " ")
+		if found && ValidateHash(hash) == nil {
+			refs[name] = hash
+		}
+	}
+	return refs, scanner.Err()
+}
+
+// ListRefs returns all loose and packed refs under prefix, sorted by name.
+func ListRefs(prefix string) ([]Ref, error) {
+	refs, err := readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(RefsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Lock files are refs being written, not refs
+		if info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(GitDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		hash, err := ResolveRef(name)
+		if err != nil {
+			return err
+		}
+		if hash != "" {
+			refs[name] = hash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Ref
+	for name, hash := range refs {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, Ref{Name: name, Hash: hash})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// checkRefFormat reports whether name is a ref name git accepts, following
+// the rules of git check-ref-format.
+func checkRefFormat(name string) bool {
+	if name == "@" || strings.Contains(name, "..") || strings.Contains(name, "@{") ||
+		strings.HasSuffix(name, ".") || !strings.Contains(name, "/") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component[0] == '.' || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// ShortRefName strips the well-known prefixes git omits when displaying refs.
+func ShortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return name
+}
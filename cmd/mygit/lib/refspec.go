@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Refspec struct {
+	Src   string
+	Dst   string
+	Force bool
+}
+
+func ParseRefspec(spec string) (Refspec, error) {
+	var refspec Refspec
+	if strings.HasPrefix(spec, "+") {
+		refspec.Force = true
+		spec = spec[1:]
+	}
+
+	src, dst, _ := strings.Cut(spec, ":")
+	refspec.Src = src
+	refspec.Dst = dst
+
+	if src == "" {
+		return Refspec{}, fmt.Errorf("invalid refspec: %s", spec)
+	}
+	if strings.Count(src, "*") > 1 || strings.Count(dst, "*") > 1 ||
+		(dst != "" && strings.Contains(src, "*") != strings.Contains(dst, "*")) {
+		return Refspec{}, fmt.Errorf("invalid refspec: %s", spec)
+	}
+
+	return refspec, nil
+}
+
+func (r Refspec) String() string {
+	spec := r.Src
+	if r.Dst != "" {
+		spec += ":" + r.Dst
+	}
+	if r.Force {
+		spec = "+" + spec
+	}
+	return spec
+}
+
+func (r Refspec) IsGlob() bool {
+	return strings.Contains(r.Src, "*")
+}
+
+// MatchSource reports whether the remote ref name matches the source side
+// and returns the corresponding local destination, if any.
+func (r Refspec) MatchSource(name string) (string, bool) {
+	if !r.IsGlob() {
+		for _, candidate := range expandRefName(r.Src) {
+			if candidate == name {
+				return expandDestination(r.Dst), true
+			}
+		}
+		return "", false
+	}
+
+	prefix, suffix, _ := strings.Cut(r.Src, "*")
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	if r.Dst == "" {
+		return "", true
+	}
+
+	match := name[len(prefix) : len(name)-len(suffix)]
+	return strings.Replace(r.Dst, "*", match, 1), true
+}
+
+// expandRefName returns the full ref names a short name may refer to, in the
+// order git's rev-parse rules try them.
+func expandRefName(name string) []string {
+	if name == "HEAD" || strings.HasPrefix(name, "refs/") {
+		return []string{name}
+	}
+	return []string{
+		"refs/" + name,
+		"refs/tags/" + name,
+		"refs/heads/" + name,
+		"refs/remotes/" + name,
+	}
+}
+
+func expandDestination(dst string) string {
+	if dst == "" || dst == "HEAD" || strings.HasPrefix(dst, "refs/") {
+		return dst
+	}
+	return "refs/heads/" + dst
+}
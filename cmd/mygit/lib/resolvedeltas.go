@@ -0,0 +1,406 @@
+package lib
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// deltaBaseCacheLimit bounds the memory held by inflated delta bases while
+// a pack is resolved. Bases pushed out are inflated again when needed.
+var deltaBaseCacheLimit = 64 << 20
+
+// deltaResolver resolves the deltas of a pack as a tree: each object is
+// the base of the deltas that refer to it, by offset or by name, and
+// resolving an object makes its children ready. Ready deltas are resolved
+// by a pool of workers, one per CPU, sharing a cache of inflated bases.
+type deltaResolver struct {
+	pack        io.ReaderAt
+	ofsChildren map[int64][]*packObject
+	refChildren map[string][]*packObject
+	cache       *baseCache
+
+	// visit, when set, is handed every object of the pack once it is
+	// resolved, one at a time
+	visit   visitFunc
+	visitMu sync.Mutex
+
+	// mu guards everything below, and the hash of objects being resolved
+	mu   sync.Mutex
+	cond *sync.Cond
+	// ready are the objects that can be resolved; pending counts those and
+	// the ones being resolved
+	ready    []*packObject
+	pending  int
+	failures map[*packObject]error
+	// bases records what each resolved delta was resolved against, so a
+	// base pushed out of the cache can be rebuilt
+	bases      map[*packObject]*packObject
+	dispatched map[*packObject]bool
+	// external are the bases of a thin pack, taken from the repository and
+	// kept for the whole resolution
+	external map[*packObject]*cachedBase
+}
+
+// applyDeltas resolves every delta in the pack and returns the bases that
+// had to be taken from the local object store because the pack is thin.
+func applyDeltas(pack io.ReaderAt, objects []*packObject) ([]string, error) {
+	externalBases, failures, err := resolvePack(pack, objects, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		if err, failed := failures[obj]; failed {
+			var missing *missingBaseError
+			if errors.As(err, &missing) || errors.Is(err, errUnresolvedBase) {
+				return nil, errors.New("invalid delta object(s)")
+			}
+			return nil, err
+		}
+	}
+	return externalBases, nil
+}
+
+// missingBaseError is a REF_DELTA base found neither in the pack nor in the
+// repository.
+type missingBaseError struct {
+	hash string
+}
+
+func (e *missingBaseError) Error() string {
+	return fmt.Sprintf("delta base %s is missing", e.hash)
+}
+
+// visitFunc is handed a resolved object of a pack: its entry, its name and
+// its contents.
+type visitFunc func(obj *packObject, hash string, data []byte, objType string) error
+
+// errUnresolvedBase is the failure of a delta whose base could not itself
+// be resolved.
+var errUnresolvedBase = errors.New("delta base could not be resolved")
+
+// resolvePack resolves every object of the pack, handing each to visit
+// when it is not nil. It returns the bases taken from the local object
+// store because the pack is thin, and why each object that could not be
+// resolved or visited failed. An object visit fails on is still the base
+// of its deltas.
+func resolvePack(pack io.ReaderAt, objects []*packObject, visit visitFunc) ([]string, map[*packObject]error, error) {
+	r := &deltaResolver{
+		pack:        pack,
+		ofsChildren: make(map[int64][]*packObject),
+		refChildren: make(map[string][]*packObject),
+		cache:       newBaseCache(deltaBaseCacheLimit),
+		visit:       visit,
+		failures:    make(map[*packObject]error),
+		bases:       make(map[*packObject]*packObject),
+		dispatched:  make(map[*packObject]bool),
+		external:    make(map[*packObject]*cachedBase),
+	}
+	r.cond = sync.NewCond(&r.mu)
+
+	var roots []*packObject
+	for _, obj := range objects {
+		switch obj.objType {
+		case ObjOfsDelta:
+			r.ofsChildren[obj.baseOffset] = append(r.ofsChildren[obj.baseOffset], obj)
+		case ObjRefDelta:
+			r.refChildren[obj.baseHash] = append(r.refChildren[obj.baseHash], obj)
+		default:
+			roots = append(roots, obj)
+		}
+	}
+
+	r.mu.Lock()
+	for _, root := range roots {
+		if visit != nil {
+			// Visiting needs the object itself, so it is inflated like a
+			// delta is resolved
+			r.dispatched[root] = true
+			r.ready = append(r.ready, root)
+			r.pending++
+		} else {
+			r.dispatchChildren(root)
+		}
+	}
+	r.mu.Unlock()
+	r.run()
+
+	// Whatever is left refers by name to objects outside the pack
+	var externalBases []string
+	taken := make(map[string]bool)
+	missingBases := make(map[string]bool)
+	for _, obj := range objects {
+		if obj.objType != ObjRefDelta || obj.hash != "" || taken[obj.baseHash] {
+			continue
+		}
+		taken[obj.baseHash] = true
+		if !ObjectExists(obj.baseHash) {
+			missingBases[obj.baseHash] = true
+			continue
+		}
+		data, objType, err := readDeltaBase(obj.baseHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		base := &packObject{offset: -1 - int64(len(externalBases)), hash: obj.baseHash}
+		r.external[base] = &cachedBase{data: data, objType: objType}
+		externalBases = append(externalBases, obj.baseHash)
+
+		r.mu.Lock()
+		r.dispatchChildren(base)
+		r.mu.Unlock()
+	}
+	if len(externalBases) > 0 {
+		r.run()
+	}
+
+	// What is still unresolved lacks a base, or is based on an object that
+	// could not be resolved itself
+	for _, obj := range objects {
+		if _, failed := r.failures[obj]; failed || obj.hash != "" {
+			continue
+		}
+		if obj.objType == ObjRefDelta && missingBases[obj.baseHash] {
+			r.failures[obj] = &missingBaseError{hash: obj.baseHash}
+		} else {
+			r.failures[obj] = errUnresolvedBase
+		}
+	}
+	return externalBases, r.failures, nil
+}
+
+// dispatchChildren makes the deltas based on a newly resolved object ready.
+// The caller holds r.mu.
+func (r *deltaResolver) dispatchChildren(base *packObject) {
+	children := r.ofsChildren[base.offset]
+	if base.offset < 0 {
+		children = nil
+	}
+	children = append(children[:len(children):len(children)], r.refChildren[base.hash]...)
+	for _, child := range children {
+		if r.dispatched[child] {
+			continue
+		}
+		r.dispatched[child] = true
+		r.bases[child] = base
+		r.ready = append(r.ready, child)
+		r.pending++
+	}
+	r.cond.Broadcast()
+}
+
+func (r *deltaResolver) hasChildren(obj *packObject) bool {
+	return len(r.ofsChildren[obj.offset]) > 0 || len(r.refChildren[obj.hash]) > 0
+}
+
+// run resolves ready objects on every CPU until none are left, including
+// those made ready along the way.
+func (r *deltaResolver) run() {
+	var workers sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			r.work()
+		}()
+	}
+	workers.Wait()
+}
+
+func (r *deltaResolver) work() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		for len(r.ready) == 0 && r.pending > 0 {
+			r.cond.Wait()
+		}
+		if len(r.ready) == 0 {
+			return
+		}
+		// Taking the newest first walks down a chain while its base is
+		// still cached
+		obj := r.ready[len(r.ready)-1]
+		r.ready = r.ready[:len(r.ready)-1]
+
+		r.mu.Unlock()
+		hash, visitErr, err := r.resolve(obj)
+		r.mu.Lock()
+
+		if err != nil {
+			r.failures[obj] = err
+		} else {
+			if visitErr != nil {
+				r.failures[obj] = visitErr
+			}
+			obj.hash = hash
+			r.dispatchChildren(obj)
+		}
+		r.pending--
+		if r.pending == 0 {
+			r.cond.Broadcast()
+		}
+	}
+}
+
+// resolve inflates an object, applying it to its base if it is a delta,
+// and returns its name, caching it if other deltas are based on it. The
+// object is then visited, which may fail on its own.
+func (r *deltaResolver) resolve(obj *packObject) (string, error, error) {
+	data, objType, err := r.objectData(obj)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "%s %d\x00", objType, len(data))
+	hasher.Write(data)
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if len(r.refChildren[hash]) > 0 {
+		r.cache.put(obj.offset, &cachedBase{data: data, objType: objType})
+	}
+
+	if r.visit == nil {
+		return hash, nil, nil
+	}
+	r.visitMu.Lock()
+	defer r.visitMu.Unlock()
+	return hash, r.visit(obj, hash, data, objType), nil
+}
+
+// objectData returns the inflated object, from the cache if it is there,
+// or else by applying its delta to its base, which is looked up the same
+// way.
+func (r *deltaResolver) objectData(obj *packObject) ([]byte, string, error) {
+	r.mu.Lock()
+	external, isExternal := r.external[obj]
+	base := r.bases[obj]
+	r.mu.Unlock()
+	if isExternal {
+		return external.data, external.objType, nil
+	}
+	if cached, ok := r.cache.get(obj.offset); ok {
+		return cached.data, cached.objType, nil
+	}
+
+	var data []byte
+	var objType string
+	if base == nil {
+		var err error
+		data, objType, err = unpackObjectAt(r.pack, obj.offset, func(hash string) ([]byte, string, error) {
+			return nil, "", fmt.Errorf("unexpected delta at offset %d", obj.offset)
+		})
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		baseData, baseType, err := r.objectData(base)
+		if err != nil {
+			return nil, "", err
+		}
+		delta, err := inflateDelta(r.pack, obj.offset)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err = applyDelta(baseData, delta)
+		if err != nil {
+			return nil, "", fmt.Errorf("applying delta at offset %d: %s", obj.offset, err)
+		}
+		objType = baseType
+	}
+
+	// A delta being resolved has no name yet, so resolve caches it if its
+	// children refer to it by name
+	if r.hasChildren(obj) {
+		r.cache.put(obj.offset, &cachedBase{data: data, objType: objType})
+	}
+	return data, objType, nil
+}
+
+// inflateDelta returns the instructions of the delta entry at offset.
+func inflateDelta(pack io.ReaderAt, offset int64) ([]byte, error) {
+	header := make([]byte, 32)
+	n, err := pack.ReadAt(header, offset)
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	header = header[:n]
+
+	_, objType, used, err := readObjectHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	switch objType {
+	case ObjRefDelta:
+		used += 20
+	case ObjOfsDelta:
+		_, ofsUsed, err := readOfsDeltaOffset(header[used:])
+		if err != nil {
+			return nil, err
+		}
+		used += ofsUsed
+	default:
+		return nil, fmt.Errorf("object at offset %d is not a delta", offset)
+	}
+	return inflateAt(pack, offset+int64(used))
+}
+
+// cachedBase is an inflated object kept as a delta base.
+type cachedBase struct {
+	data    []byte
+	objType string
+}
+
+// baseCache keeps the most recently used delta bases, keyed by pack offset,
+// up to a total size.
+type baseCache struct {
+	mu      sync.Mutex
+	limit   int
+	size    int
+	order   *list.List
+	entries map[int64]*list.Element
+}
+
+type baseCacheEntry struct {
+	offset int64
+	base   *cachedBase
+}
+
+func newBaseCache(limit int) *baseCache {
+	return &baseCache{limit: limit, order: list.New(), entries: make(map[int64]*list.Element)}
+}
+
+func (c *baseCache) get(offset int64) (*cachedBase, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[offset]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*baseCacheEntry).base, true
+}
+
+func (c *baseCache) put(offset int64, base *cachedBase) {
+	if len(base.data) > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[offset]; ok {
+		return
+	}
+	c.entries[offset] = c.order.PushFront(&baseCacheEntry{offset: offset, base: base})
+	c.size += len(base.data)
+	for c.size > c.limit {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*baseCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.offset)
+		c.size -= len(entry.base.data)
+	}
+}
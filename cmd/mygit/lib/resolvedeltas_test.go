@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// blobVersion is a blob of a hundred lines, line i saying which version it
+// is, so that every version makes a small delta against any other.
+func blobVersion(i int) []byte {
+	var data bytes.Buffer
+	for line := 0; line < 100; line++ {
+		if line == i {
+			fmt.Fprintf(&data, "line %d of version %d\n", line, i)
+		} else {
+			fmt.Fprintf(&data, "line %d, the same in every version\n", line)
+		}
+	}
+	return data.Bytes()
+}
+
+func blobHash(data []byte) string {
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "blob %d\x00", len(data))
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// deltaTestPack builds a pack of blob versions entry by entry.
+type deltaTestPack struct {
+	t       *testing.T
+	entries [][]byte
+	offset  int64
+	// bases maps the name of every blob added to the name of its base
+	bases map[string]string
+}
+
+func newDeltaTestPack(t *testing.T) *deltaTestPack {
+	return &deltaTestPack{t: t, offset: 12, bases: make(map[string]string)}
+}
+
+func (p *deltaTestPack) add(entry []byte, hash, base string) int64 {
+	offset := p.offset
+	p.entries = append(p.entries, entry)
+	p.offset += int64(len(entry))
+	p.bases[hash] = base
+	return offset
+}
+
+// addBlob adds version i undeltified and returns its offset.
+func (p *deltaTestPack) addBlob(i int) int64 {
+	p.t.Helper()
+	entry, err := encodePackEntry(blobVersion(i), "blob")
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return p.add(entry, blobHash(blobVersion(i)), "")
+}
+
+// addOfsDelta adds version i as an OFS_DELTA against version base, stored
+// at baseOffset, and returns its offset.
+func (p *deltaTestPack) addOfsDelta(i, base int, baseOffset int64) int64 {
+	p.t.Helper()
+	delta := createDelta(newDeltaIndex(blobVersion(base)), blobVersion(i), 1<<20)
+	compressed, err := compressBytes(delta)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	entry := append(encodeObjectHeader(ObjOfsDelta, uint64(len(delta))), encodeOfsDeltaOffset(p.offset-baseOffset)...)
+	entry = append(entry, compressed...)
+	return p.add(entry, blobHash(blobVersion(i)), blobHash(blobVersion(base)))
+}
+
+// addRefDelta adds version i as a REF_DELTA against version base and
+// returns its offset.
+func (p *deltaTestPack) addRefDelta(i, base int) int64 {
+	p.t.Helper()
+	delta := createDelta(newDeltaIndex(blobVersion(base)), blobVersion(i), 1<<20)
+	baseHash := blobHash(blobVersion(base))
+	return p.add(refDeltaEntry(p.t, baseHash, delta), blobHash(blobVersion(i)), baseHash)
+}
+
+// read returns the pack and its entries as index-pack reads them.
+func (p *deltaTestPack) read() (*bytes.Reader, []*packObject) {
+	p.t.Helper()
+	pack := testPack(p.t, p.entries...)
+	objects, _, _, err := readPackEntries(newPackStream(bytes.NewReader(pack), io.Discard), true)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return bytes.NewReader(pack), objects
+}
+
+// resolveTestPack resolves every object of pack, checking that each is
+// visited once, after its base, and that nothing fails.
+func resolveTestPack(t *testing.T, pack *deltaTestPack) {
+	t.Helper()
+	file, objects := pack.read()
+	visited := make(map[string]bool)
+	var visitErrors []string
+	externalBases, failures, err := resolvePack(file, objects, func(obj *packObject, hash string, data []byte, objType string) error {
+		base, known := pack.bases[hash]
+		switch {
+		case !known:
+			visitErrors = append(visitErrors, fmt.Sprintf("unexpected object %s at offset %d", hash, obj.offset))
+		case visited[hash]:
+			visitErrors = append(visitErrors, fmt.Sprintf("%s visited twice", hash))
+		case base != "" && !visited[base]:
+			visitErrors = append(visitErrors, fmt.Sprintf("%s visited before its base %s", hash, base))
+		case objType != "blob":
+			visitErrors = append(visitErrors, fmt.Sprintf("%s resolved as a %s", hash, objType))
+		}
+		visited[hash] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range visitErrors {
+		t.Error(message)
+	}
+	for obj, err := range failures {
+		t.Errorf("object at offset %d failed: %s", obj.offset, err)
+	}
+	if len(externalBases) > 0 {
+		t.Errorf("external bases = %v, want none", externalBases)
+	}
+	if len(visited) != len(pack.bases) {
+		t.Errorf("visited %d objects, want %d", len(visited), len(pack.bases))
+	}
+}
+
+func TestResolvePackOrder(t *testing.T) {
+	pack := newDeltaTestPack(t)
+	// A REF_DELTA may come before its base in the pack
+	pack.addRefDelta(6, 0)
+	v0 := pack.addBlob(0)
+	v1 := pack.addOfsDelta(1, 0, v0)
+	pack.addRefDelta(2, 1)
+	pack.addRefDelta(3, 2)
+	v4 := pack.addOfsDelta(4, 1, v1)
+	pack.addOfsDelta(5, 4, v4)
+	pack.addRefDelta(7, 6)
+	resolveTestPack(t, pack)
+}
+
+func TestResolvePackEvictedBases(t *testing.T) {
+	// Room for a single base: resolving one chain pushes out the bases the
+	// others need, which must be inflated again from the pack
+	limit := deltaBaseCacheLimit
+	deltaBaseCacheLimit = len(blobVersion(0)) + 10
+	t.Cleanup(func() { deltaBaseCacheLimit = limit })
+
+	pack := newDeltaTestPack(t)
+	v0 := pack.addBlob(0)
+	for chain := 0; chain < 4; chain++ {
+		offset, base := v0, 0
+		for depth := 1; depth <= 3; depth++ {
+			version := chain*10 + depth
+			offset = pack.addOfsDelta(version, base, offset)
+			base = version
+		}
+		pack.addRefDelta(chain*10+4, chain*10+1)
+	}
+	resolveTestPack(t, pack)
+}
+
+func TestBaseCacheEviction(t *testing.T) {
+	cache := newBaseCache(10)
+	cache.put(1, &cachedBase{data: []byte("aaaa")})
+	cache.put(2, &cachedBase{data: []byte("bbbb")})
+	// Using the first makes the second the oldest
+	cache.get(1)
+	cache.put(3, &cachedBase{data: []byte("cccc")})
+	if _, ok := cache.get(2); ok {
+		t.Error("least recently used base was kept")
+	}
+	for _, offset := range []int64{1, 3} {
+		if _, ok := cache.get(offset); !ok {
+			t.Errorf("base at offset %d was evicted", offset)
+		}
+	}
+
+	cache.put(4, &cachedBase{data: []byte("larger than the cache")})
+	if _, ok := cache.get(4); ok {
+		t.Error("base larger than the cache was kept")
+	}
+	if _, ok := cache.get(1); !ok {
+		t.Error("a base too large to cache evicted others")
+	}
+}
+
+func TestResolvePackMissingBase(t *testing.T) {
+	isolateTest(t)
+	initTestRepository(t, t.TempDir())
+
+	pack := newDeltaTestPack(t)
+	pack.addBlob(9)
+	v1 := pack.addRefDelta(1, 0)
+	pack.addOfsDelta(2, 1, v1)
+	missing := blobHash(blobVersion(0))
+
+	file, objects := pack.read()
+	externalBases, failures, err := resolvePack(file, objects, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(externalBases) > 0 {
+		t.Errorf("external bases = %v, want none", externalBases)
+	}
+	if err, failed := failures[objects[0]]; failed {
+		t.Errorf("undeltified blob failed: %s", err)
+	}
+	var missingErr *missingBaseError
+	if !errors.As(failures[objects[1]], &missingErr) || missingErr.hash != missing {
+		t.Errorf("delta on the missing base failed with %v, want missing %s", failures[objects[1]], missing)
+	}
+	if !errors.Is(failures[objects[2]], errUnresolvedBase) {
+		t.Errorf("delta on the unresolved delta failed with %v, want %v", failures[objects[2]], errUnresolvedBase)
+	}
+
+	file, objects = pack.read()
+	if _, err := applyDeltas(file, objects); err == nil || err.Error() != "invalid delta object(s)" {
+		t.Fatalf("applyDeltas = %v, want invalid delta object(s)", err)
+	}
+
+	// With the base in the repository the pack is merely thin
+	if _, err := WriteObject(CreateBlob(blobVersion(0))); err != nil {
+		t.Fatal(err)
+	}
+	file, objects = pack.read()
+	externalBases, err = applyDeltas(file, objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(externalBases) != 1 || externalBases[0] != missing {
+		t.Fatalf("external bases = %v, want [%s]", externalBases, missing)
+	}
+	for i, version := range []int{9, 1, 2} {
+		if want := blobHash(blobVersion(version)); objects[i].hash != want {
+			t.Errorf("object %d resolved to %s, want %s", i, objects[i].hash, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+type packableObject struct {
+	hash    string
+	objType string
+	// name is the path a tree or blob was found at, which guides the
+	// search for delta bases
+	name string
+}
+
+// listObjects returns every object reachable from include that is not
+// reachable from exclude, in the order a pack should contain them.
+func listObjects(include []string, exclude []string) ([]packableObject, error) {
+	return listFilteredObjects(include, exclude, nil)
+}
+
+// listFilteredObjects is listObjects leaving out the trees and blobs filter
+// rejects, unless include names them.
+func listFilteredObjects(include []string, exclude []string, filter *objectFilter) ([]packableObject, error) {
+	excludedCommits := make(map[string]bool)
+	var excludeTips []string
+	for _, hash := range exclude {
+		if commit, err := peelToCommit(hash); err == nil {
+			excludeTips = append(excludeTips, commit)
+		}
+	}
+	if err := collectAncestors(excludeTips, excludedCommits); err != nil {
+		return nil, err
+	}
+
+	lister := &objectLister{
+		seen:          make(map[string]bool),
+		uninteresting: make(map[string]bool),
+		filter:        filter,
+	}
+	if filter != nil && filter.hasTreeDepth {
+		lister.treeDepths = make(map[string]int)
+	}
+
+	var commitTips []string
+	for _, hash := range include {
+		commit, err := lister.addTagChain(hash)
+		if err != nil {
+			return nil, err
+		}
+		if commit != "" {
+			commitTips = append(commitTips, commit)
+		}
+	}
+
+	var commits []*Commit
+	var commitHashes []string
+	queue := commitTips
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if lister.seen[hash] || excludedCommits[hash] {
+			continue
+		}
+		lister.seen[hash] = true
+
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+		commitHashes = append(commitHashes, hash)
+
+		for _, parent := range commit.Parents {
+			if excludedCommits[parent] {
+				// Trees of boundary commits are already on the other side
+				if boundary, err := ReadCommit(parent); err == nil {
+					lister.markTreeUninteresting(boundary.Tree)
+				}
+			} else {
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	for i, commit := range commits {
+		lister.objects = append(lister.objects, packableObject{hash: commitHashes[i], objType: "commit"})
+		if err := lister.addTree(commit.Tree, "", 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return lister.objects, nil
+}
+
+type objectLister struct {
+	objects       []packableObject
+	seen          map[string]bool
+	uninteresting map[string]bool
+	filter        *objectFilter
+	// treeDepths is the depth each tree was walked at under a tree depth
+	// filter
+	treeDepths map[string]int
+}
+
+// addTagChain adds any annotated tags in front of hash and returns the
+// commit they ultimately point at, if any.
+func (l *objectLister) addTagChain(hash string) (string, error) {
+	for {
+		obj, objType, _, err := ReadObjectFile(hash)
+		if err != nil {
+			return "", err
+		}
+
+		switch objType {
+		case "commit":
+			return hash, nil
+		case "tag":
+			if !l.seen[hash] {
+				l.seen[hash] = true
+				l.objects = append(l.objects, packableObject{hash: hash, objType: "tag"})
+			}
+			target, _, _ := strings.Cut(string(obj), "\n")
+			if !strings.HasPrefix(target, "object ") {
+				return "", fmt.Errorf("invalid tag object %s", hash)
+			}
+			hash = strings.TrimPrefix(target, "object ")
+		case "tree":
+			if !l.seen[hash] {
+				l.seen[hash] = true
+				l.objects = append(l.objects, packableObject{hash: hash, objType: "tree"})
+			}
+			return "", l.addTreeEntries(hash, "", 0)
+		default:
+			if !l.seen[hash] {
+				l.seen[hash] = true
+				l.objects = append(l.objects, packableObject{hash: hash, objType: objType})
+			}
+			return "", nil
+		}
+	}
+}
+
+// addTree adds a tree found depth levels below a root tree, and what it
+// contains.
+func (l *objectLister) addTree(hash, name string, depth int) error {
+	if l.uninteresting[hash] || !l.filter.includesTree(depth) {
+		return nil
+	}
+	if l.seen[hash] {
+		// Met again nearer the root, a tree cut short by a depth filter
+		// reaches further
+		if walked, ok := l.treeDepths[hash]; !ok || walked <= depth {
+			return nil
+		}
+	} else {
+		l.seen[hash] = true
+		l.objects = append(l.objects, packableObject{hash: hash, objType: "tree", name: name})
+	}
+	if l.treeDepths != nil {
+		l.treeDepths[hash] = depth
+	}
+	return l.addTreeEntries(hash, name, depth)
+}
+
+func (l *objectLister) addTreeEntries(hash, name string, depth int) error {
+	entries, err := ReadTreeObjectFile(hash)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryHash := hex.EncodeToString(entry.hash)
+		entryName := path.Join(name, entry.name)
+		switch entry.objType {
+		case Tree:
+			if err := l.addTree(entryHash, entryName, depth+1); err != nil {
+				return err
+			}
+		case Blob:
+			if l.seen[entryHash] || l.uninteresting[entryHash] {
+				continue
+			}
+			size := 0
+			if l.filter.needsBlobSize() {
+				obj, _, _, err := ReadObjectFile(entryHash)
+				if err != nil {
+					return err
+				}
+				size = len(obj)
+			}
+			if l.filter.includesBlob(size, depth+1) {
+				l.seen[entryHash] = true
+				l.objects = append(l.objects, packableObject{hash: entryHash, objType: "blob", name: entryName})
+			}
+		}
+	}
+	return nil
+}
+
+func (l *objectLister) markTreeUninteresting(hash string) {
+	if l.uninteresting[hash] {
+		return
+	}
+	l.uninteresting[hash] = true
+
+	entries, err := ReadTreeObjectFile(hash)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		entryHash := hex.EncodeToString(entry.hash)
+		if entry.objType == Tree {
+			l.markTreeUninteresting(entryHash)
+		} else {
+			l.uninteresting[entryHash] = true
+		}
+	}
+}
+
+func collectAncestors(tips []string, ancestors map[string]bool) error {
+	queue := append([]string{}, tips...)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if ancestors[hash] {
+			continue
+		}
+		ancestors[hash] = true
+
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, commit.Parents...)
+	}
+	return nil
+}
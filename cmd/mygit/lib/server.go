@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// serverHeaderTimeout bounds how long a client may take to send the
+	// headers of a request; bodies are read as the service consumes them
+	serverHeaderTimeout = 30 * time.Second
+	// serverIdleTimeout closes kept-alive connections left unused
+	serverIdleTimeout = 2 * time.Minute
+)
+
+// ServeOptions configures the smart HTTP server.
+type ServeOptions struct {
+	// Listen is the address to listen on, such as ":8080"
+	Listen string
+	// ReadOnly refuses pushes
+	ReadOnly bool
+	// Username and Password, when set, are required from every client
+	// through HTTP basic authentication
+	Username string
+	Password string
+}
+
+// ServeRepositories serves each repository in dirs over smart HTTP under
+// its directory name, so /tmp/repo.git is cloned from
+// http://<listen>/repo.git.
+func ServeRepositories(dirs []string, options ServeOptions) error {
+	// Each request runs the service in a process of its own, as
+	// git-http-backend does, since the repository a process works on is
+	// package-wide state
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	server := &repositoryServer{options: options, repositories: make(map[string]*smartHTTPHandler)}
+	for _, dir := range dirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if _, err := findGitDir(dir); err != nil {
+			return err
+		}
+
+		name := filepath.Base(dir)
+		if _, ok := server.repositories[name]; ok {
+			return fmt.Errorf("more than one repository is named '%s'", name)
+		}
+		server.repositories[name] = &smartHTTPHandler{dir: dir, readOnly: options.ReadOnly, executable: executable}
+		fmt.Fprintf(os.Stderr, "Serving %s at http://%s/%s\n", dir, options.Listen, name)
+	}
+
+	httpServer := &http.Server{
+		Addr:              options.Listen,
+		Handler:           server,
+		ReadHeaderTimeout: serverHeaderTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+	return httpServer.ListenAndServe()
+}
+
+// repositoryServer routes requests to the repository named by the first
+// path segment, after checking the client's credentials.
+type repositoryServer struct {
+	options      ServeOptions
+	repositories map[string]*smartHTTPHandler
+}
+
+func (s *repositoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		fmt.Fprintf(os.Stderr, "%s %s %s %d\n", r.RemoteAddr, r.Method, r.URL.RequestURI(), recorder.status)
+	}()
+
+	if !s.authorized(r) {
+		recorder.Header().Set("WWW-Authenticate", `Basic realm="mygit"`)
+		http.Error(recorder, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	repository, ok := s.repositories[name]
+	if !ok {
+		// Allow the .git suffix to be left out, as hosting services do
+		repository, ok = s.repositories[name+".git"]
+	}
+	if !ok {
+		http.NotFound(recorder, r)
+		return
+	}
+	repository.ServeHTTP(recorder, r)
+}
+
+func (s *repositoryServer) authorized(r *http.Request) bool {
+	if s.options.Username == "" && s.options.Password == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(s.options.Username)) == 1
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(s.options.Password)) == 1
+	return usernameMatches && passwordMatches
+}
+
+// statusRecorder remembers the status of a response for the request log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// smartHTTPHandler serves one repository over the smart HTTP protocol.
+type smartHTTPHandler struct {
+	dir      string
+	readOnly bool
+	// executable is the mygit binary the services are run with
+	executable string
+}
+
+func (h *smartHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, err := findGitDir(h.dir); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/info/refs"):
+		h.serveInfoRefs(w, r)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/"+UploadPackService):
+		h.serveRPC(w, r, UploadPackService)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/"+ReceivePackService):
+		h.serveRPC(w, r, ReceivePackService)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allowService refuses services the repository does not offer, including
+// receive-pack when the server is read-only.
+func (h *smartHTTPHandler) allowService(w http.ResponseWriter, service string) bool {
+	switch {
+	case service == UploadPackService:
+		return true
+	case service == ReceivePackService:
+		if h.readOnly {
+			http.Error(w, "Pushing is disabled on this server", http.StatusForbidden)
+			return false
+		}
+		return true
+	default:
+		http.Error(w, "Unsupported service", http.StatusForbidden)
+		return false
+	}
+}
+
+// serveInfoRefs writes the advertisement a smart client starts with. Dumb
+// clients, which do not name a service, are not served.
+func (h *smartHTTPHandler) serveInfoRefs(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	if !h.allowService(w, service) {
+		return
+	}
+
+	// Pushes are always spoken in protocol v0
+	protocol := r.Header.Get("Git-Protocol")
+	if service == ReceivePackService {
+		protocol = ""
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	if !requestsProtocolV2(protocol) {
+		fmt.Fprint(w, encodePktLine(fmt.Sprintf("# service=%s\n", service)))
+		fmt.Fprint(w, flushPkt)
+	}
+
+	h.run(service, r.Body, w, protocol, "--http-backend-info-refs")
+}
+
+// serveRPC runs one stateless request against the service.
+func (h *smartHTTPHandler) serveRPC(w http.ResponseWriter, r *http.Request, service string) {
+	if !h.allowService(w, service) {
+		return
+	}
+	if r.Header.Get("Content-Type") != fmt.Sprintf("application/x-%s-request", service) {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	h.run(service, body, w, r.Header.Get("Git-Protocol"))
+}
+
+// run serves one stateless request by running the service on the
+// repository with r as its input and w as its output.
+func (h *smartHTTPHandler) run(service string, r io.Reader, w io.Writer, protocol string, flags ...string) {
+	args := append([]string{strings.TrimPrefix(service, "git-"), "--stateless-rpc"}, flags...)
+	cmd := exec.Command(h.executable, append(args, h.dir)...)
+	cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+protocol)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", service, h.dir, err)
+	}
+}
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain serves the requests of ServeRepositories, which runs each in a
+// process of os.Executable() as it would a mygit binary: here, the test
+// binary itself.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 2 && (os.Args[1] == "upload-pack" || os.Args[1] == "receive-pack") {
+		if err := runTestService(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runTestService(service string, args []string) error {
+	flags := make(map[string]bool)
+	for _, arg := range args[:len(args)-1] {
+		flags[arg] = true
+	}
+	dir := args[len(args)-1]
+	advertiseRefs := flags["--advertise-refs"] || flags["--http-backend-info-refs"]
+
+	if service == "upload-pack" {
+		options := UploadPackOptions{StatelessRPC: flags["--stateless-rpc"], AdvertiseRefs: advertiseRefs, Protocol: os.Getenv("GIT_PROTOCOL")}
+		return UploadPack(dir, os.Stdin, os.Stdout, options)
+	}
+	options := ReceivePackOptions{StatelessRPC: flags["--stateless-rpc"], AdvertiseRefs: advertiseRefs}
+	return ReceivePack(dir, os.Stdin, os.Stdout, options)
+}
+
+// isolateTest keeps the test away from the user's configuration and puts
+// the working directory and repository back when it ends.
+func isolateTest(t *testing.T) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		SetGitDir(DefaultGitDir)
+	})
+}
+
+// initTestRepository creates an empty bare repository at gitDir and makes it
+// the current one.
+func initTestRepository(t *testing.T, gitDir string) {
+	t.Helper()
+	for _, dir := range []string{"objects", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(gitDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetGitDir(gitDir)
+}
+
+// writeTestCommit writes a commit of a tree holding file.txt with contents.
+func writeTestCommit(t *testing.T, contents string, parents ...string) string {
+	t.Helper()
+	blob, err := WriteObject(CreateBlob([]byte(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := WriteObjectWithType(append([]byte("100644 file.txt\x00"), blob...), "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commit strings.Builder
+	fmt.Fprintf(&commit, "tree %x\n", tree)
+	for _, parent := range parents {
+		fmt.Fprintf(&commit, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&commit, "author %s <%s> 1620000000 +0000\n", DefaultAuthor, DefaultAuthorEmail)
+	fmt.Fprintf(&commit, "committer %s <%s> 1620000000 +0000\n", DefaultAuthor, DefaultAuthorEmail)
+	fmt.Fprintf(&commit, "\n%s\n", contents)
+	hash, err := WriteObjectWithType([]byte(commit.String()), "commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(hash)
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startTestServer serves the repositories with ServeRepositories and
+// returns the server's base URL once it accepts connections.
+func startTestServer(t *testing.T, dirs []string, options ServeOptions) string {
+	t.Helper()
+	options.Listen = freeAddress(t)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeRepositories(dirs, options)
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", options.Listen)
+		if err == nil {
+			conn.Close()
+			return "http://" + options.Listen
+		}
+		select {
+		case err := <-served:
+			t.Fatalf("ServeRepositories: %s", err)
+		default:
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("server did not start: %s", err)
+		}
+	}
+}
+
+// newTestHistory writes a line of commits changing file.txt to the current
+// repository and points main at the last one, which it returns.
+func newTestHistory(t *testing.T, commits int) string {
+	t.Helper()
+	tip := writeTestCommit(t, "version 0\n")
+	for i := 1; i < commits; i++ {
+		tip = writeTestCommit(t, fmt.Sprintf("version %d\n", i), tip)
+	}
+	if err := UpdateRef("refs/heads/main", tip); err != nil {
+		t.Fatal(err)
+	}
+	return tip
+}
+
+func TestServeRepositoriesClone(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+
+	serverDir := filepath.Join(dir, "server.git")
+	initTestRepository(t, serverDir)
+	tip := newTestHistory(t, 5)
+	SetGitDir(DefaultGitDir)
+	url := startTestServer(t, []string{serverDir}, ServeOptions{})
+
+	clientDir := filepath.Join(dir, "client")
+	CloneRepository(url+"/server", clientDir, CloneOptions{})
+	if head, err := ResolveRef("HEAD"); err != nil || head != tip {
+		t.Fatalf("cloned HEAD = %s, %v, want %s", head, err, tip)
+	}
+	if remote, err := ResolveRef("refs/remotes/origin/main"); err != nil || remote != tip {
+		t.Fatalf("refs/remotes/origin/main = %s, %v, want %s", remote, err, tip)
+	}
+	if contents, err := os.ReadFile(filepath.Join(clientDir, "file.txt")); err != nil || string(contents) != "version 4\n" {
+		t.Fatalf("checked out file.txt = %q, %v", contents, err)
+	}
+}
+
+func TestServeRepositoriesAccess(t *testing.T) {
+	isolateTest(t)
+	serverDir := filepath.Join(t.TempDir(), "server.git")
+	initTestRepository(t, serverDir)
+	newTestHistory(t, 1)
+	SetGitDir(DefaultGitDir)
+
+	readOnly := startTestServer(t, []string{serverDir}, ServeOptions{ReadOnly: true})
+	private := startTestServer(t, []string{serverDir}, ServeOptions{Username: "alice", Password: "secret"})
+
+	tests := []struct {
+		name     string
+		url      string
+		username string
+		password string
+		status   int
+	}{
+		{"upload-pack", readOnly + "/server.git/info/refs?service=git-upload-pack", "", "", http.StatusOK},
+		{"without .git", readOnly + "/server/info/refs?service=git-upload-pack", "", "", http.StatusOK},
+		{"read-only receive-pack", readOnly + "/server.git/info/refs?service=git-receive-pack", "", "", http.StatusForbidden},
+		{"dumb client", readOnly + "/server.git/info/refs", "", "", http.StatusForbidden},
+		{"unknown repository", readOnly + "/other.git/info/refs?service=git-upload-pack", "", "", http.StatusNotFound},
+		{"no credentials", private + "/server.git/info/refs?service=git-upload-pack", "", "", http.StatusUnauthorized},
+		{"wrong password", private + "/server.git/info/refs?service=git-upload-pack", "alice", "wrong", http.StatusUnauthorized},
+		{"credentials", private + "/server.git/info/refs?service=git-receive-pack", "alice", "secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.username != "" {
+				request.SetBasicAuth(test.username, test.password)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != test.status {
+				t.Fatalf("GET %s = %d, want %d", test.url, response.StatusCode, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// infiniteDepth is the depth git requests to fetch all remaining history.
+const infiniteDepth = 0x7fffffff
+
+// deepenRequest describes how much history a shallow fetch should reach.
+// The zero value fetches complete history.
+type deepenRequest struct {
+	depth    int
+	since    int64
+	exclude  []string
+	relative bool
+}
+
+func (d deepenRequest) active() bool {
+	return d.depth > 0 || d.since > 0 || len(d.exclude) > 0
+}
+
+// shallowInfo holds the boundary changes a server reports for a shallow
+// fetch.
+type shallowInfo struct {
+	shallow   []string
+	unshallow []string
+}
+
+var shallowCommits map[string]bool
+
+// readShallowCommits returns the commits recorded in .git/shallow, whose
+// parents are treated as missing.
+func readShallowCommits() (map[string]bool, error) {
+	if shallowCommits != nil {
+		return shallowCommits, nil
+	}
+
+	commits := make(map[string]bool)
+	data, err := os.ReadFile(ShallowFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if ValidateHash(line) != nil {
+			return nil, fmt.Errorf("invalid shallow line: %q", line)
+		}
+		commits[line] = true
+	}
+
+	shallowCommits = commits
+	return commits, nil
+}
+
+// IsShallowRepository reports whether the repository has truncated history.
+func IsShallowRepository() (bool, error) {
+	commits, err := readShallowCommits()
+	return len(commits) > 0, err
+}
+
+func isShallowCommit(hash string) bool {
+	commits, err := readShallowCommits()
+	return err == nil && commits[hash]
+}
+
+// updateShallow applies the server's boundary changes to .git/shallow,
+// removing the file once history is complete.
+func updateShallow(info *shallowInfo) error {
+	if info == nil || len(info.shallow)+len(info.unshallow) == 0 {
+		return nil
+	}
+
+	commits, err := readShallowCommits()
+	if err != nil {
+		return err
+	}
+	for _, hash := range info.shallow {
+		commits[hash] = true
+	}
+	for _, hash := range info.unshallow {
+		delete(commits, hash)
+	}
+	shallowCommits = nil
+
+	if len(commits) == 0 {
+		err = os.Remove(ShallowFilePath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var hashes []string
+	for hash := range commits {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return WriteFile(ShallowFilePath, []byte(strings.Join(hashes, "\n")+"\n"))
+}
+
+// capabilities returns the v0 capabilities a request with shallow lines
+// needs. Protocol v0 asks for relative deepening with a capability rather
+// than an argument.
+func (d deepenRequest) capabilities() []string {
+	capabilities := []string{"shallow"}
+	if d.relative {
+		capabilities = append(capabilities, "deepen-relative")
+	}
+	if d.since > 0 {
+		capabilities = append(capabilities, "deepen-since")
+	}
+	if len(d.exclude) > 0 {
+		capabilities = append(capabilities, "deepen-not")
+	}
+	return capabilities
+}
+
+// shallowArguments returns the request lines telling the server about our
+// shallow boundaries and how far to deepen them.
+func shallowArguments(deepen deepenRequest, version int) ([]string, error) {
+	commits, err := readShallowCommits()
+	if err != nil {
+		return nil, err
+	}
+
+	var arguments []string
+	for hash := range commits {
+		arguments = append(arguments, "shallow "+hash)
+	}
+	sort.Strings(arguments)
+
+	if deepen.depth > 0 {
+		arguments = append(arguments, fmt.Sprintf("deepen %d", deepen.depth))
+	}
+	if deepen.relative && version == 2 {
+		arguments = append(arguments, "deepen-relative")
+	}
+	if deepen.since > 0 {
+		arguments = append(arguments, fmt.Sprintf("deepen-since %d", deepen.since))
+	}
+	for _, ref := range deepen.exclude {
+		arguments = append(arguments, "deepen-not "+ref)
+	}
+	return arguments, nil
+}
+
+// checkDeepenSupport fails when the server cannot honour the request.
+func (a *refAdvertisement) checkDeepenSupport(deepen deepenRequest) error {
+	if !deepen.active() {
+		return nil
+	}
+	if a.version == 2 {
+		if !a.hasV2Feature("fetch", "shallow") {
+			return fmt.Errorf("Server does not support shallow requests")
+		}
+		return nil
+	}
+
+	switch {
+	case !a.hasCapability("shallow"):
+		return fmt.Errorf("Server does not support shallow clients")
+	case deepen.since > 0 && !a.hasCapability("deepen-since"):
+		return fmt.Errorf("Server does not support --shallow-since")
+	case len(deepen.exclude) > 0 && !a.hasCapability("deepen-not"):
+		return fmt.Errorf("Server does not support --shallow-exclude")
+	case deepen.relative && !a.hasCapability("deepen-relative"):
+		return fmt.Errorf("Server does not support --deepen")
+	}
+	return nil
+}
+
+// readShallowInfo reads shallow and unshallow lines up to a flush packet.
+func readShallowInfo(reader *pktLineReader) (*shallowInfo, error) {
+	info := &shallowInfo{}
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("reading shallow info: %s", err)
+		}
+		if line == nil {
+			return info, nil
+		}
+
+		kind, hash, _ := strings.Cut(string(line), " ")
+		if ValidateHash(hash) != nil {
+			return nil, fmt.Errorf("invalid shallow line: %q", line)
+		}
+		switch kind {
+		case "shallow":
+			info.shallow = append(info.shallow, hash)
+		case "unshallow":
+			info.unshallow = append(info.unshallow, hash)
+		default:
+			if bytes.HasPrefix(line, []byte("ERR ")) {
+				return nil, fmt.Errorf("remote error: %s", line[4:])
+			}
+			return nil, fmt.Errorf("unexpected shallow line: %q", line)
+		}
+	}
+}
+
+// ParseShallowSince converts a --shallow-since date into a Unix timestamp.
+// It accepts a timestamp, an ISO 8601 date or time, or a relative date such
+// as "2 weeks ago".
+func ParseShallowSince(date string) (int64, error) {
+	if timestamp, err := strconv.ParseInt(date, 10, 64); err == nil {
+		return timestamp, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	fields := strings.Fields(date)
+	if len(fields) == 3 && fields[2] == "ago" {
+		count, err := strconv.Atoi(fields[0])
+		if err == nil {
+			units := map[string]time.Duration{
+				"second": time.Second,
+				"minute": time.Minute,
+				"hour":   time.Hour,
+				"day":    24 * time.Hour,
+				"week":   7 * 24 * time.Hour,
+				"month":  30 * 24 * time.Hour,
+				"year":   365 * 24 * time.Hour,
+			}
+			if unit, ok := units[strings.TrimSuffix(fields[1], "s")]; ok {
+				return time.Now().Add(-time.Duration(count) * unit).Unix(), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid date: %s", date)
+}
+
+// registerShallow makes history walks stop at hash for as long as the
+// repository stays selected, as if it were listed in .git/shallow. Serving
+// a shallow client relies on this to walk history the way the client sees
+// it.
+func registerShallow(hash string) error {
+	commits, err := readShallowCommits()
+	if err != nil {
+		return err
+	}
+	commits[hash] = true
+	return nil
+}
+
+// shallowCommitsByDepth walks down from starts, counting them as depth 1,
+// and returns the commits at depth, which become shallow, and those above
+// it, whose parents are sent. Commits the repository is itself shallow at
+// end the walk early.
+func shallowCommitsByDepth(starts []string, depth int) ([]string, map[string]bool, error) {
+	var shallow []string
+	notShallow := make(map[string]bool)
+	seen := make(map[string]bool)
+
+	var level []string
+	for _, start := range starts {
+		if commit, err := peelToCommit(start); err == nil {
+			level = append(level, commit)
+		}
+	}
+	for current := 1; len(level) > 0; current++ {
+		var next []string
+		for _, hash := range level {
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			if current >= depth && depth != infiniteDepth || isShallowCommit(hash) {
+				shallow = append(shallow, hash)
+				continue
+			}
+
+			commit, err := ReadCommit(hash)
+			if err != nil {
+				return nil, nil, err
+			}
+			notShallow[hash] = true
+			next = append(next, commit.Parents...)
+		}
+		level = next
+	}
+	return shallow, notShallow, nil
+}
+
+// shallowCommitsByRevList selects the commits reachable from starts that are
+// no older than since, when it is set, and not reachable from exclude. Those
+// with a parent left out become shallow.
+func shallowCommitsByRevList(starts []string, since int64, exclude []string) ([]string, map[string]bool, error) {
+	excluded := make(map[string]bool)
+	if err := collectAncestors(exclude, excluded); err != nil {
+		return nil, nil, err
+	}
+
+	included := make(map[string]bool)
+	var order []string
+	parents := make(map[string][]string)
+	var queue []string
+	for _, start := range starts {
+		if commit, err := peelToCommit(start); err == nil {
+			queue = append(queue, commit)
+		}
+	}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if included[hash] || excluded[hash] {
+			continue
+		}
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if since > 0 && commit.CommitTime() < since {
+			continue
+		}
+		included[hash] = true
+		order = append(order, hash)
+		parents[hash] = commit.Parents
+		queue = append(queue, commit.Parents...)
+	}
+	if len(order) == 0 {
+		return nil, nil, fmt.Errorf("no commits selected for shallow requests")
+	}
+
+	var shallow []string
+	notShallow := make(map[string]bool)
+	for _, hash := range order {
+		boundary := isShallowCommit(hash)
+		for _, parent := range parents[hash] {
+			if !included[parent] {
+				boundary = true
+			}
+		}
+		if boundary {
+			shallow = append(shallow, hash)
+		} else {
+			notShallow[hash] = true
+		}
+	}
+	return shallow, notShallow, nil
+}
+
+// writeShallowInfo writes the shallow and unshallow lines answering a
+// deepen request. The caller ends them as the protocol version requires.
+func writeShallowInfo(w io.Writer, info *shallowInfo) {
+	for _, hash := range info.shallow {
+		fmt.Fprint(w, encodePktLine(fmt.Sprintf("shallow %s\n", hash)))
+	}
+	for _, hash := range info.unshallow {
+		fmt.Fprint(w, encodePktLine(fmt.Sprintf("unshallow %s\n", hash)))
+	}
+}
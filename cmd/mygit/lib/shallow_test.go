@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// firstParents lists the commits from tip back to the root.
+func firstParents(t *testing.T, tip string) []string {
+	t.Helper()
+	var history []string
+	for hash := tip; hash != ""; {
+		history = append(history, hash)
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash = ""
+		if len(commit.Parents) > 0 {
+			hash = commit.Parents[0]
+		}
+	}
+	return history
+}
+
+func readShallowFile(t *testing.T) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(GitDir, "shallow"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(data))
+	sort.Strings(lines)
+	return lines
+}
+
+// assertShallowAt checks that history is complete down to history[depth-1],
+// which the shallow file lists as the boundary.
+func assertShallowAt(t *testing.T, history []string, depth int) {
+	t.Helper()
+	if shallow := readShallowFile(t); len(shallow) != 1 || shallow[0] != history[depth-1] {
+		t.Fatalf("shallow = %q, want the commit %d deep %s", shallow, depth, history[depth-1])
+	}
+	for i, hash := range history {
+		if exists := ObjectExists(hash); exists != (i < depth) {
+			t.Errorf("commit %d deep present = %v with a depth of %d", i+1, exists, depth)
+		}
+	}
+}
+
+func TestShallowCloneAndDeepen(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+	serverDir := filepath.Join(dir, "server.git")
+	initTestRepository(t, serverDir)
+	history := firstParents(t, newTestHistory(t, 6))
+	SetGitDir(DefaultGitDir)
+	url := startTestServer(t, []string{serverDir}, ServeOptions{})
+
+	for _, remote := range []string{url + "/server.git", "file://" + serverDir} {
+		t.Run(strings.SplitN(remote, ":", 2)[0], func(t *testing.T) {
+			CloneRepository(remote, filepath.Join(t.TempDir(), "client"), CloneOptions{Depth: 2})
+			if shallow, err := IsShallowRepository(); err != nil || !shallow {
+				t.Fatalf("IsShallowRepository = %v, %v after a shallow clone", shallow, err)
+			}
+			assertShallowAt(t, history, 2)
+
+			if err := FetchRemote(FetchOptions{Remote: DefaultRemoteName, Deepen: 2}); err != nil {
+				t.Fatalf("FetchRemote --deepen 2: %s", err)
+			}
+			assertShallowAt(t, history, 4)
+
+			if err := FetchRemote(FetchOptions{Remote: DefaultRemoteName, Depth: 5}); err != nil {
+				t.Fatalf("FetchRemote --depth 5: %s", err)
+			}
+			assertShallowAt(t, history, 5)
+
+			if err := FetchRemote(FetchOptions{Remote: DefaultRemoteName, Unshallow: true}); err != nil {
+				t.Fatalf("FetchRemote --unshallow: %s", err)
+			}
+			if shallow := readShallowFile(t); shallow != nil {
+				t.Fatalf("shallow = %q after unshallowing", shallow)
+			}
+			if shallow, err := IsShallowRepository(); err != nil || shallow {
+				t.Fatalf("IsShallowRepository = %v, %v after unshallowing", shallow, err)
+			}
+			for i, hash := range history {
+				if !ObjectExists(hash) {
+					t.Errorf("commit %d deep is missing after unshallowing", i+1)
+				}
+			}
+
+			err := FetchRemote(FetchOptions{Remote: DefaultRemoteName, Unshallow: true})
+			if err == nil || !strings.Contains(err.Error(), "on a complete repository") {
+				t.Fatalf("FetchRemote --unshallow of a complete repository = %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchDeepenRequestRefusesConflicts(t *testing.T) {
+	for _, options := range []FetchOptions{
+		{Unshallow: true, Depth: 1},
+		{Unshallow: true, Deepen: 1},
+		{Depth: 1, Deepen: 1},
+	} {
+		if _, err := fetchDeepenRequest(options); err == nil {
+			t.Errorf("fetchDeepenRequest(%+v) succeeded, want an error", options)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	sidebandData     = 1
+	sidebandProgress = 2
+	sidebandError    = 3
+)
+
+// Largest packets each side-band flavour allows, header included.
+const (
+	sidebandPacketSize    = 1000
+	sideband64kPacketSize = 65520
+)
+
+// sidebandCapabilities lists the multiplexing capabilities in order of
+// preference.
+var sidebandCapabilities = []string{"side-band-64k", "side-band"}
+
+// sidebandCapability returns the side-band flavour to request, or "" when
+// the server cannot multiplex its response.
+func (a *refAdvertisement) sidebandCapability() string {
+	for _, capability := range sidebandCapabilities {
+		if a.hasCapability(capability) {
+			return capability
+		}
+	}
+	return ""
+}
+
+// progressWriter copies remote progress messages, prefixing every line with
+// "remote: " the way git does. Lines may be split across packets and end in
+// either '\n' or the '\r' progress meters use to redraw themselves.
+type progressWriter struct {
+	w       io.Writer
+	midLine bool
+}
+
+func newProgressWriter(w io.Writer) *progressWriter {
+	return &progressWriter{w: w}
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	written := len(data)
+	var out bytes.Buffer
+	for len(data) > 0 {
+		if !p.midLine {
+			out.WriteString("remote: ")
+			p.midLine = true
+		}
+
+		end := bytes.IndexAny(data, "\r\n")
+		if end < 0 {
+			out.Write(data)
+			break
+		}
+		out.Write(data[:end+1])
+		data = data[end+1:]
+		p.midLine = false
+	}
+
+	if _, err := p.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// finish terminates a progress line the remote left open.
+func (p *progressWriter) finish() {
+	if p.midLine {
+		fmt.Fprintln(p.w)
+		p.midLine = false
+	}
+}
+
+// sidebandReader demultiplexes side-band packets up to the terminating
+// flush packet, yielding the data sent on channel 1. Progress messages on
+// channel 2 are written out as they arrive and a message on channel 3 aborts
+// the transfer.
+type sidebandReader struct {
+	reader   *pktLineReader
+	progress *progressWriter
+	data     []byte
+	err      error
+}
+
+func newSidebandReader(reader *pktLineReader, progress io.Writer) *sidebandReader {
+	return &sidebandReader{reader: reader, progress: newProgressWriter(progress)}
+}
+
+func (s *sidebandReader) Read(p []byte) (int, error) {
+	for len(s.data) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.nextPacket()
+		if s.err != nil {
+			s.progress.finish()
+		}
+	}
+
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func (s *sidebandReader) nextPacket() error {
+	size, payload, err := s.reader.readPacket()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("remote end hung up unexpectedly")
+	}
+	if err != nil {
+		return fmt.Errorf("reading side-band: %s", err)
+	}
+	if size < 4 {
+		return io.EOF
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	switch payload[0] {
+	case sidebandData:
+		s.data = payload[1:]
+	case sidebandProgress:
+		s.progress.Write(payload[1:])
+	case sidebandError:
+		return fmt.Errorf("remote error: %s", bytes.TrimSpace(payload[1:]))
+	default:
+		if bytes.HasPrefix(payload, []byte("ERR ")) {
+			return fmt.Errorf("remote error: %s", bytes.TrimSpace(payload[4:]))
+		}
+		return fmt.Errorf("invalid side-band channel %d", payload[0])
+	}
+	return nil
+}
+
+// demuxSideband reads a complete side-band response into memory; it is meant
+// for small responses such as push status reports.
+func demuxSideband(reader *pktLineReader, progress io.Writer) ([]byte, error) {
+	return io.ReadAll(newSidebandReader(reader, progress))
+}
+
+// readSidebandPack returns the pack sent with side-band framing as a stream,
+// showing the server's progress on stderr.
+func readSidebandPack(reader *pktLineReader) io.Reader {
+	return newSidebandReader(reader, os.Stderr)
+}
+
+// sidebandWriter frames everything written to it as packets on one side-band
+// channel, splitting the data to fit the negotiated packet size.
+type sidebandWriter struct {
+	w          io.Writer
+	channel    byte
+	packetSize int
+}
+
+func newSidebandWriter(w io.Writer, channel byte, packetSize int) *sidebandWriter {
+	return &sidebandWriter{w: w, channel: channel, packetSize: packetSize}
+}
+
+func (s *sidebandWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > s.packetSize-5 {
+			n = s.packetSize - 5
+		}
+
+		packet := make([]byte, 0, n+5)
+		packet = append(packet, fmt.Sprintf("%04x", n+5)...)
+		packet = append(packet, s.channel)
+		packet = append(packet, data[:n]...)
+		if _, err := s.w.Write(packet); err != nil {
+			return written, err
+		}
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
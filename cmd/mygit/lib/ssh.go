@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sshRemote is a repository reached by running its service through an ssh
+// command and speaking the pkt-line protocol over the command's standard
+// input and output.
+type sshRemote struct {
+	host string
+	port string
+	path string
+}
+
+// isSSHURL reports whether url is an ssh:// URL or an scp-like
+// [user@]host:path address.
+func isSSHURL(url string) bool {
+	for _, scheme := range []string{"ssh://", "git+ssh://", "ssh+git://"} {
+		if strings.HasPrefix(url, scheme) {
+			return true
+		}
+	}
+	return !strings.Contains(url, "://") && !IsLocalURL(url)
+}
+
+func newSSHTransport(url string) (*streamTransport, error) {
+	remote := &sshRemote{}
+	if _, rest, found := strings.Cut(url, "://"); found {
+		hostPort, path, _ := strings.Cut(rest, "/")
+		remote.host, remote.port = splitHostPort(hostPort)
+		// ssh://host/~user/repo is relative to that user's home directory
+		remote.path = "/" + path
+		if strings.HasPrefix(path, "~") {
+			remote.path = path
+		}
+	} else {
+		colon := strings.Index(url, ":")
+		if strings.HasPrefix(url, "[") {
+			colon = strings.Index(url, "]:") + 1
+		}
+		remote.host = strings.Trim(url[:colon], "[]")
+		remote.path = url[colon+1:]
+	}
+
+	if remote.host == "" || remote.path == "" || remote.path == "/" {
+		return nil, fmt.Errorf("invalid ssh URL: %s", url)
+	}
+	if strings.HasPrefix(remote.host, "-") {
+		return nil, fmt.Errorf("strange hostname '%s' blocked", remote.host)
+	}
+	return &streamTransport{host: remote.host, connect: remote.connect}, nil
+}
+
+// splitHostPort separates an optional port from host, which may be a
+// bracketed IPv6 address.
+func splitHostPort(hostPort string) (string, string) {
+	if strings.HasPrefix(hostPort, "[") {
+		if end := strings.Index(hostPort, "]"); end >= 0 {
+			host, rest := hostPort[1:end], hostPort[end+1:]
+			return host, strings.TrimPrefix(rest, ":")
+		}
+	}
+	host, port, _ := strings.Cut(hostPort, ":")
+	return host, port
+}
+
+// connect runs service on the remote host.
+func (t *sshRemote) connect(service string) (*streamConn, error) {
+	program, useShell, err := sshCommand()
+	if err != nil {
+		return nil, err
+	}
+	variant, err := sshVariant(program)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	switch variant {
+	case "ssh":
+		if service == UploadPackService {
+			args = append(args, "-o", "SendEnv=GIT_PROTOCOL")
+		}
+		if t.port != "" {
+			args = append(args, "-p", t.port)
+		}
+	case "plink", "putty", "tortoiseplink":
+		if variant == "tortoiseplink" {
+			args = append(args, "-batch")
+		}
+		if t.port != "" {
+			args = append(args, "-P", t.port)
+		}
+	default:
+		if t.port != "" {
+			return nil, fmt.Errorf("ssh variant '%s' does not support setting port", variant)
+		}
+	}
+	args = append(args, t.host, fmt.Sprintf("%s %s", service, shellQuote(t.path)))
+
+	var cmd *exec.Cmd
+	if useShell {
+		cmd = exec.Command("sh", append([]string{"-c", program + ` "$@"`, program}, args...)...)
+	} else {
+		cmd = exec.Command(program, args...)
+	}
+	cmd.Env = os.Environ()
+	if service == UploadPackService {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL=version=2")
+	}
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot run ssh: %s", err)
+	}
+	return newStreamConn(stdout, stdin, func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}), nil
+}
+
+// sshCommand returns the command that connects to remote hosts and whether
+// it has to be run by the shell: GIT_SSH_COMMAND, then core.sshCommand,
+// then the program named by GIT_SSH, then ssh.
+func sshCommand() (string, bool, error) {
+	if command := os.Getenv("GIT_SSH_COMMAND"); command != "" {
+		return command, true, nil
+	}
+
+	config, err := ReadRepositoryConfig()
+	if err != nil {
+		return "", false, err
+	}
+	if command, ok := config.Get("core.sshCommand"); ok && command != "" {
+		return command, true, nil
+	}
+
+	if program := os.Getenv("GIT_SSH"); program != "" {
+		return program, false, nil
+	}
+	return "ssh", false, nil
+}
+
+// sshVariant decides which options the ssh command understands, from
+// GIT_SSH_VARIANT, ssh.variant or the name of the command. Commands we do
+// not recognise are only given the host and the remote command.
+func sshVariant(command string) (string, error) {
+	variant := os.Getenv("GIT_SSH_VARIANT")
+	if variant == "" {
+		config, err := ReadRepositoryConfig()
+		if err != nil {
+			return "", err
+		}
+		variant, _ = config.Get("ssh.variant")
+	}
+	if variant != "" && variant != "auto" {
+		return variant, nil
+	}
+
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "simple", nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(fields[0])), ".exe")
+	switch name {
+	case "ssh", "plink", "putty", "tortoiseplink":
+		return name, nil
+	}
+	return "simple", nil
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
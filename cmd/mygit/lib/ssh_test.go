@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSSH writes a script that stands in for ssh: it logs its arguments and
+// runs the remote command with the test binary, which serves it from
+// TestMain.
+func fakeSSH(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "fake-ssh")
+	log := filepath.Join(dir, "ssh.log")
+	contents := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %s
+for command; do :; done
+eval "set -- $command"
+service=$1
+shift
+exec %s "${service#git-}" "$@"
+`, shellQuote(log), shellQuote(executable))
+	if err := os.WriteFile(script, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, log
+}
+
+func TestSSHCloneAndPush(t *testing.T) {
+	isolateTest(t)
+	dir := t.TempDir()
+	serverDir := filepath.Join(dir, "server repo.git")
+	initTestRepository(t, serverDir)
+	tip := newTestHistory(t, 3)
+	SetGitDir(DefaultGitDir)
+
+	script, log := fakeSSH(t, dir)
+	t.Setenv("GIT_SSH_COMMAND", shellQuote(script))
+
+	CloneRepository("git@example.com:"+serverDir, filepath.Join(dir, "client"), CloneOptions{})
+	if head, err := ResolveRef("HEAD"); err != nil || head != tip {
+		t.Fatalf("cloned HEAD = %s, %v, want %s", head, err, tip)
+	}
+
+	pushed := writeTestCommit(t, "pushed over ssh\n", tip)
+	if err := UpdateRef("refs/heads/main", pushed); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushRemote(PushOptions{Remote: DefaultRemoteName}); err != nil {
+		t.Fatalf("PushRemote: %s", err)
+	}
+	if head := serverRef(t, serverDir, "refs/heads/main"); head != pushed {
+		t.Fatalf("server main = %s, want %s", head, pushed)
+	}
+
+	// A port needs a variant that knows how to pass it on
+	t.Setenv("GIT_SSH_VARIANT", "ssh")
+	if err := FetchRemote(FetchOptions{Remote: "ssh://git@example.com:2222" + serverDir}); err != nil {
+		t.Fatalf("FetchRemote: %s", err)
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{
+		fmt.Sprintf("git@example.com git-upload-pack %s", shellQuote(serverDir)),
+		fmt.Sprintf("git@example.com git-receive-pack %s", shellQuote(serverDir)),
+		fmt.Sprintf("-o SendEnv=GIT_PROTOCOL -p 2222 git@example.com git-upload-pack %s", shellQuote(serverDir)),
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("ssh was run as %q, want %q", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("ssh call %d = %q, want %q", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestSSHURLs(t *testing.T) {
+	tests := []struct {
+		url     string
+		host    string
+		wantErr bool
+	}{
+		{url: "ssh://example.com/repo.git", host: "example.com"},
+		{url: "git@example.com:org/repo.git", host: "git@example.com"},
+		{url: "[::1]:repo.git", host: "::1"},
+		{url: "ssh://-oProxyCommand=evil/repo.git", wantErr: true},
+		{url: "ssh://example.com/", wantErr: true},
+	}
+	for _, test := range tests {
+		remote, err := newSSHTransport(test.url)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("newSSHTransport(%q) succeeded, want an error", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newSSHTransport(%q): %s", test.url, err)
+		} else if remote.host != test.host {
+			t.Errorf("newSSHTransport(%q) host = %q, want %q", test.url, remote.host, test.host)
+		}
+	}
+}
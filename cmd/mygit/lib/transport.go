@@ -0,0 +1,268 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// transport reaches a remote repository for fetching and pushing.
+type transport interface {
+	// discoverRefs returns the refs and capabilities the remote advertises
+	// for service. Protocol v2 lists only the refs under refPrefixes.
+	discoverRefs(service string, refPrefixes []string) (*refAdvertisement, error)
+	// fetchPack stores the objects fetch asks for, returning the path of the
+	// pack it received, if any, and the shallow boundary changes.
+	fetchPack(advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (string, *shallowInfo, error)
+	// sendPack asks the remote to apply updates, sending the objects they
+	// need, and records the remote's verdict on each of them.
+	sendPack(advertisement *refAdvertisement, updates []*pushUpdate) error
+	// close ends the session with the remote.
+	close() error
+}
+
+// serviceConn carries requests to a remote upload-pack or receive-pack.
+type serviceConn interface {
+	// roundTrip sends request and returns the stream its response is read
+	// from. Closing the stream does not end the connection.
+	roundTrip(request io.Reader) (io.ReadCloser, error)
+	// stateless reports whether the service forgets the negotiation between
+	// requests, as it does over HTTP, so that every request must repeat it.
+	stateless() bool
+}
+
+// openTransport picks the transport for url: smart HTTP for http and https
+// URLs, an ssh command for ssh:// URLs and scp-like addresses, a TCP
+// connection to git daemon for git:// URLs, upload-pack run in this process
+// for file:// URLs, and direct access for local paths.
+func openTransport(url string) (transport, error) {
+	switch {
+	case strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://"):
+		return newHTTPTransport(url)
+	case strings.HasPrefix(url, "git://"):
+		return newDaemonTransport(url)
+	case isSSHURL(url):
+		return newSSHTransport(url)
+	case IsLocalURL(url) && isBundleFile(strings.TrimPrefix(url, "file://")):
+		return newBundleTransport(url)
+	case strings.HasPrefix(url, "file://"):
+		return newFileTransport(url)
+	case IsLocalURL(url):
+		return newLocalTransport(url)
+	}
+	return nil, fmt.Errorf("unsupported URL: %s", url)
+}
+
+// IsLocalURL reports whether url names a repository on this machine, either
+// as a file:// URL or as a plain path.
+func IsLocalURL(url string) bool {
+	if strings.HasPrefix(url, "file://") {
+		return true
+	}
+	if strings.Contains(url, "://") {
+		return false
+	}
+	// scp-like "host:path" addresses have a colon before any slash
+	colon := strings.Index(url, ":")
+	return colon < 0 || strings.Contains(url[:colon], "/")
+}
+
+// storeNegotiatedPack negotiates the objects fetch asks for over conn and
+// writes the pack the server sends into the object store.
+func storeNegotiatedPack(conn serviceConn, advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (string, *shallowInfo, error) {
+	packfile, shallow, err := negotiatePackfile(conn, advertisement, fetch, walker)
+	if err != nil {
+		return "", nil, err
+	}
+	defer packfile.Close()
+
+	packPath, err := writePackfile(packfile)
+	return packPath, shallow, err
+}
+
+// httpTransport speaks the smart HTTP protocol, falling back to fetching
+// files from dumb servers that only serve the repository as it is on disk.
+type httpTransport struct {
+	url    string
+	client *httpClient
+	dumb   bool
+}
+
+// discoverRefs fetches the ref advertisement, preferring protocol v2.
+func (t *httpTransport) discoverRefs(service string, refPrefixes []string) (*refAdvertisement, error) {
+	packFileResponse, err := t.getInfoRefs(service)
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.status == http.StatusNotFound {
+		return nil, fmt.Errorf("repository '%s' not found", t.url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer packFileResponse.Body.Close()
+
+	// Dumb servers hand out the info/refs file with a generic type
+	contentType, _, _ := strings.Cut(packFileResponse.Header.Get("Content-Type"), ";")
+	if strings.TrimSpace(contentType) != fmt.Sprintf("application/x-%s-advertisement", service) {
+		return t.discoverDumbRefs(service, packFileResponse.Body)
+	}
+
+	packLines, err := readRefAdvertisement(newPktLineReader(packFileResponse.Body))
+	if err != nil {
+		return nil, err
+	}
+	if isProtocolV2(packLines) {
+		advertisement := parseV2CapabilityAdvertisement(packLines)
+		return advertisement, advertisement.listRefs(t.conn(service, 2), refPrefixes)
+	}
+	return parseRefAdvertisement(packLines)
+}
+
+func (t *httpTransport) fetchPack(advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (string, *shallowInfo, error) {
+	if t.dumb {
+		return t.fetchDumbObjects(fetch)
+	}
+	return storeNegotiatedPack(t.conn(UploadPackService, advertisement.version), advertisement, fetch, walker)
+}
+
+func (t *httpTransport) sendPack(advertisement *refAdvertisement, updates []*pushUpdate) error {
+	return sendPushUpdates(t.conn(ReceivePackService, advertisement.version), advertisement, updates)
+}
+
+func (t *httpTransport) close() error {
+	return nil
+}
+
+// getInfoRefs requests the advertisement of service, asking for protocol v2
+// when fetching.
+func (t *httpTransport) getInfoRefs(service string) (*http.Response, error) {
+	header := make(http.Header)
+	if service == UploadPackService {
+		header.Set("Git-Protocol", "version=2")
+	}
+	return t.client.do("GET", fmt.Sprintf("%s/info/refs?service=%s", t.url, service), nil, header)
+}
+
+func (t *httpTransport) conn(service string, version int) *httpConn {
+	return &httpConn{url: t.url, client: t.client, service: service, version: version}
+}
+
+// httpConn posts each request to the service endpoint.
+type httpConn struct {
+	url     string
+	client  *httpClient
+	service string
+	version int
+}
+
+func (c *httpConn) roundTrip(request io.Reader) (io.ReadCloser, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", fmt.Sprintf("application/x-%s-request", c.service))
+	if c.version == 2 {
+		header.Set("Git-Protocol", "version=2")
+	}
+
+	url := fmt.Sprintf("%s/%s", c.url, c.service)
+	if _, inMemory := request.(io.Seeker); !inMemory && c.client.authorization == "" {
+		// A streamed request cannot be sent again with credentials, so find
+		// out with an empty one whether the server wants any, as git does
+		probe, err := c.client.do("POST", url, strings.NewReader(flushPkt), header)
+		if err != nil {
+			return nil, err
+		}
+		probe.Body.Close()
+	}
+
+	response, err := c.client.do("POST", url, request, header)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (c *httpConn) stateless() bool {
+	return true
+}
+
+// streamTransport reaches the remote service over a single connection, such
+// as an ssh command or a git:// socket, which it keeps open from the ref
+// advertisement until the transport is closed.
+type streamTransport struct {
+	host    string
+	connect func(service string) (*streamConn, error)
+	conn    *streamConn
+}
+
+// discoverRefs starts the remote service and reads its advertisement.
+func (t *streamTransport) discoverRefs(service string, refPrefixes []string) (*refAdvertisement, error) {
+	t.close()
+	conn, err := t.connect(service)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+
+	lines, err := readRefAdvertisement(newPktLineReader(conn.r))
+	if err != nil {
+		return nil, err
+	}
+
+	if isProtocolV2(lines) {
+		advertisement := parseV2CapabilityAdvertisement(lines)
+		return advertisement, advertisement.listRefs(conn, refPrefixes)
+	}
+	return parseRefAdvertisement(lines)
+}
+
+func (t *streamTransport) fetchPack(advertisement *refAdvertisement, fetch fetchRequest, walker *haveWalker) (string, *shallowInfo, error) {
+	if t.conn == nil {
+		return "", nil, fmt.Errorf("not connected to %s", t.host)
+	}
+	return storeNegotiatedPack(t.conn, advertisement, fetch, walker)
+}
+
+func (t *streamTransport) sendPack(advertisement *refAdvertisement, updates []*pushUpdate) error {
+	if t.conn == nil {
+		return fmt.Errorf("not connected to %s", t.host)
+	}
+	return sendPushUpdates(t.conn, advertisement, updates)
+}
+
+func (t *streamTransport) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.close()
+	t.conn = nil
+	return err
+}
+
+// streamConn is a running remote service. Its output is buffered once so
+// that consecutive responses can be read from it.
+type streamConn struct {
+	r      *bufio.Reader
+	w      io.Writer
+	finish func() error
+}
+
+func newStreamConn(r io.Reader, w io.Writer, finish func() error) *streamConn {
+	return &streamConn{r: bufio.NewReader(r), w: w, finish: finish}
+}
+
+func (c *streamConn) roundTrip(request io.Reader) (io.ReadCloser, error) {
+	if _, err := io.Copy(c.w, request); err != nil {
+		return nil, fmt.Errorf("writing to remote: %s", err)
+	}
+	return io.NopCloser(c.r), nil
+}
+
+func (c *streamConn) stateless() bool {
+	return false
+}
+
+// close ends the session with a flush packet, which a service still waiting
+// for a request takes as a goodbye, and releases the connection.
+func (c *streamConn) close() error {
+	c.w.Write([]byte(flushPkt))
+	return c.finish()
+}
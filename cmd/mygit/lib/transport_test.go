@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRefAdvertisement(t *testing.T) {
+	hash := strings.Repeat("a", 40)
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "smart HTTP v0",
+			body: encodePktLine("# service=git-upload-pack\n") + flushPkt +
+				encodePktLine(hash+" HEAD\x00multi_ack symref=HEAD:refs/heads/main\n") + encodePktLine(hash+" refs/heads/main\n") + flushPkt,
+			want: []string{hash + " HEAD\x00multi_ack symref=HEAD:refs/heads/main", hash + " refs/heads/main"},
+		},
+		{
+			name: "v2",
+			body: encodePktLine("version 2\n") + encodePktLine("ls-refs\n") + encodePktLine("fetch=shallow\n") + flushPkt,
+			want: []string{"version 2", "ls-refs", "fetch=shallow"},
+		},
+		{
+			name: "empty repository",
+			body: encodePktLine(ZeroHash+" capabilities^{}\x00report-status\n") + flushPkt,
+			want: []string{ZeroHash + " capabilities^{}\x00report-status"},
+		},
+		{
+			name: "empty packet",
+			body: "0004" + encodePktLine(hash+" refs/heads/main\n") + flushPkt,
+			want: []string{"", hash + " refs/heads/main"},
+		},
+		{name: "remote error", body: encodePktLine("ERR access denied\n"), wantErr: "remote error: access denied"},
+		{name: "no flush", body: encodePktLine(hash + " refs/heads/main\n"), wantErr: "could not read from remote repository"},
+		{name: "empty body", body: "", wantErr: "could not read from remote repository"},
+		{name: "short body", body: "00", wantErr: "could not read from remote repository"},
+		{name: "bad length", body: "zzzz", wantErr: `invalid pkt-line header "zzzz"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines, err := readRefAdvertisement(newPktLineReader(strings.NewReader(test.body)))
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("readRefAdvertisement error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readRefAdvertisement: %s", err)
+			}
+			var got []string
+			for _, line := range lines {
+				got = append(got, string(line))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("readRefAdvertisement = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHTTPDiscoverRefsRefusesMalformedAdvertisements(t *testing.T) {
+	isolateTest(t)
+	for _, body := range []string{"", "00", "0004", "zzzz", encodePktLine("# service=git-upload-pack\n") + flushPkt + "0004"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", UploadPackService))
+			fmt.Fprint(w, body)
+		}))
+		remote, err := newHTTPTransport(server.URL + "/repo.git")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if advertisement, err := remote.discoverRefs(UploadPackService, nil); err == nil {
+			t.Errorf("discoverRefs of %q = %+v, want an error", body, advertisement)
+		}
+		server.Close()
+	}
+}
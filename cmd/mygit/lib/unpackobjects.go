@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// UnpackObjectsOptions controls how UnpackObjects checks and stores objects.
+type UnpackObjectsOptions struct {
+	// DryRun checks the pack without writing anything
+	DryRun bool
+	// Strict refuses objects that are malformed or that refer to objects
+	// neither the pack nor the repository has
+	Strict bool
+}
+
+// unpackedObject is a pack entry once resolved, or the reason it could not
+// be.
+type unpackedObject struct {
+	entry   *packObject
+	hash    string
+	objType string
+	links   []string
+	// staged is set once the object is written to the staging directory
+	staged bool
+	err    error
+}
+
+// UnpackObjects reads a pack from r and writes each of its objects to the
+// repository as a loose object. An object that cannot be resolved, or with
+// Strict fails its checks, is reported and skipped while the others are
+// still written; the error returned then counts the failures.
+func UnpackObjects(r io.Reader, options UnpackObjectsOptions) error {
+	if !isGitDir(GitDir) {
+		return fmt.Errorf("not a git repository")
+	}
+
+	pack, err := spoolPack(PackDir, r, true)
+	if err != nil {
+		return err
+	}
+	defer pack.discard()
+
+	objects := make([]*unpackedObject, len(pack.objects))
+	for i, entry := range pack.objects {
+		objects[i] = &unpackedObject{entry: entry}
+	}
+
+	// Strict can only check links against the whole pack, so the objects
+	// are staged in a directory of their own until it has
+	staging := ""
+	if options.Strict && !options.DryRun {
+		staging, err = os.MkdirTemp(ObjectsDir, "tmp_objdir-unpack-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(staging)
+	}
+
+	err = resolveUnpackedObjects(pack.file, objects, func(object *unpackedObject, data []byte) error {
+		if options.Strict {
+			var err error
+			if object.links, err = parseObjectLinks(data, object.objType); err != nil {
+				return err
+			}
+		}
+		if options.DryRun || ObjectExists(object.hash) {
+			return nil
+		}
+		if staging != "" {
+			object.staged = true
+			return writeStagedObject(staging, object.hash, encodeObject(data, object.objType))
+		}
+		_, err := WriteObject(encodeObject(data, object.objType))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if options.Strict {
+		checkPackLinks(objects)
+	}
+	if staging != "" {
+		if err := moveStagedObjects(staging, objects); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, object := range objects {
+		if object.err != nil {
+			failed++
+			if object.hash != "" {
+				fmt.Fprintf(os.Stderr, "error: object %s at offset %d: %s\n", object.hash, object.entry.offset, object.err)
+			} else {
+				fmt.Fprintf(os.Stderr, "error: object at offset %d: %s\n", object.entry.offset, object.err)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects could not be unpacked", failed, len(objects))
+	}
+	fmt.Fprintf(os.Stderr, "Unpacking objects: 100%% (%d/%d), done.\n", len(objects), len(objects))
+	return nil
+}
+
+// resolveUnpackedObjects resolves the pack, recording the name and type of
+// each object and handing it to visit unless it already failed. Why an
+// object fails is recorded along with it.
+func resolveUnpackedObjects(pack io.ReaderAt, objects []*unpackedObject, visit func(object *unpackedObject, data []byte) error) error {
+	entries := make([]*packObject, len(objects))
+	byEntry := make(map[*packObject]*unpackedObject)
+	for i, object := range objects {
+		entries[i] = object.entry
+		byEntry[object.entry] = object
+	}
+
+	_, failures, err := resolvePack(pack, entries, func(entry *packObject, hash string, data []byte, objType string) error {
+		object := byEntry[entry]
+		object.hash = hash
+		object.objType = objType
+		if object.err != nil {
+			return nil
+		}
+		return visit(object, data)
+	})
+	if err != nil {
+		return err
+	}
+	for entry, err := range failures {
+		if object := byEntry[entry]; object.err == nil {
+			object.err = err
+		}
+	}
+	return nil
+}
+
+// checkPackLinks fails the objects that refer to an object neither in the
+// pack, among those that unpacked cleanly, nor in the repository.
+func checkPackLinks(objects []*unpackedObject) {
+	present := make(map[string]bool)
+	for _, object := range objects {
+		if object.err == nil {
+			present[object.hash] = true
+		}
+	}
+	for _, object := range objects {
+		if object.err != nil {
+			continue
+		}
+		for _, link := range object.links {
+			if !present[link] && !ObjectExists(link) {
+				object.err = fmt.Errorf("broken link to %s", link)
+				break
+			}
+		}
+	}
+}
+
+// writeStagedObject writes a loose object into the staging directory,
+// named by its hash alone.
+func writeStagedObject(staging, hash string, obj []byte) error {
+	zObj, err := compressBytes(obj)
+	if err != nil {
+		return fmt.Errorf("compressing object: %s", err)
+	}
+	return WriteFile(filepath.Join(staging, hash), zObj)
+}
+
+// moveStagedObjects moves the staged objects that passed their checks into
+// the object store. The others are left to be removed with the staging
+// directory.
+func moveStagedObjects(staging string, objects []*unpackedObject) error {
+	for _, object := range objects {
+		if !object.staged || object.err != nil {
+			continue
+		}
+		objectDir := filepath.Join(ObjectsDir, object.hash[:2])
+		if err := os.MkdirAll(objectDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(staging, object.hash), filepath.Join(objectDir, object.hash[2:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newUnpackTest writes a history of three commits to a source repository
+// and returns its objects, leaving an empty repository current to unpack
+// them into.
+func newUnpackTest(t *testing.T) []packableObject {
+	t.Helper()
+	isolateTest(t)
+	initTestRepository(t, filepath.Join(t.TempDir(), "source.git"))
+	objects, err := listObjects([]string{newTestHistory(t, 3)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+// packEntries reads objects from the current repository as pack entries.
+func packEntries(t *testing.T, objects []packableObject) [][]byte {
+	t.Helper()
+	var entries [][]byte
+	for _, object := range objects {
+		data, objType, _, err := ReadObjectFile(object.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := encodePackEntry(data, objType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func unpackInto(t *testing.T, pack []byte, options UnpackObjectsOptions) error {
+	t.Helper()
+	initTestRepository(t, filepath.Join(t.TempDir(), "target.git"))
+	return UnpackObjects(bytes.NewReader(pack), options)
+}
+
+func countPresent(objects []packableObject) int {
+	present := 0
+	for _, object := range objects {
+		if ObjectFileExists(object.hash) {
+			present++
+		}
+	}
+	return present
+}
+
+func assertNoStaging(t *testing.T) {
+	t.Helper()
+	left, err := filepath.Glob(filepath.Join(ObjectsDir, "tmp_objdir-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Errorf("staging directories left behind: %q", left)
+	}
+}
+
+func TestUnpackObjects(t *testing.T) {
+	objects := newUnpackTest(t)
+	pack, err := buildPackfile(objects, defaultPackOptions(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, options := range []UnpackObjectsOptions{{}, {Strict: true}} {
+		if err := unpackInto(t, pack, options); err != nil {
+			t.Fatalf("UnpackObjects(%+v): %s", options, err)
+		}
+		if present := countPresent(objects); present != len(objects) {
+			t.Errorf("UnpackObjects(%+v) wrote %d of %d objects", options, present, len(objects))
+		}
+		assertNoStaging(t)
+	}
+
+	for _, options := range []UnpackObjectsOptions{{DryRun: true}, {DryRun: true, Strict: true}} {
+		if err := unpackInto(t, pack, options); err != nil {
+			t.Fatalf("UnpackObjects(%+v): %s", options, err)
+		}
+		if present := countPresent(objects); present != 0 {
+			t.Errorf("UnpackObjects(%+v) wrote %d objects", options, present)
+		}
+		assertNoStaging(t)
+	}
+}
+
+func TestUnpackObjectsStrictRefusesBrokenLinks(t *testing.T) {
+	objects := newUnpackTest(t)
+	// Without its trees, every commit links to an object nobody has
+	var withoutTrees []packableObject
+	for _, object := range objects {
+		if object.objType != "tree" {
+			withoutTrees = append(withoutTrees, object)
+		}
+	}
+	pack := testPack(t, packEntries(t, withoutTrees)...)
+
+	err := unpackInto(t, pack, UnpackObjectsOptions{Strict: true})
+	if err == nil || !strings.Contains(err.Error(), "3 of 6 objects could not be unpacked") {
+		t.Fatalf("UnpackObjects = %v, want the three commits refused", err)
+	}
+	for _, object := range withoutTrees {
+		if exists := ObjectFileExists(object.hash); exists != (object.objType == "blob") {
+			t.Errorf("%s %s present = %v after a strict unpack", object.objType, object.hash, exists)
+		}
+	}
+	assertNoStaging(t)
+
+	// Without Strict, nothing is checked
+	if err := unpackInto(t, pack, UnpackObjectsOptions{}); err != nil {
+		t.Fatalf("UnpackObjects: %s", err)
+	}
+	if present := countPresent(withoutTrees); present != len(withoutTrees) {
+		t.Errorf("UnpackObjects wrote %d of %d objects", present, len(withoutTrees))
+	}
+}
+
+func TestUnpackObjectsSkipsFailedObjects(t *testing.T) {
+	objects := newUnpackTest(t)
+	// A delta against a base nobody has fails on its own
+	entries := append(packEntries(t, objects), refDeltaEntry(t, strings.Repeat("1", 40), []byte("\x00\x01\x01x")))
+	pack := testPack(t, entries...)
+
+	for _, options := range []UnpackObjectsOptions{{}, {Strict: true}} {
+		err := unpackInto(t, pack, options)
+		if err == nil || !strings.Contains(err.Error(), "1 of 10 objects could not be unpacked") {
+			t.Fatalf("UnpackObjects(%+v) = %v, want the delta refused", options, err)
+		}
+		if present := countPresent(objects); present != len(objects) {
+			t.Errorf("UnpackObjects(%+v) wrote %d of %d objects", options, present, len(objects))
+		}
+		assertNoStaging(t)
+	}
+}
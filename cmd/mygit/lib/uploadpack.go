@@ -0,0 +1,862 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const serverAgent = "agent=mygit"
+
+// uploadPackCapabilities are advertised in protocol v0, along with the
+// symref of HEAD.
+var uploadPackCapabilities = []string{
+	"multi_ack", "thin-pack", "side-band", "side-band-64k", "ofs-delta",
+	"multi_ack_detailed", "no-progress", "include-tag", "shallow", "deepen-since",
+	"deepen-not", "deepen-relative", "filter", "allow-tip-sha1-in-want",
+	"allow-reachable-sha1-in-want", "object-format=sha1", serverAgent,
+}
+
+// uploadPackV2Capabilities are advertised in protocol v2.
+var uploadPackV2Capabilities = []string{serverAgent, "ls-refs", "fetch=shallow filter", "object-format=sha1"}
+
+// UploadPackOptions selects how upload-pack talks to its client.
+type UploadPackOptions struct {
+	// StatelessRPC serves a single request without an advertisement, as
+	// over smart HTTP
+	StatelessRPC bool
+	// AdvertiseRefs only writes the advertisement
+	AdvertiseRefs bool
+	// Protocol is what the client asked for through GIT_PROTOCOL or the
+	// Git-Protocol header, such as "version=2"
+	Protocol string
+	// AllowAnySHA1InWant serves any object the repository has, not only
+	// those its refs reach; it is meant for clients as trusted as the
+	// repository's owner, such as file:// fetches
+	AllowAnySHA1InWant bool
+}
+
+// UploadPack serves a fetch from the repository at dir: it advertises the
+// refs, negotiates with the client what it lacks and sends that as a pack.
+func UploadPack(dir string, r io.Reader, w io.Writer, options UploadPackOptions) error {
+	gitDir, err := findGitDir(dir)
+	if err != nil {
+		return err
+	}
+	return withGitDir(gitDir, func() error {
+		out := bufio.NewWriter(w)
+		err := serveUploadPack(newPktLineReader(r), out, options)
+		if flushErr := out.Flush(); err == nil {
+			err = flushErr
+		}
+		return err
+	})
+}
+
+func serveUploadPack(reader *pktLineReader, w *bufio.Writer, options UploadPackOptions) error {
+	advertisement, err := advertiseLocalRefs()
+	if err != nil {
+		return err
+	}
+
+	if requestsProtocolV2(options.Protocol) {
+		if !options.StatelessRPC || options.AdvertiseRefs {
+			writeV2Advertisement(w)
+			if options.AdvertiseRefs {
+				return nil
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		return serveV2Commands(reader, w, advertisement, options)
+	}
+
+	if !options.StatelessRPC || options.AdvertiseRefs {
+		writeV0Advertisement(w, advertisement, uploadPackCapabilities)
+		if options.AdvertiseRefs {
+			return nil
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	session := newUploadPackSession(advertisement, options.AllowAnySHA1InWant)
+	err = session.readWants(reader)
+	var shallow *shallowInfo
+	if err == nil && len(session.wants) > 0 {
+		shallow, err = session.deepenHistory(false)
+	}
+	if err != nil {
+		fmt.Fprint(w, encodePktLine(fmt.Sprintf("ERR upload-pack: %s\n", err)))
+		return err
+	}
+	if len(session.wants) == 0 {
+		return nil
+	}
+	if session.deepen.active() {
+		// The client waits for the boundary before it sends haves
+		writeShallowInfo(w, shallow)
+		fmt.Fprint(w, flushPkt)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	done, err := session.negotiateV0(reader, w, options.StatelessRPC)
+	if err != nil || !done {
+		return err
+	}
+	return session.sendPack(w, session.sidebandSize)
+}
+
+// requestsProtocolV2 reports whether a GIT_PROTOCOL value, a colon separated
+// list of key=value pairs, asks for version 2.
+func requestsProtocolV2(protocol string) bool {
+	for _, parameter := range strings.Split(protocol, ":") {
+		if parameter == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// advertiseLocalRefs lists the repository's refs as upload-pack advertises
+// them: HEAD first, then every ref, with peeled tags following their tag.
+func advertiseLocalRefs() (*refAdvertisement, error) {
+	advertisement := &refAdvertisement{symrefs: make(map[string]string)}
+	head, err := ResolveRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		advertisement.refs = append(advertisement.refs, Ref{Hash: head, Name: "HEAD"})
+	}
+	if target, _ := ReadSymbolicRef("HEAD"); target != "" {
+		advertisement.symrefs["HEAD"] = target
+	}
+
+	refs, err := ListRefs("refs/")
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		advertisement.refs = append(advertisement.refs, ref)
+		if !strings.HasPrefix(ref.Name, "refs/tags/") {
+			continue
+		}
+		if peeled, err := peelToCommit(ref.Hash); err == nil && peeled != ref.Hash {
+			advertisement.refs = append(advertisement.refs, Ref{Hash: peeled, Name: ref.Name + "^{}"})
+		}
+	}
+	return advertisement, nil
+}
+
+// writeV0Advertisement lists the refs with the service's capabilities
+// attached to the first one.
+func writeV0Advertisement(w io.Writer, advertisement *refAdvertisement, serviceCapabilities []string) {
+	capabilities := append([]string{}, serviceCapabilities...)
+	if target, ok := advertisement.symrefs["HEAD"]; ok {
+		capabilities = append(capabilities, "symref=HEAD:"+target)
+	}
+
+	if len(advertisement.refs) == 0 {
+		fmt.Fprint(w, encodePktLine(fmt.Sprintf("%s capabilities^{}\x00%s\n", ZeroHash, strings.Join(capabilities, " "))))
+	}
+	for i, ref := range advertisement.refs {
+		if i == 0 {
+			fmt.Fprint(w, encodePktLine(fmt.Sprintf("%s %s\x00%s\n", ref.Hash, ref.Name, strings.Join(capabilities, " "))))
+		} else {
+			fmt.Fprint(w, encodePktLine(fmt.Sprintf("%s %s\n", ref.Hash, ref.Name)))
+		}
+	}
+	fmt.Fprint(w, flushPkt)
+}
+
+func writeV2Advertisement(w io.Writer) {
+	fmt.Fprint(w, encodePktLine("version 2\n"))
+	for _, capability := range uploadPackV2Capabilities {
+		fmt.Fprint(w, encodePktLine(capability+"\n"))
+	}
+	fmt.Fprint(w, flushPkt)
+}
+
+// serveV2Commands runs the client's commands until it ends the session. A
+// stateless server runs exactly one.
+func serveV2Commands(reader *pktLineReader, w *bufio.Writer, advertisement *refAdvertisement, options UploadPackOptions) error {
+	for {
+		command, arguments, err := readV2Command(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch command {
+		case "":
+			// A flush instead of a command ends the session
+			return nil
+		case "ls-refs":
+			err = serveLsRefs(w, advertisement, arguments)
+		case "fetch":
+			err = newUploadPackSession(advertisement, options.AllowAnySHA1InWant).serveV2Fetch(w, arguments)
+		default:
+			err = fmt.Errorf("invalid command '%s'", command)
+			fmt.Fprint(w, encodePktLine(fmt.Sprintf("ERR %s\n", err)))
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if options.StatelessRPC {
+			return nil
+		}
+	}
+}
+
+// readV2Command reads a command request: the command, its capabilities up
+// to a delimiter and its arguments up to a flush.
+func readV2Command(reader *pktLineReader) (string, []string, error) {
+	var command string
+	var arguments []string
+	inArguments := false
+	for first := true; ; first = false {
+		size, payload, err := reader.readPacket()
+		if err == io.EOF && first {
+			return "", nil, io.EOF
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("reading command: %s", err)
+		}
+
+		switch {
+		case size == 0:
+			return command, arguments, nil
+		case size == 1:
+			inArguments = true
+		case size < 4:
+			return "", nil, fmt.Errorf("unexpected packet in command request")
+		case inArguments:
+			arguments = append(arguments, strings.TrimSuffix(string(payload), "\n"))
+		default:
+			line := strings.TrimSuffix(string(payload), "\n")
+			if strings.HasPrefix(line, "command=") {
+				command = strings.TrimPrefix(line, "command=")
+			}
+		}
+	}
+}
+
+// serveLsRefs answers ls-refs with the refs under the requested prefixes.
+func serveLsRefs(w io.Writer, advertisement *refAdvertisement, arguments []string) error {
+	var prefixes []string
+	symrefs, peel := false, false
+	for _, argument := range arguments {
+		switch {
+		case argument == "symrefs":
+			symrefs = true
+		case argument == "peel":
+			peel = true
+		case strings.HasPrefix(argument, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(argument, "ref-prefix "))
+		}
+	}
+
+	peeled := make(map[string]string)
+	for _, ref := range advertisement.refs {
+		if name := strings.TrimSuffix(ref.Name, "^{}"); name != ref.Name {
+			peeled[name] = ref.Hash
+		}
+	}
+
+	for _, ref := range advertisement.refs {
+		if strings.HasSuffix(ref.Name, "^{}") || !matchesRefPrefix(ref.Name, prefixes) {
+			continue
+		}
+		line := fmt.Sprintf("%s %s", ref.Hash, ref.Name)
+		if target, ok := advertisement.symrefs[ref.Name]; ok && symrefs {
+			line += " symref-target:" + target
+		}
+		if hash, ok := peeled[ref.Name]; ok && peel {
+			line += " peeled:" + hash
+		}
+		fmt.Fprint(w, encodePktLine(line+"\n"))
+	}
+	fmt.Fprint(w, flushPkt)
+	return nil
+}
+
+func matchesRefPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadPackSession tracks one negotiation: what the client wants, which of
+// its commits we share, and the capabilities it asked for.
+type uploadPackSession struct {
+	tips map[string]bool
+	// reachable are the objects the tips reach, listed the first time an
+	// object that is not a tip is wanted, unless allowAny lets clients
+	// have any object
+	reachable    map[string]bool
+	allowAny     bool
+	wants        []string
+	common       []string
+	isCommon     map[string]bool
+	oldestCommon int64
+	// reachesCommon caches the wants known to lead to a common commit;
+	// giveUpChecked is how many common commits there were when we last
+	// found that some want did not
+	reachesCommon map[string]bool
+	giveUpChecked int
+
+	multiAck     int
+	sidebandSize int
+	noProgress   bool
+	includeTag   bool
+	ofsDelta     bool
+
+	// clientShallow are the commits the client's history ends at, and
+	// deepen how much further it asked for
+	clientShallow []string
+	deepen        deepenRequest
+	filter        *objectFilter
+}
+
+func newUploadPackSession(advertisement *refAdvertisement, allowAny bool) *uploadPackSession {
+	session := &uploadPackSession{
+		tips:          make(map[string]bool),
+		allowAny:      allowAny,
+		isCommon:      make(map[string]bool),
+		reachesCommon: make(map[string]bool),
+		giveUpChecked: -1,
+	}
+	for _, ref := range advertisement.refs {
+		session.tips[ref.Hash] = true
+	}
+	return session
+}
+
+// addWant records a wanted object. Besides the tips we advertised, any
+// object they reach may be asked for, as partial clones do for the objects
+// their filter left out.
+func (s *uploadPackSession) addWant(hash string) error {
+	if ValidateHash(hash) != nil {
+		return fmt.Errorf("protocol error, expected to get object ID, not '%s'", hash)
+	}
+	ours, err := s.isOurObject(hash)
+	if err != nil {
+		return err
+	}
+	if !ours {
+		return fmt.Errorf("not our ref %s", hash)
+	}
+	s.wants = append(s.wants, hash)
+	return nil
+}
+
+// isOurObject reports whether a client may have the object: it is a tip,
+// reachable from one, or the session allows any object.
+func (s *uploadPackSession) isOurObject(hash string) (bool, error) {
+	if s.tips[hash] {
+		return true, nil
+	}
+	if s.allowAny {
+		return ObjectExists(hash), nil
+	}
+
+	if s.reachable == nil {
+		var tips []string
+		for tip := range s.tips {
+			tips = append(tips, tip)
+		}
+		objects, err := listObjects(tips, nil)
+		if err != nil {
+			return false, err
+		}
+		s.reachable = make(map[string]bool, len(objects))
+		for _, object := range objects {
+			s.reachable[object.hash] = true
+		}
+	}
+	return s.reachable[hash], nil
+}
+
+// readWants reads the v0 want lines, taking the client's capabilities from
+// the first, up to the flush that ends them.
+func (s *uploadPackSession) readWants(reader *pktLineReader) error {
+	for {
+		line, err := reader.readLine()
+		if err == io.EOF && len(s.wants) == 0 {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading wants: %s", err)
+		}
+		if line == nil {
+			return nil
+		}
+
+		fields := strings.Fields(string(line))
+		switch {
+		case len(fields) >= 2 && fields[0] == "want":
+			if len(s.wants) == 0 {
+				s.setCapabilities(fields[2:])
+			}
+			if err := s.addWant(fields[1]); err != nil {
+				return err
+			}
+		case len(fields) == 2 && (fields[0] == "shallow" || strings.HasPrefix(fields[0], "deepen")):
+			if err := s.addShallowArgument(fields[0], fields[1]); err != nil {
+				return err
+			}
+		case len(fields) == 2 && fields[0] == "filter":
+			if err := s.setFilter(fields[1]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("protocol error, unexpected '%s'", line)
+		}
+	}
+}
+
+func (s *uploadPackSession) setCapabilities(capabilities []string) {
+	for _, capability := range capabilities {
+		switch capability {
+		case "multi_ack_detailed":
+			s.multiAck = 2
+		case "multi_ack":
+			if s.multiAck == 0 {
+				s.multiAck = 1
+			}
+		case "side-band-64k":
+			s.sidebandSize = sideband64kPacketSize
+		case "side-band":
+			if s.sidebandSize == 0 {
+				s.sidebandSize = sidebandPacketSize
+			}
+		case "no-progress":
+			s.noProgress = true
+		case "include-tag":
+			s.includeTag = true
+		case "ofs-delta":
+			s.ofsDelta = true
+		case "deepen-relative":
+			s.deepen.relative = true
+		}
+	}
+}
+
+// setFilter records the filter spec the pack is to be filtered with.
+func (s *uploadPackSession) setFilter(spec string) error {
+	filter, err := parseFilterSpec(spec)
+	if err != nil {
+		return err
+	}
+	s.filter = filter
+	return nil
+}
+
+// addShallowArgument records a shallow, deepen, deepen-since or deepen-not
+// line of the request.
+func (s *uploadPackSession) addShallowArgument(keyword, value string) error {
+	switch keyword {
+	case "shallow":
+		if ValidateHash(value) != nil {
+			return fmt.Errorf("invalid shallow line: shallow %s", value)
+		}
+		// A boundary we do not have cannot limit what we send
+		if ObjectExists(value) {
+			s.clientShallow = append(s.clientShallow, value)
+		}
+	case "deepen":
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			return fmt.Errorf("invalid deepen: %s", value)
+		}
+		s.deepen.depth = depth
+	case "deepen-since":
+		since, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid deepen-since: %s", value)
+		}
+		s.deepen.since = since
+	case "deepen-not":
+		_, hash, err := resolveRevision(value)
+		if err != nil {
+			return fmt.Errorf("deepen-not is not a ref: %s", value)
+		}
+		s.deepen.exclude = append(s.deepen.exclude, hash)
+	default:
+		return fmt.Errorf("protocol error, unexpected '%s %s'", keyword, value)
+	}
+	return nil
+}
+
+// deepenHistory works out the shallow boundary of the history to send and
+// makes history walks stop there, as they do for the client. It returns the
+// boundary changes to report: new shallow commits, and those of the client
+// the deeper history goes past, whose parents are then wanted. With
+// serverShallow, a repository that is itself shallow reports its boundary
+// even to clients that did not ask to deepen.
+func (s *uploadPackSession) deepenHistory(serverShallow bool) (*shallowInfo, error) {
+	// Forget what an earlier command of the session registered
+	shallowCommits = nil
+	deepen := s.deepen
+	if shallow, err := IsShallowRepository(); err != nil {
+		return nil, err
+	} else if shallow && serverShallow && !deepen.active() {
+		deepen.depth = infiniteDepth
+	}
+
+	info := &shallowInfo{}
+	var shallow []string
+	notShallow := make(map[string]bool)
+	var err error
+	switch {
+	case deepen.depth > 0 && (deepen.since > 0 || len(deepen.exclude) > 0):
+		return nil, fmt.Errorf("deepen and deepen-since (or deepen-not) cannot be used together")
+	case deepen.depth > 0 && deepen.relative:
+		depth := deepen.depth
+		if depth < infiniteDepth {
+			depth++
+		}
+		shallow, notShallow, err = shallowCommitsByDepth(s.clientShallow, depth)
+	case deepen.depth > 0:
+		shallow, notShallow, err = shallowCommitsByDepth(s.wants, deepen.depth)
+	case deepen.active():
+		shallow, notShallow, err = shallowCommitsByRevList(s.wants, deepen.since, deepen.exclude)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	isClientShallow := make(map[string]bool)
+	for _, hash := range s.clientShallow {
+		isClientShallow[hash] = true
+		if !notShallow[hash] {
+			continue
+		}
+		commit, err := ReadCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		info.unshallow = append(info.unshallow, hash)
+		s.wants = append(s.wants, commit.Parents...)
+	}
+	for _, hash := range shallow {
+		if !isClientShallow[hash] {
+			info.shallow = append(info.shallow, hash)
+		}
+	}
+
+	// The client keeps its boundary commits, even those it now gets the
+	// parents of, so the walk of what it has stops there
+	for _, hash := range append(shallow, s.clientShallow...) {
+		if err := registerShallow(hash); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// addHave records a commit the client has, reporting whether we have it
+// too.
+func (s *uploadPackSession) addHave(hash string) bool {
+	if s.isCommon[hash] {
+		return true
+	}
+	if ValidateHash(hash) != nil || !ObjectExists(hash) {
+		return false
+	}
+
+	s.isCommon[hash] = true
+	s.common = append(s.common, hash)
+	if commit, err := ReadCommit(hash); err == nil {
+		if time := commit.CommitTime(); s.oldestCommon == 0 || time < s.oldestCommon {
+			s.oldestCommon = time
+		}
+	}
+	return true
+}
+
+// okToGiveUp reports whether every want leads down to a common commit, in
+// which case more haves would not make the pack much smaller.
+func (s *uploadPackSession) okToGiveUp() bool {
+	if len(s.common) == 0 || len(s.common) == s.giveUpChecked {
+		return false
+	}
+	for _, want := range s.wants {
+		if !s.wantReachesCommon(want) {
+			s.giveUpChecked = len(s.common)
+			return false
+		}
+	}
+	return true
+}
+
+func (s *uploadPackSession) wantReachesCommon(want string) bool {
+	if s.reachesCommon[want] {
+		return true
+	}
+	start, err := peelToCommit(want)
+	if err != nil {
+		return false
+	}
+
+	seen := make(map[string]bool)
+	queue := []string{start}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		if s.isCommon[hash] {
+			s.reachesCommon[want] = true
+			return true
+		}
+
+		commit, err := ReadCommit(hash)
+		if err != nil || commit.CommitTime() < s.oldestCommon {
+			continue
+		}
+		queue = append(queue, commit.Parents...)
+	}
+	return false
+}
+
+// negotiateV0 answers the client's haves as multi_ack, multi_ack_detailed or
+// plain negotiation prescribes until it sends done, reporting whether the
+// pack should follow. A stateless server answers a single round.
+func (s *uploadPackSession) negotiateV0(reader *pktLineReader, w *bufio.Writer, stateless bool) (bool, error) {
+	gotCommon, gotOther := false, false
+	var last string
+	for {
+		line, err := reader.readLine()
+		if err == io.EOF && !stateless {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading haves: %s", err)
+		}
+
+		if line == nil {
+			if s.multiAck == 2 && gotCommon && !gotOther && s.okToGiveUp() {
+				fmt.Fprint(w, encodePktLine(fmt.Sprintf("ACK %s ready\n", last)))
+			}
+			if len(s.common) == 0 || s.multiAck > 0 {
+				fmt.Fprint(w, encodePktLine("NAK\n"))
+			}
+			if err := w.Flush(); err != nil {
+				return false, err
+			}
+			if stateless {
+				return false, nil
+			}
+			gotCommon, gotOther = false, false
+			continue
+		}
+
+		fields := strings.Fields(string(line))
+		switch {
+		case len(fields) == 2 && fields[0] == "have":
+			hash := fields[1]
+			if s.addHave(hash) {
+				gotCommon = true
+				last = hash
+				switch {
+				case s.multiAck == 2:
+					fmt.Fprint(w, encodePktLine(fmt.Sprintf("ACK %s common\n", hash)))
+				case s.multiAck == 1:
+					fmt.Fprint(w, encodePktLine(fmt.Sprintf("ACK %s continue\n", hash)))
+				case len(s.common) == 1:
+					fmt.Fprint(w, encodePktLine(fmt.Sprintf("ACK %s\n", hash)))
+				}
+			} else {
+				gotOther = true
+				if s.multiAck > 0 && s.okToGiveUp() {
+					status := "continue"
+					if s.multiAck == 2 {
+						status = "ready"
+					}
+					fmt.Fprint(w, encodePktLine(fmt.Sprintf("ACK %s %s\n", hash, status)))
+				}
+			}
+		case len(fields) == 1 && fields[0] == "done":
+			if len(s.common) == 0 {
+				fmt.Fprint(w, encodePktLine("NAK\n"))
+			} else if s.multiAck > 0 {
+				fmt.Fprint(w, encodePktLine(fmt.Sprintf("ACK %s\n", last)))
+			}
+			return true, nil
+		default:
+			return false, fmt.Errorf("protocol error, expected have or done, not '%s'", line)
+		}
+	}
+}
+
+// serveV2Fetch answers a v2 fetch command: acknowledgements while the client
+// is still negotiating, then the packfile section.
+func (s *uploadPackSession) serveV2Fetch(w *bufio.Writer, arguments []string) error {
+	var haves []string
+	done := false
+	for _, argument := range arguments {
+		keyword, value, _ := strings.Cut(argument, " ")
+		var err error
+		switch keyword {
+		case "want":
+			err = s.addWant(value)
+		case "have":
+			haves = append(haves, value)
+		case "done":
+			done = true
+		case "no-progress":
+			s.noProgress = true
+		case "include-tag":
+			s.includeTag = true
+		case "ofs-delta":
+			s.ofsDelta = true
+		case "thin-pack":
+		case "shallow", "deepen", "deepen-since", "deepen-not":
+			err = s.addShallowArgument(keyword, value)
+		case "deepen-relative":
+			s.deepen.relative = true
+		case "filter":
+			err = s.setFilter(value)
+		default:
+			err = fmt.Errorf("unexpected line: '%s'", argument)
+		}
+		if err != nil {
+			fmt.Fprint(w, encodePktLine(fmt.Sprintf("ERR fetch: %s\n", err)))
+			return err
+		}
+	}
+	shallow, err := s.deepenHistory(true)
+	if err != nil {
+		fmt.Fprint(w, encodePktLine(fmt.Sprintf("ERR fetch: %s\n", err)))
+		return err
+	}
+
+	if !done {
+		fmt.Fprint(w, encodePktLine("acknowledgments\n"))
+		acked := false
+		for _, have := range haves {
+			if s.addHave(have) {
+				fmt.Fprint(w, encodePktLine(fmt.Sprintf("ACK %s\n", have)))
+				acked = true
+			}
+		}
+		if !acked {
+			fmt.Fprint(w, encodePktLine("NAK\n"))
+		}
+		if !s.okToGiveUp() {
+			fmt.Fprint(w, flushPkt)
+			return nil
+		}
+		fmt.Fprint(w, encodePktLine("ready\n"))
+		fmt.Fprint(w, delimPkt)
+	} else {
+		for _, have := range haves {
+			s.addHave(have)
+		}
+	}
+
+	if len(shallow.shallow)+len(shallow.unshallow) > 0 || s.deepen.active() || len(s.clientShallow) > 0 {
+		fmt.Fprint(w, encodePktLine("shallow-info\n"))
+		writeShallowInfo(w, shallow)
+		fmt.Fprint(w, delimPkt)
+	}
+	fmt.Fprint(w, encodePktLine("packfile\n"))
+	return s.sendPack(w, sideband64kPacketSize)
+}
+
+// sendPack writes the objects the client lacks as a pack, framed in side-band
+// packets when sidebandSize is not zero.
+func (s *uploadPackSession) sendPack(w *bufio.Writer, sidebandSize int) error {
+	var progress io.Writer = io.Discard
+	var packOut io.Writer = w
+	if sidebandSize > 0 {
+		packOut = newSidebandWriter(w, sidebandData, sidebandSize)
+		if !s.noProgress {
+			progress = newSidebandWriter(w, sidebandProgress, sidebandSize)
+		}
+	}
+
+	err := s.writePack(packOut, progress)
+	if err != nil && sidebandSize > 0 {
+		newSidebandWriter(w, sidebandError, sidebandSize).Write([]byte(fmt.Sprintf("upload-pack: %s\n", err)))
+	}
+	if sidebandSize > 0 {
+		fmt.Fprint(w, flushPkt)
+	}
+	return err
+}
+
+func (s *uploadPackSession) writePack(w io.Writer, progress io.Writer) error {
+	objects, err := listFilteredObjects(s.wants, s.common, s.filter)
+	if err != nil {
+		return err
+	}
+	if s.includeTag {
+		objects, err = s.addIncludedTags(objects)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(progress, "Enumerating objects: %d, done.\n", len(objects))
+	pack, err := writePackStream(w, objects, defaultPackOptions(s.ofsDelta))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(progress, "Total %d (delta %d), reused 0 (delta 0), pack-reused 0\n", len(objects), pack.deltas)
+	return nil
+}
+
+// addIncludedTags adds the annotated tags pointing at objects in the pack,
+// which include-tag asks for even though they were not wanted.
+func (s *uploadPackSession) addIncludedTags(objects []packableObject) ([]packableObject, error) {
+	inPack := make(map[string]bool)
+	for _, object := range objects {
+		inPack[object.hash] = true
+	}
+
+	tags, err := ListRefs("refs/tags/")
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		var chain []packableObject
+		hash := tag.Hash
+		for !inPack[hash] {
+			obj, objType, _, err := ReadObjectFile(hash)
+			if err != nil || objType != "tag" {
+				chain = nil
+				break
+			}
+			chain = append(chain, packableObject{hash: hash, objType: "tag"})
+			target, _, _ := strings.Cut(string(obj), "\n")
+			hash = strings.TrimPrefix(target, "object ")
+		}
+		for _, object := range chain {
+			inPack[object.hash] = true
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
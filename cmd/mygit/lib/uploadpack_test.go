@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// uploadPackRequest is a want of each object, in protocol v0 or v2.
+func uploadPackRequest(version int, wants ...string) []byte {
+	var request strings.Builder
+	if version == 2 {
+		request.WriteString(encodePktLine("command=fetch\n") + "0001")
+	}
+	for i, want := range wants {
+		line := "want " + want
+		if version == 0 && i == 0 {
+			line += " ofs-delta"
+		}
+		request.WriteString(encodePktLine(line + "\n"))
+	}
+	if version == 0 {
+		request.WriteString(flushPkt)
+	}
+	request.WriteString(encodePktLine("done\n") + flushPkt)
+	return []byte(request.String())
+}
+
+func TestUploadPackServesOnlyReachableObjects(t *testing.T) {
+	isolateTest(t)
+	gitDir := filepath.Join(t.TempDir(), "repo.git")
+	initTestRepository(t, gitDir)
+	tip := newTestHistory(t, 2)
+	commit, err := ReadCommit(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older, err := ReadCommit(commit.Parents[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := writeTestCommit(t, "deleted branch\n", tip)
+	SetGitDir(DefaultGitDir)
+
+	tests := []struct {
+		name     string
+		want     string
+		allowAny bool
+		wantErr  bool
+	}{
+		{"tip", tip, false, false},
+		{"ancestor", commit.Parents[0], false, false},
+		{"older tree", older.Tree, false, false},
+		{"unreachable commit", unreachable, false, true},
+		{"missing object", strings.Repeat("1", 40), false, true},
+		{"unreachable commit allowing any", unreachable, true, false},
+		{"missing object allowing any", strings.Repeat("1", 40), true, true},
+	}
+	for _, test := range tests {
+		for _, version := range []int{0, 2} {
+			options := UploadPackOptions{StatelessRPC: true, AllowAnySHA1InWant: test.allowAny}
+			if version == 2 {
+				options.Protocol = "version=2"
+			}
+			var response bytes.Buffer
+			err := UploadPack(gitDir, bytes.NewReader(uploadPackRequest(version, test.want)), &response, options)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "not our ref") {
+					t.Errorf("%s in v%d: UploadPack = %v, want a refusal", test.name, version, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s in v%d: UploadPack: %s", test.name, version, err)
+			} else if !bytes.Contains(response.Bytes(), []byte("PACK")) {
+				t.Errorf("%s in v%d: no pack in the response %q", test.name, version, response.Bytes())
+			}
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		lib.HandleError("usage: ./your-git.sh <command> [<args>...]\n", "")
+		lib.HandleError("usage: ./your-git.sh <command> [<args>...]\n")
 	}
 	command := os.Args[1]
 	args := os.Args[2:]